@@ -14,6 +14,8 @@ import (
 	"backend/internal/db"
 	apiHandler "backend/internal/handler"
 	"backend/internal/middleware"
+	"backend/internal/models"
+	"backend/internal/notify"
 	"backend/internal/repository"
 	"backend/internal/router"
 	"backend/internal/service"
@@ -36,6 +38,10 @@ func main() {
 	slog.SetDefault(logger)
 
 	logger.Info("Initializing application...", "env", cfg.Environment)
+	if _, ok := models.Currencies[cfg.StepUpCurrency]; !ok {
+		logger.Error("Unsupported step-up currency", "currency", cfg.StepUpCurrency)
+		os.Exit(1)
+	}
 
 	// Init Tracing
 	shutdownTrace, err := telemetry.InitTracer(context.Background(), cfg.OTLPEndpoint, "banking-api")
@@ -73,17 +79,110 @@ func main() {
 	logger.Info("Database initialized and migrations run")
 
 	repo := repository.NewPostgresRepository(database)
-	userSvc := service.NewUserService(repo, cfg.AuthSecret)
+	keys, err := service.NewKeyManager(context.Background(), repo, service.KeyConfig{
+		Algorithm:        cfg.JWTAlgorithm,
+		RotationInterval: cfg.JWTKeyRotation,
+		// Retired keys must outlive the access tokens they signed
+		GracePeriod:      max(cfg.JWTKeyGracePeriod, cfg.AccessTokenTTL),
+		EncryptionSecret: cfg.AuthSecret,
+	})
+	if err != nil {
+		logger.Error("Failed to initialize signing keys", "error", err)
+		os.Exit(1)
+	}
+	notifier, err := notify.New(cfg.Notifier, cfg.NotifierFilePath)
+	if err != nil {
+		logger.Error("Failed to initialize notifier", "error", err)
+		os.Exit(1)
+	}
+	var breached *service.BreachedPasswords
+	if cfg.BreachedPasswordsFile != "" {
+		breached, err = service.LoadBreachedPasswords(cfg.BreachedPasswordsFile)
+		if err != nil {
+			logger.Error("Failed to load breached password list", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Loaded breached password list", "hashes", breached.Len())
+	}
+	permSvc := service.NewPermissionService(repo)
+	userSvc := service.NewUserService(repo, keys, cache.NewRevocationStore(redisClient), cache.NewAttemptCounter(redisClient), permSvc, notifier, service.AuthConfig{
+		AccessTokenTTL:   cfg.AccessTokenTTL,
+		RefreshTokenTTL:  cfg.RefreshTokenTTL,
+		MFAChallengeTTL:  cfg.MFAChallengeTTL,
+		MFAIssuer:        cfg.MFAIssuer,
+		EncryptionSecret: cfg.AuthSecret,
+		PasswordResetTTL: cfg.PasswordResetTTL,
+		PasswordResetURL: cfg.PasswordResetURL,
+
+		PasswordResetResendInterval: cfg.PasswordResetResendInterval,
+
+		VerificationTTL:            cfg.VerificationTTL,
+		VerificationURL:            cfg.VerificationURL,
+		VerificationResendInterval: cfg.VerificationResendInterval,
+
+		Lockout: service.LockoutConfig{
+			MaxAccountFailures: cfg.LoginMaxAccountFailures,
+			MaxIPFailures:      cfg.LoginMaxIPFailures,
+			FailureWindow:      cfg.LoginFailureWindow,
+			LockoutDuration:    cfg.LoginLockoutDuration,
+			DelayBase:          cfg.LoginDelayBase,
+			DelayMax:           cfg.LoginDelayMax,
+		},
+		Password: service.PasswordPolicy{
+			MinLength:     cfg.PasswordMinLength,
+			MaxLength:     cfg.PasswordMaxLength,
+			RequireUpper:  cfg.PasswordRequireUpper,
+			RequireLower:  cfg.PasswordRequireLower,
+			RequireDigit:  cfg.PasswordRequireDigit,
+			RequireSymbol: cfg.PasswordRequireSymbol,
+			Breached:      breached,
+		},
+	})
 	balSvc := service.NewBalanceService(repo, redisClient)
-	txSvc := service.NewTransactionService(repo, balSvc)
+	rates, err := service.NewRateProvider(cfg.FXRateSource, cfg.FXRatesFile, repo)
+	if err != nil {
+		logger.Error("Failed to initialize exchange rates", "error", err)
+		os.Exit(1)
+	}
+	fxSvc := service.NewFXService(repo, rates)
+	txSvc := service.NewTransactionService(repo, balSvc, userSvc, permSvc, fxSvc, service.TransactionConfig{
+		IdempotencyTTL:  cfg.IdempotencyTTL,
+		StepUpThreshold: cfg.StepUpThreshold,
+		StepUpCurrency:  cfg.StepUpCurrency,
+		StepUpTTL:       cfg.StepUpTTL,
+		HoldTTL:         cfg.HoldTTL,
+		HoldMaxTTL:      cfg.HoldMaxTTL,
+	})
 	poolCtx, poolCancel := context.WithCancel(context.Background())
 	defer poolCancel()
+	go txSvc.CleanupIdempotencyKeys(poolCtx, time.Hour)
+	go txSvc.ExpireConfirmations(poolCtx, time.Minute)
+	go txSvc.ExpireHolds(poolCtx, time.Minute)
+	go userSvc.ExpireAccountStates(poolCtx, time.Minute)
+	go keys.Run(poolCtx, time.Minute)
 
-	pool := worker.NewPool(5, 100, txSvc.ProcessTransaction)
+	pool := worker.NewPool(repo, worker.Config{
+		Workers:      cfg.WorkerCount,
+		PollInterval: cfg.WorkerPollInterval,
+		Lease:        cfg.WorkerLease,
+		MaxAttempts:  cfg.WorkerMaxAttempts,
+		BaseBackoff:  cfg.WorkerBaseBackoff,
+		MaxBackoff:   cfg.WorkerMaxBackoff,
+	}, txSvc.ProcessTransaction)
 	pool.Start(poolCtx)
 	txSvc.SetPool(pool)
 
-	h := apiHandler.NewHandler(userSvc, txSvc, balSvc)
+	standingOrderSvc := service.NewStandingOrderService(repo, txSvc, userSvc, service.StandingOrderConfig{
+		RetryInterval: cfg.StandingOrderRetryInterval,
+		MaxRetries:    cfg.StandingOrderMaxRetries,
+	})
+	go standingOrderSvc.Run(poolCtx, time.Minute)
+
+	keySvc := service.NewAPIKeyService(repo)
+	accountSvc := service.NewAccountService(repo)
+	oauthSvc := service.NewOAuthService(repo, userSvc, service.OAuthConfig{CodeTTL: cfg.OAuthCodeTTL})
+
+	h := apiHandler.NewHandler(userSvc, txSvc, balSvc, keySvc, oauthSvc, permSvc, accountSvc, fxSvc, standingOrderSvc)
 
 	r := router.NewRouter()
 	r.Use(middleware.Logger, middleware.Metrics, middleware.Recovery, middleware.CORS, middleware.RateLimit)
@@ -95,26 +194,110 @@ func main() {
 		w.Write([]byte("OK"))
 	})
 	
+	r.HandleFunc("/.well-known/jwks.json", h.JWKS)
+
 	// Public routes
 	r.HandleFunc("/api/v1/auth/register", h.Register)
 	r.HandleFunc("/api/v1/auth/login", h.Login)
+	r.HandleFunc("/api/v1/auth/login/mfa", h.LoginMFA)
 	r.HandleFunc("/api/v1/auth/refresh", h.Refresh)
+	r.HandleFunc("/api/v1/auth/logout", h.Logout)
+	r.HandleFunc("/api/v1/auth/password/forgot", h.ForgotPassword)
+	r.HandleFunc("/api/v1/auth/password/reset", h.ResetPassword)
+	r.HandleFunc("/api/v1/auth/verify-email", h.VerifyEmail)
+
+	// OAuth2 endpoints for clients, which authenticate themselves
+	r.HandleFunc("/api/v1/oauth/token", h.OAuthToken)
+	r.HandleFunc("/api/v1/oauth/introspect", h.OAuthIntrospect)
+	r.HandleFunc("/api/v1/oauth/revoke", h.OAuthRevoke)
 
 	// Protected routes
 	authMw := middleware.Auth(userSvc)
+	// Routes only accept a user's own session unless they declare the scope an
+	// API key or OAuth token needs; the router rejects those credentials
+	// everywhere else. The exceptions are the routes below with a scope.
+	keyMw := middleware.APIKey(keySvc)
+	scope := middleware.RequireScope
+
+	r.HandleFunc("/api/v1/auth/verify-email/resend", h.ResendVerification, authMw)
+	r.HandleFunc("/api/v1/auth/password/change", h.ChangePassword, authMw)
+
+	// Two-factor Routes
+	r.HandleFunc("/api/v1/auth/mfa/enroll", h.EnrollMFA, authMw)
+	r.HandleFunc("/api/v1/auth/mfa/confirm", h.ConfirmMFA, authMw)
+	r.HandleFunc("/api/v1/auth/mfa/disable", h.DisableMFA, authMw)
+	r.HandleFunc("/api/v1/auth/mfa/recovery-codes", h.RegenerateRecoveryCodes, authMw)
+
+	// OAuth2 Consent Routes, called by our own frontend with the client's query string
+	r.HandleFunc("/api/v1/oauth/authorize", h.OAuthAuthorize, authMw)
+	r.HandleFunc("/api/v1/oauth/authorize/consent", h.OAuthConsent, authMw)
 	
 	// Transaction Routes
-	r.HandleFunc("/api/v1/transactions", h.CreateTransaction, authMw)
-	r.HandleFunc("/api/v1/transactions/history", h.GetTransactionHistory, authMw)
+	r.HandleFunc("/api/v1/transactions", h.CreateTransaction, keyMw, authMw, scope(models.ScopeTransactionsWrite))
+	r.HandleFunc("/api/v1/transactions/history", h.GetTransactionHistory, keyMw, authMw, scope(models.ScopeTransactionsRead))
+	r.HandleFunc("/api/v1/transactions/confirm", h.ConfirmTransaction, authMw) // ?id=
+
+	// Hold Routes
+	r.HandleFunc("/api/v1/holds", h.ListHolds, keyMw, authMw, scope(models.ScopeTransactionsRead))
+	r.HandleFunc("/api/v1/holds/authorize", h.AuthorizeHold, keyMw, authMw, scope(models.ScopeTransactionsWrite))
+	r.HandleFunc("/api/v1/holds/capture", h.CaptureHold, keyMw, authMw, scope(models.ScopeTransactionsWrite)) // ?id=
+	r.HandleFunc("/api/v1/holds/void", h.VoidHold, keyMw, authMw, scope(models.ScopeTransactionsWrite))       // ?id=
+
+	// Standing Order Routes
+	r.HandleFunc("/api/v1/standing-orders", h.ListStandingOrders, keyMw, authMw, scope(models.ScopeTransactionsRead))
+	r.HandleFunc("/api/v1/standing-orders/create", h.CreateStandingOrder, keyMw, authMw, scope(models.ScopeTransactionsWrite))
+	r.HandleFunc("/api/v1/standing-orders/update", h.UpdateStandingOrder, keyMw, authMw, scope(models.ScopeTransactionsWrite)) // ?id=
+	r.HandleFunc("/api/v1/standing-orders/cancel", h.CancelStandingOrder, keyMw, authMw, scope(models.ScopeTransactionsWrite)) // ?id=
 	
 	// Balance Routes
-	r.HandleFunc("/api/v1/balances/current", h.GetBalance, authMw)
-	r.HandleFunc("/api/v1/balances/historical", h.GetBalanceHistory, authMw)
+	r.HandleFunc("/api/v1/balances/current", h.GetBalance, keyMw, authMw, scope(models.ScopeBalancesRead))
+	r.HandleFunc("/api/v1/balances/historical", h.GetBalanceHistory, keyMw, authMw, scope(models.ScopeBalancesRead))
+	r.HandleFunc("/api/v1/balances/ledger", h.GetLedger, keyMw, authMw, scope(models.ScopeBalancesRead))
+
+	// Account Routes
+	r.HandleFunc("/api/v1/accounts", h.ListAccounts, keyMw, authMw, scope(models.ScopeBalancesRead))
+	r.HandleFunc("/api/v1/accounts/open", h.OpenAccount, keyMw, authMw, scope(models.ScopeAccountsWrite))
+	r.HandleFunc("/api/v1/accounts/rename", h.RenameAccount, keyMw, authMw, scope(models.ScopeAccountsWrite)) // ?id=
 	
 	// User Routes
-	roleMw := middleware.Role("admin")
-	r.HandleFunc("/api/v1/users", h.ListUsers, authMw, roleMw)
-	r.HandleFunc("/api/v1/users/delete", h.DeleteUser, authMw, roleMw) // Using query param ?id=
+	can := func(perm string) middleware.Middleware { return middleware.RequirePermission(permSvc, perm) }
+	r.HandleFunc("/api/v1/users", h.ListUsers, keyMw, authMw, can(models.PermUsersRead), scope(models.ScopeUsersRead))
+	r.HandleFunc("/api/v1/users/get", h.GetUser, keyMw, authMw, can(models.PermUsersRead), scope(models.ScopeUsersRead)) // ?id=
+	r.HandleFunc("/api/v1/users/update", h.UpdateUser, keyMw, authMw, can(models.PermUsersWrite), scope(models.ScopeUsersWrite)) // ?id=
+	r.HandleFunc("/api/v1/users/role", h.ChangeUserRole, authMw, can(models.PermRolesManage)) // ?id=
+	r.HandleFunc("/api/v1/users/mfa/reset", h.ResetUserMFA, authMw, can(models.PermUsersMFAReset)) // ?id=
+	r.HandleFunc("/api/v1/users/state", h.SetUserState, keyMw, authMw, can(models.PermUsersRestrict), scope(models.ScopeUsersWrite)) // ?id=
+	r.HandleFunc("/api/v1/users/close", h.CloseUser, keyMw, authMw, can(models.PermUsersClose), scope(models.ScopeUsersWrite)) // ?id=
+	r.HandleFunc("/api/v1/users/revoke-sessions", h.RevokeSessions, keyMw, authMw, can(models.PermUsersWrite), scope(models.ScopeUsersWrite)) // ?id=
+	r.HandleFunc("/api/v1/users/unlock", h.UnlockUser, keyMw, authMw, can(models.PermUsersWrite), scope(models.ScopeUsersWrite)) // ?id=
+
+	// Role Routes
+	r.HandleFunc("/api/v1/roles", h.ListRoles, authMw, can(models.PermRolesManage))
+	r.HandleFunc("/api/v1/roles/save", h.SaveRole, authMw, can(models.PermRolesManage))
+
+	// API Key Routes
+	r.HandleFunc("/api/v1/api-keys", h.ListAPIKeys, authMw, can(models.PermAPIKeysManage))
+	r.HandleFunc("/api/v1/api-keys/create", h.CreateAPIKey, authMw, can(models.PermAPIKeysManage))
+	r.HandleFunc("/api/v1/api-keys/revoke", h.RevokeAPIKey, authMw, can(models.PermAPIKeysManage)) // ?id=
+
+	// OAuth2 Client Routes
+	r.HandleFunc("/api/v1/oauth/clients", h.ListOAuthClients, authMw, can(models.PermOAuthClientsManage))
+	r.HandleFunc("/api/v1/oauth/clients/create", h.CreateOAuthClient, authMw, can(models.PermOAuthClientsManage))
+	r.HandleFunc("/api/v1/oauth/clients/revoke", h.RevokeOAuthClient, authMw, can(models.PermOAuthClientsManage)) // ?id=
+
+	// Exchange Rate Routes
+	r.HandleFunc("/api/v1/fx/rates", h.ListFXRates, keyMw, authMw, scope(models.ScopeBalancesRead))
+	r.HandleFunc("/api/v1/fx/rates/set", h.SetFXRate, authMw, can(models.PermFXManage))
+	r.HandleFunc("/api/v1/fx/rates/delete", h.DeleteFXRate, authMw, can(models.PermFXManage)) // ?base=&quote=
+
+	// Ledger Routes
+	r.HandleFunc("/api/v1/ledger/verify", h.VerifyLedger, keyMw, authMw, can(models.PermLedgerRead), scope(models.ScopeLedgerRead))
+	r.HandleFunc("/api/v1/ledger/adjust", h.AdjustLedger, authMw, can(models.PermLedgerAdjust))
+
+	// Dead-letter Routes
+	r.HandleFunc("/api/v1/jobs/dead", h.ListDeadJobs, keyMw, authMw, can(models.PermJobsManage), scope(models.ScopeJobsWrite))
+	r.HandleFunc("/api/v1/jobs/dead/requeue", h.RequeueDeadJob, keyMw, authMw, can(models.PermJobsManage), scope(models.ScopeJobsWrite)) // ?id=
+	r.HandleFunc("/api/v1/jobs/dead/discard", h.DiscardDeadJob, keyMw, authMw, can(models.PermJobsManage), scope(models.ScopeJobsWrite)) // ?id=
 
 	otelHandler := otelhttp.NewHandler(r, "api-server")
 
@@ -137,8 +320,6 @@ func main() {
 	sign := <-quit
 	logger.Info("Shutdown signal received", "signal", sign.String())
 	
-	poolCancel()
-
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -146,5 +327,9 @@ func main() {
 		logger.Error("Server forced to shutdown", "error", err)
 	}
 
+	// Let in-flight jobs finish; anything still queued stays in Postgres
+	poolCancel()
+	pool.Wait()
+
 	logger.Info("Server exited gracefully")
 }
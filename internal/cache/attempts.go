@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// AttemptCounter counts events, such as failed logins, per key within a
+// fixed window that starts at the first event.
+type AttemptCounter interface {
+	// Add records an event and returns the number of events in the window.
+	Add(ctx context.Context, key string, window time.Duration) (int64, error)
+	Count(ctx context.Context, key string) (int64, error)
+	Reset(ctx context.Context, key string) error
+}
+
+// NewAttemptCounter returns a counter backed by Redis, so counts are shared
+// by every instance, that falls back to process memory when Redis is
+// unavailable. redisClient may be nil, in which case only memory is used.
+func NewAttemptCounter(redisClient *RedisClient) AttemptCounter {
+	mem := NewMemoryAttemptCounter()
+	if redisClient == nil {
+		return mem
+	}
+	return &fallbackAttemptCounter{redis: &redisAttemptCounter{client: redisClient.Client}, memory: mem}
+}
+
+// --- Redis ---
+
+type redisAttemptCounter struct {
+	client *redis.Client
+}
+
+func (c *redisAttemptCounter) Add(ctx context.Context, key string, window time.Duration) (int64, error) {
+	n, err := c.client.Incr(ctx, "attempts:"+key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if n == 1 {
+		if err := c.client.Expire(ctx, "attempts:"+key, window).Err(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+func (c *redisAttemptCounter) Count(ctx context.Context, key string) (int64, error) {
+	n, err := c.client.Get(ctx, "attempts:"+key).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+func (c *redisAttemptCounter) Reset(ctx context.Context, key string) error {
+	return c.client.Del(ctx, "attempts:"+key).Err()
+}
+
+// --- Memory ---
+
+type MemoryAttemptCounter struct {
+	mu      sync.Mutex
+	entries map[string]attemptEntry
+	lastGC  time.Time
+}
+
+type attemptEntry struct {
+	count     int64
+	expiresAt time.Time
+}
+
+func NewMemoryAttemptCounter() *MemoryAttemptCounter {
+	return &MemoryAttemptCounter{
+		entries: make(map[string]attemptEntry),
+		lastGC:  time.Now(),
+	}
+}
+
+func (c *MemoryAttemptCounter) Add(ctx context.Context, key string, window time.Duration) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	e, ok := c.entries[key]
+	if !ok || now.After(e.expiresAt) {
+		e = attemptEntry{expiresAt: now.Add(window)}
+	}
+	e.count++
+	c.entries[key] = e
+	c.gc()
+	return e.count, nil
+}
+
+func (c *MemoryAttemptCounter) Count(ctx context.Context, key string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok && time.Now().Before(e.expiresAt) {
+		return e.count, nil
+	}
+	return 0, nil
+}
+
+func (c *MemoryAttemptCounter) Reset(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+	return nil
+}
+
+// gc drops expired entries at most once a minute. Callers hold c.mu.
+func (c *MemoryAttemptCounter) gc() {
+	now := time.Now()
+	if now.Sub(c.lastGC) < time.Minute {
+		return
+	}
+	c.lastGC = now
+	for key, e := range c.entries {
+		if now.After(e.expiresAt) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// --- Fallback ---
+
+// fallbackAttemptCounter counts in Redis and only relies on memory when
+// Redis cannot be reached.
+type fallbackAttemptCounter struct {
+	redis  *redisAttemptCounter
+	memory *MemoryAttemptCounter
+}
+
+func (c *fallbackAttemptCounter) Add(ctx context.Context, key string, window time.Duration) (int64, error) {
+	memCount, _ := c.memory.Add(ctx, key, window)
+	n, err := c.redis.Add(ctx, key, window)
+	if err != nil {
+		slog.Warn("Redis unavailable, counting attempts in memory only", "error", err)
+		return memCount, nil
+	}
+	return max(n, memCount), nil
+}
+
+func (c *fallbackAttemptCounter) Count(ctx context.Context, key string) (int64, error) {
+	memCount, _ := c.memory.Count(ctx, key)
+	n, err := c.redis.Count(ctx, key)
+	if err != nil {
+		slog.Warn("Redis unavailable, counting attempts in memory only", "error", err)
+		return memCount, nil
+	}
+	return max(n, memCount), nil
+}
+
+func (c *fallbackAttemptCounter) Reset(ctx context.Context, key string) error {
+	_ = c.memory.Reset(ctx, key)
+	if err := c.redis.Reset(ctx, key); err != nil {
+		slog.Warn("Redis unavailable, attempts reset in memory only", "error", err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryAttemptCounter(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		run   func(c *MemoryAttemptCounter) (int64, error)
+		count int64
+	}{
+		{"unknown key", func(c *MemoryAttemptCounter) (int64, error) {
+			return c.Count(ctx, "a")
+		}, 0},
+		{"add increments", func(c *MemoryAttemptCounter) (int64, error) {
+			c.Add(ctx, "a", time.Minute)
+			c.Add(ctx, "a", time.Minute)
+			return c.Add(ctx, "a", time.Minute)
+		}, 3},
+		{"keys are separate", func(c *MemoryAttemptCounter) (int64, error) {
+			c.Add(ctx, "a", time.Minute)
+			c.Add(ctx, "b", time.Minute)
+			return c.Count(ctx, "a")
+		}, 1},
+		{"reset", func(c *MemoryAttemptCounter) (int64, error) {
+			c.Add(ctx, "a", time.Minute)
+			if err := c.Reset(ctx, "a"); err != nil {
+				return 0, err
+			}
+			return c.Count(ctx, "a")
+		}, 0},
+		{"window starts at first event", func(c *MemoryAttemptCounter) (int64, error) {
+			c.Add(ctx, "a", 50*time.Millisecond)
+			time.Sleep(30 * time.Millisecond)
+			c.Add(ctx, "a", 50*time.Millisecond)
+			time.Sleep(30 * time.Millisecond)
+			return c.Count(ctx, "a")
+		}, 0},
+		{"add after window expires starts over", func(c *MemoryAttemptCounter) (int64, error) {
+			c.Add(ctx, "a", 20*time.Millisecond)
+			c.Add(ctx, "a", 20*time.Millisecond)
+			time.Sleep(30 * time.Millisecond)
+			return c.Add(ctx, "a", time.Minute)
+		}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.run(NewMemoryAttemptCounter())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.count {
+				t.Errorf("count = %d, want %d", got, tt.count)
+			}
+		})
+	}
+}
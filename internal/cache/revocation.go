@@ -0,0 +1,184 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RevocationStore tracks access tokens that must be rejected before they expire.
+type RevocationStore interface {
+	// Revoke rejects the token with the given jti until it expires.
+	Revoke(ctx context.Context, jti string, expiresAt time.Time) error
+	// RevokeUser rejects every token for the user issued at or before before,
+	// compared to the microsecond. Entries are kept until keepUntil, by which
+	// point those tokens have expired.
+	RevokeUser(ctx context.Context, userID int64, before time.Time, keepUntil time.Time) error
+	IsRevoked(ctx context.Context, jti string, userID int64, issuedAt time.Time) (bool, error)
+}
+
+// NewRevocationStore returns a store backed by Redis, so revocations are
+// shared by every instance, that falls back to process memory when Redis is
+// unavailable. redisClient may be nil, in which case only memory is used.
+func NewRevocationStore(redisClient *RedisClient) RevocationStore {
+	mem := NewMemoryRevocationStore()
+	if redisClient == nil {
+		return mem
+	}
+	return &fallbackRevocationStore{redis: &redisRevocationStore{client: redisClient.Client}, memory: mem}
+}
+
+// --- Redis ---
+
+type redisRevocationStore struct {
+	client *redis.Client
+}
+
+func (s *redisRevocationStore) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	return s.client.Set(ctx, "revoked:jti:"+jti, 1, time.Until(expiresAt)).Err()
+}
+
+func (s *redisRevocationStore) RevokeUser(ctx context.Context, userID int64, before time.Time, keepUntil time.Time) error {
+	// Stored in seconds, as it was before sub-second precision
+	cutoff := fmt.Sprintf("%d.%06d", before.Unix(), before.Nanosecond()/1000)
+	return s.client.Set(ctx, fmt.Sprintf("revoked:user:%d", userID), cutoff, time.Until(keepUntil)).Err()
+}
+
+func (s *redisRevocationStore) IsRevoked(ctx context.Context, jti string, userID int64, issuedAt time.Time) (bool, error) {
+	pipe := s.client.Pipeline()
+	jtiCmd := pipe.Exists(ctx, "revoked:jti:"+jti)
+	userCmd := pipe.Get(ctx, fmt.Sprintf("revoked:user:%d", userID))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return false, err
+	}
+
+	if jtiCmd.Val() > 0 {
+		return true, nil
+	}
+	if userCmd.Err() == redis.Nil {
+		return false, nil
+	}
+	before, err := strconv.ParseFloat(userCmd.Val(), 64)
+	if err != nil {
+		return false, err
+	}
+	return revokedBefore(issuedAt, time.UnixMicro(int64(math.Round(before*1e6)))), nil
+}
+
+// revokedBefore reports whether a token issued at issuedAt is covered by a
+// revocation of every token issued at or before before.
+func revokedBefore(issuedAt, before time.Time) bool {
+	return !issuedAt.Truncate(time.Microsecond).After(before.Truncate(time.Microsecond))
+}
+
+// --- Memory ---
+
+type MemoryRevocationStore struct {
+	mu     sync.Mutex
+	tokens map[string]time.Time // jti -> expiry
+	users  map[int64]userRevocation
+	lastGC time.Time
+}
+
+type userRevocation struct {
+	before    time.Time
+	keepUntil time.Time
+}
+
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{
+		tokens: make(map[string]time.Time),
+		users:  make(map[int64]userRevocation),
+		lastGC: time.Now(),
+	}
+}
+
+func (s *MemoryRevocationStore) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[jti] = expiresAt
+	s.gc()
+	return nil
+}
+
+func (s *MemoryRevocationStore) RevokeUser(ctx context.Context, userID int64, before time.Time, keepUntil time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[userID] = userRevocation{before: before, keepUntil: keepUntil}
+	s.gc()
+	return nil
+}
+
+func (s *MemoryRevocationStore) IsRevoked(ctx context.Context, jti string, userID int64, issuedAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if exp, ok := s.tokens[jti]; ok && time.Now().Before(exp) {
+		return true, nil
+	}
+	if u, ok := s.users[userID]; ok && time.Now().Before(u.keepUntil) {
+		return revokedBefore(issuedAt, u.before), nil
+	}
+	return false, nil
+}
+
+// gc drops expired entries at most once a minute. Callers hold s.mu.
+func (s *MemoryRevocationStore) gc() {
+	now := time.Now()
+	if now.Sub(s.lastGC) < time.Minute {
+		return
+	}
+	s.lastGC = now
+	for jti, exp := range s.tokens {
+		if now.After(exp) {
+			delete(s.tokens, jti)
+		}
+	}
+	for id, u := range s.users {
+		if now.After(u.keepUntil) {
+			delete(s.users, id)
+		}
+	}
+}
+
+// --- Fallback ---
+
+// fallbackRevocationStore writes to both stores and only relies on memory
+// alone when Redis cannot be reached.
+type fallbackRevocationStore struct {
+	redis  *redisRevocationStore
+	memory *MemoryRevocationStore
+}
+
+func (s *fallbackRevocationStore) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	_ = s.memory.Revoke(ctx, jti, expiresAt)
+	if err := s.redis.Revoke(ctx, jti, expiresAt); err != nil {
+		slog.Warn("Redis unavailable, token revocation kept in memory only", "error", err)
+	}
+	return nil
+}
+
+func (s *fallbackRevocationStore) RevokeUser(ctx context.Context, userID int64, before time.Time, keepUntil time.Time) error {
+	_ = s.memory.RevokeUser(ctx, userID, before, keepUntil)
+	if err := s.redis.RevokeUser(ctx, userID, before, keepUntil); err != nil {
+		slog.Warn("Redis unavailable, user revocation kept in memory only", "user_id", userID, "error", err)
+	}
+	return nil
+}
+
+func (s *fallbackRevocationStore) IsRevoked(ctx context.Context, jti string, userID int64, issuedAt time.Time) (bool, error) {
+	if revoked, _ := s.memory.IsRevoked(ctx, jti, userID, issuedAt); revoked {
+		return true, nil
+	}
+	revoked, err := s.redis.IsRevoked(ctx, jti, userID, issuedAt)
+	if err != nil {
+		slog.Warn("Redis unavailable, checking token revocation in memory only", "error", err)
+		return false, nil
+	}
+	return revoked, nil
+}
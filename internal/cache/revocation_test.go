@@ -0,0 +1,45 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryRevocationStoreRevokeUser(t *testing.T) {
+	ctx := context.Background()
+	before := time.Date(2026, 5, 1, 12, 0, 0, 500_000_000, time.UTC)
+
+	tests := []struct {
+		name     string
+		issuedAt time.Time
+		want     bool
+	}{
+		{"issued a second earlier", before.Add(-time.Second), true},
+		{"issued earlier in the same second", before.Add(-400 * time.Millisecond), true},
+		{"issued at the cutoff", before, true},
+		{"issued within the same microsecond", before.Add(500 * time.Nanosecond), true},
+		{"issued later in the same second", before.Add(400 * time.Millisecond), false},
+		{"issued after", before.Add(time.Second), false},
+		{"second precision iat in the same second", before.Add(400 * time.Millisecond).Truncate(time.Second), true},
+		{"no iat", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryRevocationStore()
+			if err := s.RevokeUser(ctx, 1, before, time.Now().Add(time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.IsRevoked(ctx, "jti", 1, tt.issuedAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("IsRevoked() = %v, want %v", got, tt.want)
+			}
+			if other, _ := s.IsRevoked(ctx, "jti", 2, tt.issuedAt); other {
+				t.Errorf("IsRevoked() for another user = true")
+			}
+		})
+	}
+}
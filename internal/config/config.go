@@ -3,6 +3,8 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -21,6 +23,65 @@ type Config struct {
 	RedisPort     string
 	RedisPassword string
 	OTLPEndpoint  string
+
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	MFAChallengeTTL time.Duration
+	MFAIssuer       string
+
+	PasswordResetTTL            time.Duration
+	PasswordResetURL            string
+	PasswordResetResendInterval time.Duration
+
+	VerificationTTL            time.Duration
+	VerificationURL            string
+	VerificationResendInterval time.Duration
+
+	OAuthCodeTTL time.Duration
+
+	PasswordMinLength     int
+	PasswordMaxLength     int
+	PasswordRequireUpper  bool
+	PasswordRequireLower  bool
+	PasswordRequireDigit  bool
+	PasswordRequireSymbol bool
+	BreachedPasswordsFile string
+
+	LoginMaxAccountFailures int
+	LoginMaxIPFailures      int
+	LoginFailureWindow      time.Duration
+	LoginLockoutDuration    time.Duration
+	LoginDelayBase          time.Duration
+	LoginDelayMax           time.Duration
+
+	Notifier         string
+	NotifierFilePath string
+
+	JWTAlgorithm      string
+	JWTKeyRotation    time.Duration
+	JWTKeyGracePeriod time.Duration
+
+	IdempotencyTTL time.Duration
+
+	StepUpThreshold int64
+	StepUpCurrency  string
+	StepUpTTL       time.Duration
+
+	FXRateSource string
+	FXRatesFile  string
+
+	HoldTTL    time.Duration
+	HoldMaxTTL time.Duration
+
+	StandingOrderRetryInterval time.Duration
+	StandingOrderMaxRetries    int
+
+	WorkerCount        int
+	WorkerPollInterval time.Duration
+	WorkerLease        time.Duration
+	WorkerMaxAttempts  int
+	WorkerBaseBackoff  time.Duration
+	WorkerMaxBackoff   time.Duration
 }
 
 func Load() *Config {
@@ -42,6 +103,65 @@ func Load() *Config {
 		RedisPort:     getEnv("REDIS_PORT", "6379"),
 		RedisPassword: getEnv("REDIS_PASSWORD", ""),
 		OTLPEndpoint:  getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "localhost:4318"),
+
+		AccessTokenTTL:  getEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute),
+		RefreshTokenTTL: getEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+		MFAChallengeTTL: getEnvDuration("MFA_CHALLENGE_TTL", 5*time.Minute),
+		MFAIssuer:       getEnv("MFA_ISSUER", "Banking API"),
+
+		PasswordResetTTL:            getEnvDuration("PASSWORD_RESET_TTL", time.Hour),
+		PasswordResetURL:            getEnv("PASSWORD_RESET_URL", "http://localhost:8080/reset-password?token="),
+		PasswordResetResendInterval: getEnvDuration("PASSWORD_RESET_RESEND_INTERVAL", time.Minute),
+
+		VerificationTTL:            getEnvDuration("EMAIL_VERIFICATION_TTL", 24*time.Hour),
+		VerificationURL:            getEnv("EMAIL_VERIFICATION_URL", "http://localhost:8080/verify-email?token="),
+		VerificationResendInterval: getEnvDuration("EMAIL_VERIFICATION_RESEND_INTERVAL", time.Minute),
+
+		OAuthCodeTTL: getEnvDuration("OAUTH_CODE_TTL", time.Minute),
+
+		PasswordMinLength:     getEnvInt("PASSWORD_MIN_LENGTH", 10),
+		PasswordMaxLength:     getEnvInt("PASSWORD_MAX_LENGTH", 72),
+		PasswordRequireUpper:  getEnvBool("PASSWORD_REQUIRE_UPPER", true),
+		PasswordRequireLower:  getEnvBool("PASSWORD_REQUIRE_LOWER", true),
+		PasswordRequireDigit:  getEnvBool("PASSWORD_REQUIRE_DIGIT", true),
+		PasswordRequireSymbol: getEnvBool("PASSWORD_REQUIRE_SYMBOL", false),
+		BreachedPasswordsFile: getEnv("BREACHED_PASSWORDS_FILE", ""),
+
+		LoginMaxAccountFailures: getEnvInt("LOGIN_MAX_ACCOUNT_FAILURES", 5),
+		LoginMaxIPFailures:      getEnvInt("LOGIN_MAX_IP_FAILURES", 20),
+		LoginFailureWindow:      getEnvDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		LoginLockoutDuration:    getEnvDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		LoginDelayBase:          getEnvDuration("LOGIN_DELAY_BASE", 250*time.Millisecond),
+		LoginDelayMax:           getEnvDuration("LOGIN_DELAY_MAX", 5*time.Second),
+
+		Notifier:         getEnv("NOTIFIER", "log"),
+		NotifierFilePath: getEnv("NOTIFIER_FILE_PATH", "notifications.log"),
+
+		JWTAlgorithm:      getEnv("JWT_ALGORITHM", "EdDSA"),
+		JWTKeyRotation:    getEnvDuration("JWT_KEY_ROTATION", 30*24*time.Hour),
+		JWTKeyGracePeriod: getEnvDuration("JWT_KEY_GRACE_PERIOD", 24*time.Hour),
+
+		IdempotencyTTL: getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour),
+
+		StepUpThreshold: int64(getEnvInt("STEP_UP_THRESHOLD", 100000)),
+		StepUpCurrency:  getEnv("STEP_UP_CURRENCY", "USD"),
+		StepUpTTL:       getEnvDuration("STEP_UP_TTL", 10*time.Minute),
+
+		FXRateSource: getEnv("FX_RATE_SOURCE", "table"),
+		FXRatesFile:  getEnv("FX_RATES_FILE", "fx_rates.json"),
+
+		HoldTTL:    getEnvDuration("HOLD_TTL", 7*24*time.Hour),
+		HoldMaxTTL: getEnvDuration("HOLD_MAX_TTL", 30*24*time.Hour),
+
+		StandingOrderRetryInterval: getEnvDuration("STANDING_ORDER_RETRY_INTERVAL", 4*time.Hour),
+		StandingOrderMaxRetries:    getEnvInt("STANDING_ORDER_MAX_RETRIES", 3),
+
+		WorkerCount:        getEnvInt("WORKER_COUNT", 5),
+		WorkerPollInterval: getEnvDuration("WORKER_POLL_INTERVAL", time.Second),
+		WorkerLease:        getEnvDuration("WORKER_LEASE", 30*time.Second),
+		WorkerMaxAttempts:  getEnvInt("WORKER_MAX_ATTEMPTS", 5),
+		WorkerBaseBackoff:  getEnvDuration("WORKER_BASE_BACKOFF", time.Second),
+		WorkerMaxBackoff:   getEnvDuration("WORKER_MAX_BACKOFF", 5*time.Minute),
 	}
 }
 
@@ -51,3 +171,42 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+func getEnvInt(key string, fallback int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid integer for %s: %q, using %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid boolean for %s: %q, using %t", key, value, fallback)
+		return fallback
+	}
+	return b
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration for %s: %q, using %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
@@ -46,7 +46,10 @@ func RunMigrations(db *sql.DB, migrationsDir string) error {
 			}
 
 			slog.Info("Running migration", "file", file.Name())
-			
+			if err := CheckMigration(string(content)); err != nil {
+				return fmt.Errorf("invalid migration file %s: %w", file.Name(), err)
+			}
+
 			requests := strings.Split(string(content), ";")
 			for _, request := range requests {
 				cmd := strings.TrimSpace(request)
@@ -61,3 +64,15 @@ func RunMigrations(db *sql.DB, migrationsDir string) error {
 	}
 	return nil
 }
+
+// CheckMigration rejects migrations that RunMigrations would split in the
+// wrong place. Statements are split on every ";", so one in a comment cuts
+// the comment in two and leaves its tail at the start of a statement.
+func CheckMigration(content string) error {
+	for i, line := range strings.Split(content, "\n") {
+		if _, comment, ok := strings.Cut(line, "--"); ok && strings.Contains(comment, ";") {
+			return fmt.Errorf("line %d: comments must not contain \";\"", i+1)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckMigration(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"statements", "CREATE TABLE t (id INT);\nALTER TABLE t ADD COLUMN x INT;", false},
+		{"comment", "-- Set when it passes\nALTER TABLE t ADD COLUMN x INT;", false},
+		{"semicolon in comment", "-- Set after failures; cleared later\nALTER TABLE t ADD COLUMN x INT;", true},
+		{"semicolon in trailing comment", "ALTER TABLE t ADD COLUMN x INT -- nullable; for now\n;", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckMigration(tt.content); (err != nil) != tt.wantErr {
+				t.Errorf("CheckMigration() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMigrationsSplitCleanly(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("..", "..", "migrations", "*.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no migrations found")
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			content, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := CheckMigration(string(content)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
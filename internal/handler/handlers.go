@@ -1,22 +1,35 @@
 package handler
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"io"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"backend/internal/middleware"
+	"backend/internal/models"
 	"backend/internal/service"
 )
 
 type Handler struct {
-	userSvc *service.UserService
-	txSvc   *service.TransactionService
-	balSvc  *service.BalanceService
+	userSvc    *service.UserService
+	txSvc      *service.TransactionService
+	balSvc     *service.BalanceService
+	keySvc     *service.APIKeyService
+	oauthSvc   *service.OAuthService
+	permSvc    *service.PermissionService
+	accountSvc *service.AccountService
+	fxSvc      *service.FXService
+	orderSvc   *service.StandingOrderService
 }
 
-func NewHandler(u *service.UserService, t *service.TransactionService, b *service.BalanceService) *Handler {
-	return &Handler{userSvc: u, txSvc: t, balSvc: b}
+func NewHandler(u *service.UserService, t *service.TransactionService, b *service.BalanceService, k *service.APIKeyService, o *service.OAuthService, p *service.PermissionService, a *service.AccountService, f *service.FXService, so *service.StandingOrderService) *Handler {
+	return &Handler{userSvc: u, txSvc: t, balSvc: b, keySvc: k, oauthSvc: o, permSvc: p, accountSvc: a, fxSvc: f, orderSvc: so}
 }
 
 func respondJSON(w http.ResponseWriter, status int, payload interface{}) {
@@ -41,114 +54,1497 @@ func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user, err := h.userSvc.Register(r.Context(), req.Username, req.Email, req.Password)
+	if respondPasswordPolicyError(w, err) {
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusCreated, user)
+}
+
+func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	result, err := h.userSvc.Authenticate(r.Context(), req.Email, req.Password, clientIP(r))
+	if err != nil {
+		respondLoginError(w, err)
+		return
+	}
+	if result.MFAToken != "" {
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"mfa_required": true,
+			"mfa_token":    result.MFAToken,
+		})
+		return
+	}
+	respondLogin(w, result.User, result.Tokens)
+}
+
+func respondLoginError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, service.ErrInvalidCredentials):
+		respondError(w, http.StatusUnauthorized, "Invalid credentials")
+	case errors.Is(err, service.ErrAccountLocked):
+		respondError(w, http.StatusLocked, err.Error())
+	case errors.Is(err, service.ErrAccountClosed), errors.Is(err, service.ErrAccountSuspended):
+		respondError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, service.ErrTooManyAttempts):
+		respondError(w, http.StatusTooManyRequests, err.Error())
+	default:
+		respondError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// clientIP returns the address of the peer, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func respondLogin(w http.ResponseWriter, user *models.User, tokens *models.AuthTokens) {
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"user":          user,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	})
+}
+
+// LoginMFA completes a login for a user with two-factor authentication.
+func (h *Handler) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"` // TOTP or recovery code
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" || req.Code == "" {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	user, tokens, err := h.userSvc.CompleteMFALogin(r.Context(), req.MFAToken, req.Code, clientIP(r))
+	if errors.Is(err, service.ErrAccountLocked) || errors.Is(err, service.ErrTooManyAttempts) ||
+		errors.Is(err, service.ErrAccountClosed) || errors.Is(err, service.ErrAccountSuspended) {
+		respondLoginError(w, err)
+		return
+	}
+	if err != nil {
+		respondMFAError(w, err)
+		return
+	}
+	respondLogin(w, user, tokens)
+}
+
+func (h *Handler) EnrollMFA(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(middleware.UserIDKey)
+	if userIDVal == nil {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	enrollment, err := h.userSvc.EnrollMFA(r.Context(), int64(userIDVal.(float64)))
+	if err != nil {
+		respondMFAError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, enrollment)
+}
+
+func (h *Handler) ConfirmMFA(w http.ResponseWriter, r *http.Request) {
+	h.withMFACode(w, r, func(userID int64, code string) {
+		codes, err := h.userSvc.ConfirmMFA(r.Context(), userID, code)
+		if err != nil {
+			respondMFAError(w, err)
+			return
+		}
+		respondJSON(w, http.StatusOK, map[string]interface{}{"recovery_codes": codes})
+	})
+}
+
+func (h *Handler) DisableMFA(w http.ResponseWriter, r *http.Request) {
+	h.withMFACode(w, r, func(userID int64, code string) {
+		if err := h.userSvc.DisableMFA(r.Context(), userID, code); err != nil {
+			respondMFAError(w, err)
+			return
+		}
+		respondJSON(w, http.StatusOK, map[string]string{"status": "disabled"})
+	})
+}
+
+func (h *Handler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	h.withMFACode(w, r, func(userID int64, code string) {
+		codes, err := h.userSvc.RegenerateRecoveryCodes(r.Context(), userID, code)
+		if err != nil {
+			respondMFAError(w, err)
+			return
+		}
+		respondJSON(w, http.StatusOK, map[string]interface{}{"recovery_codes": codes})
+	})
+}
+
+// withMFACode decodes {"code": ...} for the authenticated user.
+func (h *Handler) withMFACode(w http.ResponseWriter, r *http.Request, fn func(userID int64, code string)) {
+	userIDVal := r.Context().Value(middleware.UserIDKey)
+	if userIDVal == nil {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	fn(int64(userIDVal.(float64)), req.Code)
+}
+
+func respondMFAError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, service.ErrInvalidMFAToken), errors.Is(err, service.ErrInvalidMFACode):
+		respondError(w, http.StatusUnauthorized, err.Error())
+	case errors.Is(err, service.ErrMFAAlreadyEnabled):
+		respondError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, service.ErrMFANotEnrolled):
+		respondError(w, http.StatusBadRequest, err.Error())
+	default:
+		respondError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func (h *Handler) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondJSON(w, http.StatusOK, h.userSvc.JWKS())
+}
+
+func (h *Handler) CreateTransaction(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		FromUserID    *int64 `json:"from_user_id"`
+		ToUserID      *int64 `json:"to_user_id"`
+		FromAccountID *int64 `json:"from_account_id"`
+		ToAccountID   *int64 `json:"to_account_id"`
+		Amount        int64  `json:"amount"`
+		Type          string `json:"type"`
+		OnBehalfOf    *int64 `json:"on_behalf_of"` // Needs transactions.act_on_behalf
+		Reason        string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	userIDVal := r.Context().Value(middleware.UserIDKey)
+	if userIDVal == nil {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	role, _ := r.Context().Value(middleware.UserRoleKey).(string)
+	actor := service.Actor{
+		UserID:     int64(userIDVal.(float64)),
+		Role:       role,
+		OnBehalfOf: req.OnBehalfOf,
+		Reason:     req.Reason,
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > 255 {
+		respondError(w, http.StatusBadRequest, "Idempotency-Key must be at most 255 characters")
+		return
+	}
+
+	txReq := service.TransactionRequest{
+		Type:          req.Type,
+		Amount:        req.Amount,
+		FromUserID:    req.FromUserID,
+		ToUserID:      req.ToUserID,
+		FromAccountID: req.FromAccountID,
+		ToAccountID:   req.ToAccountID,
+	}
+	var (
+		tx       *models.Transaction
+		replayed bool
+		err      error
+	)
+	if key == "" {
+		tx, err = h.txSvc.Create(r.Context(), actor, txReq)
+	} else {
+		tx, replayed, err = h.txSvc.CreateIdempotent(r.Context(), actor, key, txReq)
+	}
+	if err != nil {
+		respondTransactionError(w, err)
+		return
+	}
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	respondJSON(w, http.StatusAccepted, tx)
+}
+
+// ConfirmTransaction releases a high-value transaction after the caller
+// re-authenticates with their password or a TOTP code.
+func (h *Handler) ConfirmTransaction(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(middleware.UserIDKey)
+	if userIDVal == nil {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	var req struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Password == "" && req.Code == "") {
+		respondError(w, http.StatusBadRequest, "password or code is required")
+		return
+	}
+
+	tx, err := h.txSvc.Confirm(r.Context(), int64(userIDVal.(float64)), id, req.Password, req.Code)
+	if err != nil {
+		respondTransactionError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusAccepted, tx)
+}
+
+func respondTransactionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, service.ErrForbidden):
+		respondError(w, http.StatusForbidden, "Not allowed to debit this account")
+	case errors.Is(err, service.ErrEmailNotVerified), errors.Is(err, service.ErrAccountClosed),
+		errors.Is(err, service.ErrAccountFrozen), errors.Is(err, service.ErrAccountSuspended):
+		respondError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, service.ErrInvalidTransaction):
+		respondError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrIdempotencyConflict), errors.Is(err, service.ErrFXRateUnavailable):
+		respondError(w, http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, sql.ErrNoRows):
+		respondError(w, http.StatusNotFound, "Transaction not found")
+	case errors.Is(err, service.ErrReauthFailed):
+		respondError(w, http.StatusUnauthorized, err.Error())
+	case errors.Is(err, service.ErrAccountLocked):
+		respondError(w, http.StatusLocked, err.Error())
+	case errors.Is(err, service.ErrNotAwaitingConfirmation):
+		respondError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, service.ErrConfirmationExpired):
+		respondError(w, http.StatusGone, err.Error())
+	default:
+		respondError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func (h *Handler) ListHolds(w http.ResponseWriter, r *http.Request) {
+	userID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	holds, err := h.txSvc.ListHolds(r.Context(), userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, holds)
+}
+
+// AuthorizeHold reserves funds in the caller's account, or another user's
+// with on_behalf_of, to be captured or voided later.
+func (h *Handler) AuthorizeHold(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		FromUserID    *int64     `json:"from_user_id"`
+		FromAccountID *int64     `json:"from_account_id"`
+		ToUserID      *int64     `json:"to_user_id"`
+		ToAccountID   *int64     `json:"to_account_id"`
+		Amount        int64      `json:"amount"`
+		Description   string     `json:"description"`
+		ExpiresAt     *time.Time `json:"expires_at"`
+		OnBehalfOf    *int64     `json:"on_behalf_of"` // Needs transactions.act_on_behalf
+		Reason        string     `json:"reason"`
+		Password      string     `json:"password"` // Needed from the step-up threshold up
+		Code          string     `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	role, _ := r.Context().Value(middleware.UserRoleKey).(string)
+	actor := service.Actor{
+		UserID:     int64(r.Context().Value(middleware.UserIDKey).(float64)),
+		Role:       role,
+		OnBehalfOf: req.OnBehalfOf,
+		Reason:     req.Reason,
+	}
+	hold, err := h.txSvc.AuthorizeHold(r.Context(), actor, service.HoldRequest{
+		Amount:        req.Amount,
+		FromUserID:    req.FromUserID,
+		FromAccountID: req.FromAccountID,
+		ToUserID:      req.ToUserID,
+		ToAccountID:   req.ToAccountID,
+		Description:   req.Description,
+		ExpiresAt:     req.ExpiresAt,
+		Password:      req.Password,
+		Code:          req.Code,
+	})
+	if err != nil {
+		respondHoldError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusCreated, hold)
+}
+
+// CaptureHold captures the whole hold, or the amount given in the body.
+func (h *Handler) CaptureHold(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	var req struct {
+		Amount *int64 `json:"amount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	userID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	hold, tx, err := h.txSvc.CaptureHold(r.Context(), userID, id, req.Amount)
+	if err != nil {
+		respondHoldError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"hold": hold, "transaction": tx})
+}
+
+func (h *Handler) VoidHold(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	userID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	hold, err := h.txSvc.VoidHold(r.Context(), userID, id)
+	if err != nil {
+		respondHoldError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, hold)
+}
+
+func respondHoldError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		respondError(w, http.StatusNotFound, "Hold not found")
+	case errors.Is(err, service.ErrInvalidHold):
+		respondError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrInsufficientFunds):
+		respondError(w, http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, service.ErrHoldNotActive):
+		respondError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, service.ErrHoldExpired):
+		respondError(w, http.StatusGone, err.Error())
+	default:
+		respondTransactionError(w, err)
+	}
+}
+
+func (h *Handler) ListStandingOrders(w http.ResponseWriter, r *http.Request) {
+	userID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	orders, err := h.orderSvc.List(r.Context(), userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, orders)
+}
+
+// CreateStandingOrder sets up a one-off or recurring transfer from one of the
+// caller's accounts. Dates are given as YYYY-MM-DD, in UTC.
+func (h *Handler) CreateStandingOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		FromAccountID       *int64 `json:"from_account_id"`
+		ToUserID            *int64 `json:"to_user_id"`
+		ToAccountID         *int64 `json:"to_account_id"`
+		Amount              int64  `json:"amount"`
+		Description         string `json:"description"`
+		Frequency           string `json:"frequency"`
+		StartDate           string `json:"start_date"`
+		EndDate             string `json:"end_date"`
+		OnInsufficientFunds string `json:"on_insufficient_funds"`
+		Password            string `json:"password"` // Needed from the step-up threshold up
+		Code                string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	start, err := time.Parse(time.DateOnly, req.StartDate)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "start_date must be a date in YYYY-MM-DD format")
+		return
+	}
+	var end *time.Time
+	if req.EndDate != "" {
+		t, err := time.Parse(time.DateOnly, req.EndDate)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "end_date must be a date in YYYY-MM-DD format")
+			return
+		}
+		end = &t
+	}
+
+	userID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	order, err := h.orderSvc.Create(r.Context(), userID, service.StandingOrderRequest{
+		FromAccountID:       req.FromAccountID,
+		ToUserID:            req.ToUserID,
+		ToAccountID:         req.ToAccountID,
+		Amount:              req.Amount,
+		Description:         req.Description,
+		Frequency:           req.Frequency,
+		StartDate:           start,
+		EndDate:             end,
+		OnInsufficientFunds: req.OnInsufficientFunds,
+		Password:            req.Password,
+		Code:                req.Code,
+	})
+	if err != nil {
+		respondStandingOrderError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusCreated, order)
+}
+
+// UpdateStandingOrder changes the fields given in the body. An empty
+// end_date removes the end date.
+func (h *Handler) UpdateStandingOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	var req struct {
+		Amount              *int64  `json:"amount"`
+		Description         *string `json:"description"`
+		EndDate             *string `json:"end_date"`
+		OnInsufficientFunds *string `json:"on_insufficient_funds"`
+		Password            string  `json:"password"`
+		Code                string  `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	update := service.StandingOrderUpdate{
+		Amount:              req.Amount,
+		Description:         req.Description,
+		OnInsufficientFunds: req.OnInsufficientFunds,
+		Password:            req.Password,
+		Code:                req.Code,
+	}
+	if req.EndDate != nil {
+		if *req.EndDate == "" {
+			update.ClearEndDate = true
+		} else {
+			t, err := time.Parse(time.DateOnly, *req.EndDate)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, "end_date must be a date in YYYY-MM-DD format")
+				return
+			}
+			update.EndDate = &t
+		}
+	}
+
+	userID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	order, err := h.orderSvc.Update(r.Context(), userID, id, update)
+	if err != nil {
+		respondStandingOrderError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, order)
+}
+
+func (h *Handler) CancelStandingOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	userID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	order, err := h.orderSvc.Cancel(r.Context(), userID, id)
+	if err != nil {
+		respondStandingOrderError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, order)
+}
+
+func respondStandingOrderError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		respondError(w, http.StatusNotFound, "Standing order not found")
+	case errors.Is(err, service.ErrInvalidStandingOrder):
+		respondError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrStandingOrderNotActive):
+		respondError(w, http.StatusConflict, err.Error())
+	default:
+		respondTransactionError(w, err)
+	}
+}
+
+func (h *Handler) Refresh(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	tokens, err := h.userSvc.Refresh(r.Context(), req.RefreshToken)
+	if errors.Is(err, service.ErrInvalidRefreshToken) || errors.Is(err, service.ErrRefreshTokenReused) ||
+		errors.Is(err, service.ErrAccountClosed) || errors.Is(err, service.ErrAccountSuspended) {
+		respondError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, tokens)
+}
+
+func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	err := h.userSvc.Logout(r.Context(), req.RefreshToken)
+	if errors.Is(err, service.ErrInvalidRefreshToken) {
+		respondError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Also revoke the access token used for this request, if any
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if err := h.userSvc.RevokeAccessToken(r.Context(), bearer); err != nil {
+			respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "logged_out"})
+}
+
+func (h *Handler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	err := h.userSvc.VerifyEmail(r.Context(), req.Token)
+	if errors.Is(err, service.ErrInvalidVerificationToken) {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "verified"})
+}
+
+func (h *Handler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(middleware.UserIDKey)
+	if userIDVal == nil {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	err := h.userSvc.SendVerification(r.Context(), int64(userIDVal.(float64)))
+	switch {
+	case errors.Is(err, service.ErrVerificationThrottled):
+		respondError(w, http.StatusTooManyRequests, err.Error())
+	case errors.Is(err, service.ErrAlreadyVerified):
+		respondError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		respondError(w, http.StatusInternalServerError, err.Error())
+	default:
+		respondJSON(w, http.StatusAccepted, map[string]string{"status": "sent"})
+	}
+}
+
+func (h *Handler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	if err := h.userSvc.RequestPasswordReset(r.Context(), req.Email); err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Same response whether or not the account exists
+	respondJSON(w, http.StatusAccepted, map[string]string{"status": "reset_requested"})
+}
+
+func (h *Handler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || req.NewPassword == "" {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	err := h.userSvc.ResetPassword(r.Context(), req.Token, req.NewPassword)
+	if respondPasswordPolicyError(w, err) {
+		return
+	}
+	if errors.Is(err, service.ErrInvalidResetToken) {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "password_reset"})
+}
+
+func (h *Handler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(middleware.UserIDKey)
+	if userIDVal == nil {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		Code            string `json:"code"` // Needed if MFA is enabled
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.CurrentPassword == "" || req.NewPassword == "" {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	err := h.userSvc.ChangePassword(r.Context(), int64(userIDVal.(float64)), req.CurrentPassword, req.Code, req.NewPassword, clientIP(r))
+	if respondPasswordPolicyError(w, err) {
+		return
+	}
+	switch {
+	case errors.Is(err, service.ErrReauthFailed):
+		respondError(w, http.StatusUnauthorized, err.Error())
+		return
+	case errors.Is(err, service.ErrAccountLocked):
+		respondError(w, http.StatusLocked, err.Error())
+		return
+	case errors.Is(err, service.ErrTooManyAttempts):
+		respondError(w, http.StatusTooManyRequests, err.Error())
+		return
+	case err != nil:
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "password_changed"})
+}
+
+// respondPasswordPolicyError writes a 400 listing every broken rule if err is
+// a password policy error, and reports whether it did.
+func respondPasswordPolicyError(w http.ResponseWriter, err error) bool {
+	var policyErr *service.PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+	respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+		"error":      service.ErrWeakPassword.Error(),
+		"violations": policyErr.Violations,
+	})
+	return true
+}
+
+func (h *Handler) GetTransactionHistory(w http.ResponseWriter, r *http.Request) {
+    userIDVal := r.Context().Value(middleware.UserIDKey)
+    if userIDVal == nil {
+         respondError(w, http.StatusUnauthorized, "Unauthorized")
+         return
+    }
+    userID := int64(userIDVal.(float64))
+    
+    txs, err := h.txSvc.GetHistory(r.Context(), userID)
+    if err != nil {
+        respondError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    respondJSON(w, http.StatusOK, txs)
+}
+
+func (h *Handler) GetBalanceHistory(w http.ResponseWriter, r *http.Request) {
+    userIDVal := r.Context().Value(middleware.UserIDKey)
+    if userIDVal == nil {
+         respondError(w, http.StatusUnauthorized, "Unauthorized")
+         return
+    }
+    userID := int64(userIDVal.(float64))
+    
+    logs, err := h.balSvc.GetHistory(r.Context(), userID)
+    if err != nil {
+        respondError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    respondJSON(w, http.StatusOK, logs)
+}
+
+func (h *Handler) GetLedger(w http.ResponseWriter, r *http.Request) {
+	userIDVal := r.Context().Value(middleware.UserIDKey)
+	if userIDVal == nil {
+		respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	userID := int64(userIDVal.(float64))
+
+	postings, err := h.balSvc.GetLedger(r.Context(), userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, postings)
+}
+
+func (h *Handler) ListAccounts(w http.ResponseWriter, r *http.Request) {
+	userID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	accounts, err := h.accountSvc.List(r.Context(), userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, accounts)
+}
+
+func (h *Handler) OpenAccount(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Type     string `json:"type"`
+		Name     string `json:"name"`
+		Currency string `json:"currency"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	userID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	account, err := h.accountSvc.Open(r.Context(), userID, req.Type, req.Name, req.Currency)
+	if err != nil {
+		respondAccountError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusCreated, account)
+}
+
+func (h *Handler) RenameAccount(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	userID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	account, err := h.accountSvc.Rename(r.Context(), userID, id, req.Name)
+	if err != nil {
+		respondAccountError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, account)
+}
+
+func respondAccountError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		respondError(w, http.StatusNotFound, "Account not found")
+	case errors.Is(err, service.ErrInvalidAccount):
+		respondError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrAccountClosed):
+		respondError(w, http.StatusForbidden, err.Error())
+	default:
+		respondError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func (h *Handler) ListFXRates(w http.ResponseWriter, r *http.Request) {
+	rates, err := h.fxSvc.Rates(r.Context())
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, rates)
+}
+
+// SetFXRate creates or replaces the rate converting one unit of base into quote.
+func (h *Handler) SetFXRate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Base  string `json:"base"`
+		Quote string `json:"quote"`
+		Rate  string `json:"rate"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	actorID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	rate, err := h.fxSvc.SetRate(r.Context(), actorID, req.Base, req.Quote, req.Rate)
+	if err != nil {
+		respondFXError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, rate)
+}
+
+func (h *Handler) DeleteFXRate(w http.ResponseWriter, r *http.Request) {
+	actorID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	q := r.URL.Query()
+	if err := h.fxSvc.DeleteRate(r.Context(), actorID, q.Get("base"), q.Get("quote")); err != nil {
+		respondFXError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+func respondFXError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		respondError(w, http.StatusNotFound, "Exchange rate not found")
+	case errors.Is(err, service.ErrUnsupportedCurrency), errors.Is(err, service.ErrInvalidFXRate):
+		respondError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrFXRatesReadOnly):
+		respondError(w, http.StatusConflict, err.Error())
+	default:
+		respondError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func (h *Handler) VerifyLedger(w http.ResponseWriter, r *http.Request) {
+	report, err := h.balSvc.VerifyLedger(r.Context())
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, report)
+}
+
+// AdjustLedger posts a correction to an account's balance against the
+// external account.
+func (h *Handler) AdjustLedger(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		AccountID int64  `json:"account_id"`
+		Amount    int64  `json:"amount"` // Positive to credit the account, negative to debit it
+		Reason    string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	actorID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	entry, err := h.balSvc.Adjust(r.Context(), actorID, req.AccountID, req.Amount, strings.TrimSpace(req.Reason))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		respondError(w, http.StatusNotFound, "Account not found")
+	case errors.Is(err, service.ErrInsufficientFunds):
+		respondError(w, http.StatusUnprocessableEntity, err.Error())
+	case err != nil:
+		respondTransactionError(w, err)
+	default:
+		respondJSON(w, http.StatusCreated, entry)
+	}
+}
+
+func (h *Handler) ListDeadJobs(w http.ResponseWriter, r *http.Request) {
+	jobs, err := h.txSvc.ListDeadJobs(r.Context())
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, jobs)
+}
+
+func (h *Handler) RequeueDeadJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	err = h.txSvc.RequeueDeadJob(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, "Dead job not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "requeued"})
+}
+
+func (h *Handler) DiscardDeadJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	err = h.txSvc.DiscardDeadJob(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, "Dead job not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "discarded"})
+}
+
+func (h *Handler) ListUsers(w http.ResponseWriter, r *http.Request) {
+    users, err := h.userSvc.ListUsers(r.Context())
+    if err != nil {
+        respondError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    respondJSON(w, http.StatusOK, users)
+}
+
+// CloseUser closes a user's account. If it still holds funds, the balances
+// are paid out to payout_to_user_id.
+func (h *Handler) CloseUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	var req struct {
+		Reason         string `json:"reason"`
+		PayoutToUserID *int64 `json:"payout_to_user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	actorID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	payouts, err := h.txSvc.CloseAccount(r.Context(), actorID, id, req.Reason, req.PayoutToUserID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		respondError(w, http.StatusNotFound, "User not found")
+	case errors.Is(err, service.ErrInvalidClosure), errors.Is(err, service.ErrBalanceNotZero):
+		respondError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrAccountClosed), errors.Is(err, service.ErrTransactionsInProgress),
+		errors.Is(err, service.ErrAccountFrozen), errors.Is(err, service.ErrAccountSuspended):
+		respondError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, service.ErrFXRateUnavailable):
+		respondError(w, http.StatusUnprocessableEntity, err.Error())
+	case err != nil:
+		respondError(w, http.StatusInternalServerError, err.Error())
+	default:
+		respondJSON(w, http.StatusOK, map[string]interface{}{"status": "closed", "payouts": payouts})
+	}
+}
+
+// SetUserState freezes, suspends or reactivates a user's account.
+func (h *Handler) SetUserState(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	var req struct {
+		State     string     `json:"state"`
+		Reason    string     `json:"reason"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	actorID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	user, err := h.userSvc.SetAccountState(r.Context(), actorID, id, req.State, req.Reason, req.ExpiresAt)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		respondError(w, http.StatusNotFound, "User not found")
+	case errors.Is(err, service.ErrInvalidAccountState):
+		respondError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrAccountClosed):
+		respondError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		respondError(w, http.StatusInternalServerError, err.Error())
+	default:
+		respondJSON(w, http.StatusOK, user)
+	}
+}
+
+// recentTransactionLimit is how many transactions GetUser shows.
+const recentTransactionLimit = 20
+
+// GetUser returns a user together with their accounts and latest
+// transactions, for the back office.
+func (h *Handler) GetUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	actorID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	user, err := h.userSvc.GetUser(r.Context(), actorID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, "User not found")
+		return
+	}
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	respondJSON(w, http.StatusCreated, user)
+	accounts, err := h.accountSvc.List(r.Context(), id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	txs, err := h.txSvc.GetRecent(r.Context(), id, recentTransactionLimit)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"user":                user,
+		"accounts":            accounts,
+		"recent_transactions": txs,
+	})
 }
 
-func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
 	var req struct {
+		Username string `json:"username"`
 		Email    string `json:"email"`
-		Password string `json:"password"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Username == "" && req.Email == "") {
 		respondError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	user, token, err := h.userSvc.Authenticate(r.Context(), req.Email, req.Password)
+	actorID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	user, err := h.userSvc.UpdateProfile(r.Context(), actorID, id, req.Username, req.Email)
 	if err != nil {
-		respondError(w, http.StatusUnauthorized, "Invalid credentials")
+		respondUserUpdateError(w, err)
 		return
 	}
-	respondJSON(w, http.StatusOK, map[string]interface{}{
-		"user":  user,
-		"token": token,
-	})
+	respondJSON(w, http.StatusOK, user)
 }
 
-func (h *Handler) CreateTransaction(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) ChangeUserRole(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Role == "" {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	actorID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	user, err := h.userSvc.ChangeRole(r.Context(), actorID, id, req.Role)
+	if err != nil {
+		respondUserUpdateError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, user)
+}
+
+func respondUserUpdateError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		respondError(w, http.StatusNotFound, "User not found")
+	case errors.Is(err, service.ErrInvalidUser), errors.Is(err, service.ErrUnknownRole):
+		respondError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrUserExists):
+		respondError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, service.ErrPrivileged):
+		respondError(w, http.StatusForbidden, err.Error())
+	default:
+		respondError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func (h *Handler) ResetUserMFA(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	actorID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	err = h.userSvc.ResetMFA(r.Context(), actorID, id)
+	if errors.Is(err, service.ErrMFANotEnrolled) {
+		respondError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		respondUserUpdateError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "mfa_reset"})
+}
+
+func (h *Handler) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	actorID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	err = h.userSvc.UnlockUser(r.Context(), actorID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "unlocked"})
+}
+
+func (h *Handler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name      string     `json:"name"`
+		UserID    int64      `json:"user_id"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" || req.UserID == 0 {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		respondError(w, http.StatusBadRequest, "expires_at must be in the future")
+		return
+	}
+
+	actorID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	key, secret, err := h.keySvc.Create(r.Context(), actorID, req.Name, req.UserID, req.Scopes, req.ExpiresAt)
+	if errors.Is(err, service.ErrInvalidScope) {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusCreated, map[string]interface{}{"api_key": key, "key": secret})
+}
+
+func (h *Handler) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.keySvc.List(r.Context())
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, keys)
+}
+
+func (h *Handler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	actorID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	err = h.keySvc.Revoke(r.Context(), actorID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, "API key not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "revoked"})
+}
+
+func (h *Handler) ListRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := h.permSvc.ListRoles(r.Context())
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, roles)
+}
+
+func (h *Handler) SaveRole(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		FromUserID *int64 `json:"from_user_id"`
-		ToUserID   *int64 `json:"to_user_id"`
-		Amount     int64  `json:"amount"`
-		Type       string `json:"type"`
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Permissions []string `json:"permissions"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		respondError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	tx, err := h.txSvc.Create(r.Context(), req.FromUserID, req.ToUserID, req.Amount, req.Type)
+	actorID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	role, err := h.permSvc.SaveRole(r.Context(), actorID, req.Name, req.Description, req.Permissions)
+	if errors.Is(err, service.ErrInvalidRole) || errors.Is(err, service.ErrInvalidPermission) {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	respondJSON(w, http.StatusAccepted, tx)
+	respondJSON(w, http.StatusOK, role)
 }
 
-func (h *Handler) Refresh(w http.ResponseWriter, r *http.Request) {
-    respondError(w, http.StatusNotImplemented, "Refresh not implemented yet")
+func (h *Handler) CreateOAuthClient(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential bool     `json:"confidential"`
+		UserID       *int64   `json:"user_id"` // Needed for client_credentials
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	actorID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	client, secret, err := h.oauthSvc.RegisterClient(r.Context(), actorID, req.Name, req.RedirectURIs, req.Scopes, req.Confidential, req.UserID)
+	if errors.Is(err, service.ErrInvalidScope) || errors.Is(err, service.ErrInvalidClientMetadata) {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp := map[string]interface{}{"client": client}
+	if secret != "" {
+		resp["client_secret"] = secret
+	}
+	respondJSON(w, http.StatusCreated, resp)
 }
 
-func (h *Handler) GetTransactionHistory(w http.ResponseWriter, r *http.Request) {
-    userIDVal := r.Context().Value(middleware.UserIDKey)
-    if userIDVal == nil {
-         respondError(w, http.StatusUnauthorized, "Unauthorized")
-         return
-    }
-    userID := int64(userIDVal.(float64))
-    
-    txs, err := h.txSvc.GetHistory(r.Context(), userID)
-    if err != nil {
-        respondError(w, http.StatusInternalServerError, err.Error())
-        return
-    }
-    respondJSON(w, http.StatusOK, txs)
+func (h *Handler) ListOAuthClients(w http.ResponseWriter, r *http.Request) {
+	clients, err := h.oauthSvc.ListClients(r.Context())
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, clients)
 }
 
-func (h *Handler) GetBalanceHistory(w http.ResponseWriter, r *http.Request) {
-    userIDVal := r.Context().Value(middleware.UserIDKey)
-    if userIDVal == nil {
-         respondError(w, http.StatusUnauthorized, "Unauthorized")
-         return
-    }
-    userID := int64(userIDVal.(float64))
-    
-    logs, err := h.balSvc.GetHistory(r.Context(), userID)
-    if err != nil {
-        respondError(w, http.StatusInternalServerError, err.Error())
-        return
-    }
-    respondJSON(w, http.StatusOK, logs)
+func (h *Handler) RevokeOAuthClient(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	actorID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	err = h.oauthSvc.RevokeClient(r.Context(), actorID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, "OAuth client not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "revoked"})
 }
 
-func (h *Handler) ListUsers(w http.ResponseWriter, r *http.Request) {
-    users, err := h.userSvc.ListUsers(r.Context())
-    if err != nil {
-        respondError(w, http.StatusInternalServerError, err.Error())
-        return
-    }
-    respondJSON(w, http.StatusOK, users)
+// OAuthAuthorize validates an authorization request and returns what the
+// consent screen should show. The query string is the one the client sent.
+func (h *Handler) OAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+	consent, err := h.oauthSvc.PrepareAuthorization(r.Context(), authorizeRequest(r))
+	if err != nil {
+		respondOAuthError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, consent)
 }
 
-func (h *Handler) DeleteUser(w http.ResponseWriter, r *http.Request) {
-    idStr := r.URL.Query().Get("id")
-    id, err := strconv.ParseInt(idStr, 10, 64)
-    if err != nil {
-        respondError(w, http.StatusBadRequest, "Invalid ID")
-        return
-    }
-    err = h.userSvc.DeleteUser(r.Context(), id)
-    if err != nil {
-        respondError(w, http.StatusInternalServerError, err.Error())
-        return
-    }
-    respondJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+// OAuthConsent records the user's decision and returns the URL to send the
+// browser back to the client with.
+func (h *Handler) OAuthConsent(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Approve bool `json:"approve"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	userID := int64(r.Context().Value(middleware.UserIDKey).(float64))
+	redirect, err := h.oauthSvc.Authorize(r.Context(), userID, authorizeRequest(r), req.Approve)
+	if err != nil {
+		respondOAuthError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"redirect_uri": redirect})
+}
+
+func authorizeRequest(r *http.Request) service.AuthorizeRequest {
+	q := r.URL.Query()
+	return service.AuthorizeRequest{
+		ResponseType:        q.Get("response_type"),
+		ClientID:            q.Get("client_id"),
+		RedirectURI:         q.Get("redirect_uri"),
+		Scope:               q.Get("scope"),
+		State:               q.Get("state"),
+		CodeChallenge:       q.Get("code_challenge"),
+		CodeChallengeMethod: q.Get("code_challenge_method"),
+	}
+}
+
+// OAuthToken is the token endpoint. As RFC 6749 requires, it takes a form
+// body, and clients may authenticate with HTTP Basic or form parameters.
+func (h *Handler) OAuthToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		respondOAuthError(w, &service.OAuthError{Code: "invalid_request", Description: "invalid form body"})
+		return
+	}
+	clientID, clientSecret := clientCredentials(r)
+	token, err := h.oauthSvc.Token(r.Context(), service.TokenRequest{
+		GrantType:    r.PostForm.Get("grant_type"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Code:         r.PostForm.Get("code"),
+		RedirectURI:  r.PostForm.Get("redirect_uri"),
+		CodeVerifier: r.PostForm.Get("code_verifier"),
+		RefreshToken: r.PostForm.Get("refresh_token"),
+		Scope:        r.PostForm.Get("scope"),
+	})
+	if err != nil {
+		respondOAuthError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondJSON(w, http.StatusOK, token)
+}
+
+func (h *Handler) OAuthIntrospect(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		respondOAuthError(w, &service.OAuthError{Code: "invalid_request", Description: "invalid form body"})
+		return
+	}
+	clientID, clientSecret := clientCredentials(r)
+	result, err := h.oauthSvc.Introspect(r.Context(), clientID, clientSecret, r.PostForm.Get("token"))
+	if err != nil {
+		respondOAuthError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, result)
+}
+
+func (h *Handler) OAuthRevoke(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		respondOAuthError(w, &service.OAuthError{Code: "invalid_request", Description: "invalid form body"})
+		return
+	}
+	clientID, clientSecret := clientCredentials(r)
+	if err := h.oauthSvc.Revoke(r.Context(), clientID, clientSecret, r.PostForm.Get("token")); err != nil {
+		respondOAuthError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// clientCredentials reads client authentication from HTTP Basic, falling
+// back to the client_id and client_secret form parameters.
+func clientCredentials(r *http.Request) (string, string) {
+	if id, secret, ok := r.BasicAuth(); ok {
+		return id, secret
+	}
+	return r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+}
+
+// respondOAuthError writes errors in the format of RFC 6749, section 5.2.
+func respondOAuthError(w http.ResponseWriter, err error) {
+	var oauthErr *service.OAuthError
+	if !errors.As(err, &oauthErr) {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	status := http.StatusBadRequest
+	if oauthErr.Code == "invalid_client" {
+		status = http.StatusUnauthorized
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondJSON(w, status, map[string]string{"error": oauthErr.Code, "error_description": oauthErr.Description})
 }
 
+func (h *Handler) RevokeSessions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	if err := h.userSvc.RevokeAllSessions(r.Context(), id); err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "revoked"})
+}
+
+// GetBalance returns the balance of the account given by ?account_id=, or of
+// the caller's default account.
 func (h *Handler) GetBalance(w http.ResponseWriter, r *http.Request) {
 	userIDVal := r.Context().Value(middleware.UserIDKey)
     if userIDVal == nil {
@@ -157,7 +1553,26 @@ func (h *Handler) GetBalance(w http.ResponseWriter, r *http.Request) {
     }
     userID := int64(userIDVal.(float64))
 
-	bal, err := h.balSvc.GetBalance(r.Context(), userID)
+	var accountID int64
+	if v := r.URL.Query().Get("account_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid account ID")
+			return
+		}
+		accountID = id
+	}
+	account, err := h.accountSvc.Get(r.Context(), userID, accountID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, "Account not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	bal, err := h.balSvc.GetBalance(r.Context(), account.ID)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Failed to fetch balance")
 		return
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireScopeAndSession(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name   string
+		scopes []string // nil for a user session
+		mw     []Middleware
+		want   int
+	}{
+		{"session on route without scope", nil, nil, http.StatusOK},
+		{"session on route with scope", nil, []Middleware{RequireScope("balances:read")}, http.StatusOK},
+		{"scoped credential on route without scope", []string{"balances:read"}, nil, http.StatusForbidden},
+		{"scoped credential with the scope", []string{"balances:read"}, []Middleware{RequireScope("balances:read")}, http.StatusOK},
+		{"scoped credential without the scope", []string{"users:read"}, []Middleware{RequireScope("balances:read")}, http.StatusForbidden},
+		{"scoped credential with no scopes", []string{}, nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The order the router applies them in
+			h := Chain(RequireSession(ok), tt.mw...)
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.scopes != nil {
+				req = req.WithContext(context.WithValue(req.Context(), ScopesKey, tt.scopes))
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
@@ -69,7 +69,7 @@ func CORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key, X-API-Key")
 		if r.Method == "OPTIONS" {
 			return
 		}
@@ -157,6 +157,11 @@ const UserRoleKey contextKey = "user_role"
 func Auth(userSvc *service.UserService) Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Context().Value(APIKeyIDKey) != nil {
+				next.ServeHTTP(w, r) // Already authenticated by APIKey
+				return
+			}
+
 			authHeader := r.Header.Get("Authorization")
 			if authHeader == "" {
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -182,15 +187,45 @@ func Auth(userSvc *service.UserService) Middleware {
 				return
 			}
 
+			revoked, err := userSvc.IsRevoked(r.Context(), claims)
+			if err != nil || revoked {
+				http.Error(w, "Token revoked", http.StatusUnauthorized)
+				return
+			}
+
 			// Add claims to context
 			ctx := context.WithValue(r.Context(), UserIDKey, claims["user_id"])
 			ctx = context.WithValue(ctx, UserRoleKey, claims["role"])
+			if scope, ok := claims["scope"].(string); ok {
+				// Issued to an OAuth client, limited to what the user approved
+				ctx = context.WithValue(ctx, ScopesKey, strings.Fields(scope))
+			}
 			
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
+// RequirePermission checks that the user's role grants perm.
+func RequirePermission(perms *service.PermissionService, perm string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role, _ := r.Context().Value(UserRoleKey).(string)
+			allowed, err := perms.HasPermission(r.Context(), role, perm)
+			if err != nil {
+				slog.Error("Failed to check permission", "role", role, "permission", perm, "error", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			if !allowed {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // RoleMiddleware checks user role
 func Role(requiredRole string) Middleware {
 	return func(next http.Handler) http.Handler {
@@ -2,7 +2,7 @@ package models
 
 import (
 	"errors"
-	"strings"
+	"net/mail"
 	"time"
 )
 
@@ -10,6 +10,121 @@ const (
 	RoleUser  = "user"
 	RoleAdmin = "admin"
 )
+
+// Permissions granted to roles. Which roles have which is stored in the
+// database; these are the names the code checks for.
+const (
+	PermUsersRead               = "users.read"
+	PermUsersWrite              = "users.write"
+	PermUsersClose              = "users.close"
+	PermUsersRestrict           = "users.restrict"
+	PermUsersMFAReset           = "users.mfa_reset"
+	PermTransactionsActOnBehalf = "transactions.act_on_behalf"
+	PermLedgerRead              = "ledger.read"
+	PermLedgerAdjust            = "ledger.adjust"
+	PermJobsManage              = "jobs.manage"
+	PermAPIKeysManage           = "api_keys.manage"
+	PermOAuthClientsManage      = "oauth_clients.manage"
+	PermRolesManage             = "roles.manage"
+	PermFXManage                = "fx.manage"
+)
+
+// Permissions lists every permission a role can be granted.
+var Permissions = []string{
+	PermUsersRead,
+	PermUsersWrite,
+	PermUsersClose,
+	PermUsersRestrict,
+	PermUsersMFAReset,
+	PermTransactionsActOnBehalf,
+	PermLedgerRead,
+	PermLedgerAdjust,
+	PermJobsManage,
+	PermAPIKeysManage,
+	PermOAuthClientsManage,
+	PermRolesManage,
+	PermFXManage,
+}
+
+// Account states staff can set to restrict an account
+const (
+	AccountStateActive      = "active"
+	AccountStateDebitFrozen = "debit_frozen" // Money can come in but not go out
+	AccountStateFrozen      = "frozen"       // No money in or out
+	AccountStateSuspended   = "suspended"    // Frozen, and the user cannot sign in
+)
+
+var AccountStates = []string{
+	AccountStateActive,
+	AccountStateDebitFrozen,
+	AccountStateFrozen,
+	AccountStateSuspended,
+}
+
+const (
+	AccountTypeChecking = "checking"
+	AccountTypeSavings  = "savings"
+)
+
+var AccountTypes = []string{AccountTypeChecking, AccountTypeSavings}
+
+const (
+	AccountStatusOpen   = "open"
+	AccountStatusClosed = "closed"
+)
+
+// DefaultCurrency is the currency of new accounts.
+const DefaultCurrency = "USD"
+
+// Currency is an ISO 4217 currency. Amounts are stored as integers in its
+// minor unit, e.g. cents for USD, so MinorUnits is the number of decimal
+// places in a major unit.
+type Currency struct {
+	Code       string `json:"code"`
+	MinorUnits int    `json:"minor_units"`
+}
+
+// Currencies lists the currencies accounts can be held in, by code.
+var Currencies = map[string]Currency{
+	"AUD": {"AUD", 2},
+	"BHD": {"BHD", 3},
+	"BRL": {"BRL", 2},
+	"CAD": {"CAD", 2},
+	"CHF": {"CHF", 2},
+	"CNY": {"CNY", 2},
+	"CZK": {"CZK", 2},
+	"DKK": {"DKK", 2},
+	"EUR": {"EUR", 2},
+	"GBP": {"GBP", 2},
+	"HKD": {"HKD", 2},
+	"HUF": {"HUF", 2},
+	"INR": {"INR", 2},
+	"JOD": {"JOD", 3},
+	"JPY": {"JPY", 0},
+	"KRW": {"KRW", 0},
+	"KWD": {"KWD", 3},
+	"MXN": {"MXN", 2},
+	"NOK": {"NOK", 2},
+	"NZD": {"NZD", 2},
+	"OMR": {"OMR", 3},
+	"PLN": {"PLN", 2},
+	"SEK": {"SEK", 2},
+	"SGD": {"SGD", 2},
+	"TND": {"TND", 3},
+	"USD": {"USD", 2},
+	"ZAR": {"ZAR", 2},
+}
+
+// FXRate converts one unit of Base into Rate units of Quote. Rate is a
+// decimal string so that it is stored and applied exactly.
+type FXRate struct {
+	ID        int64     `json:"id,omitempty"`
+	Base      string    `json:"base"`
+	Quote     string    `json:"quote"`
+	Rate      string    `json:"rate"`
+	UpdatedBy *int64    `json:"updated_by,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
 const (
 	TxTypeDeposit  = "deposit"
 	TxTypeWithdraw = "withdraw"
@@ -19,22 +134,92 @@ const (
 	TxStatusPending   = "pending"
 	TxStatusCompleted = "completed"
 	TxStatusFailed    = "failed"
+	// Held until the creator re-authenticates; see TransactionService.Confirm
+	TxStatusRequiresConfirmation = "requires_confirmation"
+	TxStatusExpired              = "expired"
 )
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusFailed    = "failed"    // Business failure, will not be retried
+	JobStatusDead      = "dead"      // Out of retries, waiting for an operator
+	JobStatusDiscarded = "discarded" // Dead job dropped by an operator
+)
+const (
+	LedgerAccountUser     = "user"
+	LedgerAccountExternal = "external" // Cash moving in or out of the bank
+	LedgerAccountFX       = "fx"       // The bank's position in each currency from conversions
+)
+const (
+	PostingDebit  = "debit"
+	PostingCredit = "credit"
+)
+
+// Scopes limit what an API key may do
+const (
+	ScopeTransactionsRead  = "transactions:read"
+	ScopeTransactionsWrite = "transactions:write"
+	ScopeBalancesRead      = "balances:read"
+	ScopeAccountsWrite     = "accounts:write"
+	ScopeUsersRead         = "users:read"
+	ScopeUsersWrite        = "users:write"
+	ScopeLedgerRead        = "ledger:read"
+	ScopeJobsWrite         = "jobs:write"
+)
+
+// Scopes lists every scope that can be granted.
+var Scopes = []string{
+	ScopeTransactionsRead,
+	ScopeTransactionsWrite,
+	ScopeBalancesRead,
+	ScopeAccountsWrite,
+	ScopeUsersRead,
+	ScopeUsersWrite,
+	ScopeLedgerRead,
+	ScopeJobsWrite,
+}
+
 type User struct {
-	ID           int64     `json:"id"`
-	Username     string    `json:"username"`
-	Email        string    `json:"email"`
-	PasswordHash string    `json:"-"`
-	Role         string    `json:"role"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID           int64      `json:"id"`
+	Username     string     `json:"username"`
+	Email        string     `json:"email"`
+	PasswordHash string     `json:"-"`
+	Role         string     `json:"role"`
+	Verified     bool       `json:"verified"`               // Email address confirmed
+	LockedUntil  *time.Time `json:"locked_until,omitempty"` // Set after too many failed logins
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+
+	// Set once the account is closed. Closed users cannot sign in or transact.
+	ClosedAt      *time.Time `json:"closed_at,omitempty"`
+	ClosedBy      *int64     `json:"closed_by,omitempty"`
+	ClosureReason string     `json:"closure_reason,omitempty"`
+
+	// Set by staff to restrict the account; see CurrentState
+	State          string     `json:"state"`
+	StateReason    string     `json:"state_reason,omitempty"`
+	StateExpiresAt *time.Time `json:"state_expires_at,omitempty"`
+}
+
+func (u *User) Closed() bool {
+	return u.ClosedAt != nil
+}
+
+// CurrentState returns the account state in effect at now. A state whose
+// expiry has passed no longer applies, even before it is reset.
+func (u *User) CurrentState(now time.Time) string {
+	if u.State == "" || (u.StateExpiresAt != nil && !now.Before(*u.StateExpiresAt)) {
+		return AccountStateActive
+	}
+	return u.State
 }
 
 func (u *User) Validate() error {
 	if len(u.Username) < 3 {
 		return errors.New("username must be at least 3 characters")
 	}
-	if !strings.Contains(u.Email, "@") {
+	if addr, err := mail.ParseAddress(u.Email); err != nil || addr.Address != u.Email {
 		return errors.New("invalid email format")
 	}
 	if len(u.PasswordHash) == 0 {
@@ -43,40 +228,445 @@ func (u *User) Validate() error {
 	return nil
 }
 
+// RefreshToken is the server-side record of an opaque refresh token. Only a
+// hash of the token is stored. Tokens issued by rotating one another share a
+// FamilyID so that reuse of an old token can revoke the whole chain. Tokens
+// issued to an OAuth client carry its ClientID and the granted Scopes.
+type RefreshToken struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"user_id"`
+	FamilyID   string     `json:"family_id"`
+	TokenHash  string     `json:"-"`
+	ClientID   *string    `json:"client_id,omitempty"`
+	Scopes     []string   `json:"scopes,omitempty"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	UsedAt     *time.Time `json:"used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	ReplacedBy *int64     `json:"replaced_by,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// AuthTokens is returned to clients on login and refresh.
+type AuthTokens struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"` // Access token lifetime in seconds
+}
+
+// APIKey lets a back-office system call the API as UserID, limited to Scopes.
+// The key itself is only shown once; Prefix identifies it in logs and lists.
+type APIKey struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"`
+	UserID     int64      `json:"user_id"`
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  *int64     `json:"created_by,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Role is a named set of permissions that users are assigned by name.
+type Role struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// OAuthClient is a third-party application registered for OAuth2. Public
+// clients have no secret and can only use the authorization code flow with
+// PKCE. Client credentials tokens act as UserID, which must be set for that
+// grant.
+type OAuthClient struct {
+	ID           int64      `json:"id"`
+	ClientID     string     `json:"client_id"`
+	SecretHash   string     `json:"-"`
+	Confidential bool       `json:"confidential"`
+	Name         string     `json:"name"`
+	RedirectURIs []string   `json:"redirect_uris"`
+	Scopes       []string   `json:"scopes"`
+	UserID       *int64     `json:"user_id,omitempty"`
+	CreatedBy    *int64     `json:"created_by,omitempty"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// AuthorizationCode is issued when a user approves a client. It is single use
+// and bound to the redirect URI and PKCE challenge of the request. FamilyID
+// is the refresh token family issued for it.
+type AuthorizationCode struct {
+	ID            int64      `json:"id"`
+	CodeHash      string     `json:"-"`
+	ClientID      string     `json:"client_id"`
+	UserID        int64      `json:"user_id"`
+	RedirectURI   string     `json:"redirect_uri"`
+	Scopes        []string   `json:"scopes"`
+	CodeChallenge string     `json:"-"`
+	FamilyID      *string    `json:"-"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	UsedAt        *time.Time `json:"used_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// OAuthConsent describes an authorization request for the user to approve.
+type OAuthConsent struct {
+	ClientID    string   `json:"client_id"`
+	ClientName  string   `json:"client_name"`
+	Scopes      []string `json:"scopes"`
+	RedirectURI string   `json:"redirect_uri"`
+	State       string   `json:"state,omitempty"`
+}
+
+// OAuthToken is the token endpoint response defined by RFC 6749.
+type OAuthToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"` // Omitted on refresh, where it is unchanged
+}
+
+// TokenIntrospection is the introspection response defined by RFC 7662.
+// Only Active is set for tokens that are invalid or not visible to the caller.
+type TokenIntrospection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+}
+
+// PasswordResetToken is a single-use token mailed to a user who forgot their
+// password. Only a hash of the token is stored.
+type PasswordResetToken struct {
+	ID        int64      `json:"id"`
+	UserID    int64      `json:"user_id"`
+	TokenHash string     `json:"-"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// UserMFA is a user's TOTP enrollment. Secret is encrypted at rest. The
+// second factor is only required once EnabledAt is set. LastUsedStep stops a
+// code from being accepted twice.
+type UserMFA struct {
+	UserID       int64      `json:"user_id"`
+	Secret       []byte     `json:"-"`
+	EnabledAt    *time.Time `json:"enabled_at,omitempty"`
+	LastUsedStep int64      `json:"-"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// MFAEnrollment is returned when a user starts TOTP enrollment.
+type MFAEnrollment struct {
+	Secret     string `json:"secret"` // Base32, for manual entry
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+// SigningKey is a JWT signing key pair. The private key is stored encrypted.
+// Retired keys no longer sign but still verify until VerifyUntil.
+type SigningKey struct {
+	ID          int64      `json:"id"`
+	KID         string     `json:"kid"`
+	Algorithm   string     `json:"algorithm"`
+	PrivateKey  []byte     `json:"-"`
+	PublicKey   []byte     `json:"-"` // PKIX DER
+	CreatedAt   time.Time  `json:"created_at"`
+	RetiredAt   *time.Time `json:"retired_at,omitempty"`
+	VerifyUntil *time.Time `json:"verify_until,omitempty"`
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"` // OKP
+	X   string `json:"x,omitempty"`   // OKP
+	N   string `json:"n,omitempty"`   // RSA
+	E   string `json:"e,omitempty"`   // RSA
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// Account holds money for the user who owns it. Every user has a Default
+// account, used when a transaction names the user but not an account.
+// Balance and Available are filled in whenever accounts are read.
+type Account struct {
+	ID        int64      `json:"id"`
+	UserID    int64      `json:"user_id"`
+	Number    string     `json:"number"`
+	Name      string     `json:"name"`
+	Type      string     `json:"type"`
+	Currency  string     `json:"currency"`
+	Status    string     `json:"status"`
+	Default   bool       `json:"default"`
+	Balance   int64      `json:"balance"`   // Ledger balance, in minor units of Currency
+	Available int64      `json:"available"` // Balance less active holds
+	CreatedAt time.Time  `json:"created_at"`
+	ClosedAt  *time.Time `json:"closed_at,omitempty"`
+}
+
+const (
+	HoldStatusActive   = "active"
+	HoldStatusCaptured = "captured"
+	HoldStatusVoided   = "voided"
+	HoldStatusExpired  = "expired"
+)
+
+// Hold reserves Amount in FromAccountID, e.g. for a card authorization.
+// Capturing it turns up to Amount into a transaction to ToAccountID, or a
+// withdrawal if there is none, and releases the rest.
+type Hold struct {
+	ID             int64      `json:"id"`
+	FromUserID     int64      `json:"from_user_id"`
+	FromAccountID  int64      `json:"from_account_id"`
+	ToUserID       *int64     `json:"to_user_id,omitempty"`
+	ToAccountID    *int64     `json:"to_account_id,omitempty"`
+	Amount         int64      `json:"amount"` // In minor units of Currency
+	Currency       string     `json:"currency"`
+	CapturedAmount *int64     `json:"captured_amount,omitempty"`
+	Description    string     `json:"description"`
+	Status         string     `json:"status"`
+	CreatedBy      int64      `json:"created_by"`
+	TransactionID  *int64     `json:"transaction_id,omitempty"` // Set once captured
+	ExpiresAt      time.Time  `json:"expires_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ClosedAt       *time.Time `json:"closed_at,omitempty"`
+}
+
+// CurrentStatus returns the hold's status, treating an active hold past
+// ExpiresAt as expired even before it is marked so.
+func (h *Hold) CurrentStatus(now time.Time) string {
+	if h.Status == HoldStatusActive && !now.Before(h.ExpiresAt) {
+		return HoldStatusExpired
+	}
+	return h.Status
+}
+
+// How often a standing order pays out
+const (
+	FrequencyOnce    = "once"
+	FrequencyDaily   = "daily"
+	FrequencyWeekly  = "weekly"
+	FrequencyMonthly = "monthly"
+)
+
+const (
+	StandingOrderStatusActive    = "active"
+	StandingOrderStatusCompleted = "completed"
+	StandingOrderStatusCancelled = "cancelled"
+)
+
+// What a standing order does when the account cannot cover a payment
+const (
+	InsufficientFundsRetry = "retry" // Try again later, then skip the payment
+	InsufficientFundsSkip  = "skip"  // Skip the payment straight away
+)
+
+// StandingOrder transfers Amount from FromAccountID to ToAccountID on
+// StartDate and, unless Frequency is once, every day, week or month after it
+// up to EndDate. Monthly payments due on a day the month does not have are
+// made on its last day. Dates are in UTC; a payment is due from midnight.
+type StandingOrder struct {
+	ID                  int64      `json:"id"`
+	UserID              int64      `json:"user_id"`
+	FromAccountID       int64      `json:"from_account_id"`
+	ToUserID            int64      `json:"to_user_id"`
+	ToAccountID         int64      `json:"to_account_id"`
+	Amount              int64      `json:"amount"` // In minor units of the source account's currency
+	Description         string     `json:"description"`
+	Frequency           string     `json:"frequency"`
+	StartDate           time.Time  `json:"start_date"`
+	EndDate             *time.Time `json:"end_date,omitempty"`
+	OnInsufficientFunds string     `json:"on_insufficient_funds"`
+	Status              string     `json:"status"`
+	NextRunDate         time.Time  `json:"next_run_date"`   // The payment due next
+	NextAttemptAt       time.Time  `json:"next_attempt_at"` // Later than NextRunDate while retrying
+	Attempts            int        `json:"attempts"`        // Failed attempts at the payment due next
+	RunCount            int        `json:"run_count"`       // Payments made or skipped so far
+	LastRunAt           *time.Time `json:"last_run_at,omitempty"`
+	LastTransactionID   *int64     `json:"last_transaction_id,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+}
+
+// Transaction moves money between accounts. The user ids are the owners of
+// the accounts. Amount is taken from the source account in its Currency and
+// ToAmount is paid into the destination in ToCurrency. They only differ for
+// transfers between currencies, which record the FXRate applied.
 type Transaction struct {
-	ID         int64     `json:"id"`
-	FromUserID *int64    `json:"from_user_id,omitempty"` // Nullable for deposits
-	ToUserID   *int64    `json:"to_user_id,omitempty"`   // Nullable for withdrawals (if applicable)
-	Amount     int64     `json:"amount"`                 // In cents
-	Type       string    `json:"type"`
-	Status     string    `json:"status"`
-	CreatedAt  time.Time `json:"created_at"`
+	ID                    int64      `json:"id"`
+	FromUserID            *int64     `json:"from_user_id,omitempty"` // Nullable for deposits
+	ToUserID              *int64     `json:"to_user_id,omitempty"`   // Nullable for withdrawals (if applicable)
+	FromAccountID         *int64     `json:"from_account_id,omitempty"`
+	ToAccountID           *int64     `json:"to_account_id,omitempty"`
+	Amount                int64      `json:"amount"` // In minor units of Currency
+	Currency              string     `json:"currency"`
+	ToAmount              int64      `json:"to_amount"` // In minor units of ToCurrency
+	ToCurrency            string     `json:"to_currency"`
+	FXRate                *string    `json:"fx_rate,omitempty"`
+	Type                  string     `json:"type"`
+	Status                string     `json:"status"`
+	CreatedBy             *int64     `json:"created_by,omitempty"` // The authenticated caller, which may be an admin
+	ConfirmationExpiresAt *time.Time `json:"confirmation_expires_at,omitempty"`
+	CreatedAt             time.Time  `json:"created_at"`
 }
 
 func (t *Transaction) IsValidStatusTransition(newStatus string) bool {
 	if t.Status == newStatus {
 		return true
 	}
-	if t.Status == TxStatusCompleted || t.Status == TxStatusFailed {
-		return false // Terminal states
-	}
-	if t.Status == TxStatusPending {
+	switch t.Status {
+	case TxStatusPending:
 		return newStatus == TxStatusCompleted || newStatus == TxStatusFailed
+	case TxStatusRequiresConfirmation:
+		return newStatus == TxStatusPending || newStatus == TxStatusExpired
 	}
-	return false
+	return false // Terminal states
 }
 
 
+// Balance of an account. Ledger is the sum of its postings; Available is
+// what can still be spent, which excludes funds reserved by active holds.
 type Balance struct {
-	UserID        int64     `json:"user_id"`
-	Amount        int64     `json:"amount"` // In cents
+	AccountID     int64     `json:"account_id"`
+	Ledger        int64     `json:"ledger"`    // In minor units of Currency
+	Available     int64     `json:"available"` // In minor units of Currency
+	Currency      string    `json:"currency"`
 	LastUpdatedAt time.Time `json:"last_updated_at"`
 }
 
+// Job is a durable work item that asks a worker to process a transaction.
+type Job struct {
+	ID             int64        `json:"id"`
+	TransactionID  int64        `json:"transaction_id"`
+	Status         string       `json:"status"`
+	Attempts       int          `json:"attempts"`
+	RunAt          time.Time    `json:"run_at"`
+	LockedBy       *string      `json:"locked_by,omitempty"`
+	LeaseExpiresAt *time.Time   `json:"lease_expires_at,omitempty"`
+	HeartbeatAt    *time.Time   `json:"heartbeat_at,omitempty"`
+	LastError      *string      `json:"last_error,omitempty"`
+	DeadAt         *time.Time   `json:"dead_at,omitempty"`
+	CreatedAt      time.Time    `json:"created_at"`
+	UpdatedAt      time.Time    `json:"updated_at"`
+	Transaction    *Transaction `json:"transaction,omitempty"`
+}
+
+// JournalEntry groups the postings that record a single movement of money.
+// The sum of its debits always equals the sum of its credits.
+type JournalEntry struct {
+	ID            int64      `json:"id"`
+	TransactionID *int64     `json:"transaction_id,omitempty"`
+	Description   string     `json:"description"`
+	Postings      []*Posting `json:"postings"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// Validate checks that the entry balances in every currency it touches.
+func (e *JournalEntry) Validate() error {
+	if len(e.Postings) < 2 {
+		return errors.New("journal entry needs at least two postings")
+	}
+	net := make(map[string]int64) // currency -> debits - credits
+	for _, p := range e.Postings {
+		if p.Amount <= 0 {
+			return errors.New("posting amount must be positive")
+		}
+		if p.AccountType == LedgerAccountUser && (p.UserID == nil || p.AccountID == nil) {
+			return errors.New("user posting is missing user_id or account_id")
+		}
+		if _, ok := Currencies[p.Currency]; !ok {
+			return errors.New("posting has an unsupported currency")
+		}
+		switch p.Direction {
+		case PostingDebit:
+			net[p.Currency] += p.Amount
+		case PostingCredit:
+			net[p.Currency] -= p.Amount
+		default:
+			return errors.New("invalid posting direction")
+		}
+	}
+	for _, n := range net {
+		if n != 0 {
+			return errors.New("journal entry is not balanced")
+		}
+	}
+	return nil
+}
+
+type Posting struct {
+	ID             int64     `json:"id"`
+	JournalEntryID int64     `json:"journal_entry_id"`
+	AccountType    string    `json:"account_type"`
+	UserID         *int64    `json:"user_id,omitempty"`
+	AccountID      *int64    `json:"account_id,omitempty"`
+	Direction      string    `json:"direction"`
+	Amount         int64     `json:"amount"` // In minor units of Currency, always positive
+	Currency       string    `json:"currency"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// BalanceDelta returns the posting's effect on an account balance. User accounts
+// are liabilities of the bank, so credits increase them and debits decrease them.
+func (p *Posting) BalanceDelta() int64 {
+	if p.Direction == PostingCredit {
+		return p.Amount
+	}
+	return -p.Amount
+}
+
+type BalanceMismatch struct {
+	AccountID int64 `json:"account_id"`
+	Projected int64 `json:"projected"`
+	Ledger    int64 `json:"ledger"`
+}
+
+// LedgerReport is the result of checking that the ledger is balanced and that
+// the balances projection agrees with it.
+type LedgerReport struct {
+	Totals     []*LedgerTotal     `json:"totals"`
+	Balanced   bool               `json:"balanced"`
+	Mismatches []*BalanceMismatch `json:"mismatches"`
+}
+
+// LedgerTotal sums the postings in one currency.
+type LedgerTotal struct {
+	Currency     string `json:"currency"`
+	TotalDebits  int64  `json:"total_debits"`
+	TotalCredits int64  `json:"total_credits"`
+}
+
+// IdempotencyKey remembers the transaction created for a client supplied
+// Idempotency-Key so that retries replay the original response.
+type IdempotencyKey struct {
+	UserID        int64     `json:"user_id"`
+	Key           string    `json:"key"`
+	RequestHash   string    `json:"request_hash"`
+	TransactionID *int64    `json:"transaction_id,omitempty"`
+	ResponseBody  string    `json:"response_body"`
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
 type AuditLog struct {
 	ID         int64     `json:"id"`
 	EntityType string    `json:"entity_type"`
 	EntityID   int64     `json:"entity_id"`
+	ActorID    *int64    `json:"actor_id,omitempty"` // User who performed the action, if not the system
 	Action     string    `json:"action"`
 	Details    string    `json:"details"`
 	CreatedAt  time.Time `json:"created_at"`
@@ -0,0 +1,53 @@
+package models
+
+import "testing"
+
+func TestJournalEntryValidate(t *testing.T) {
+	userID, accountID := int64(1), int64(2)
+	user := func(direction string, amount int64, currency string) *Posting {
+		return &Posting{AccountType: LedgerAccountUser, UserID: &userID, AccountID: &accountID, Direction: direction, Amount: amount, Currency: currency}
+	}
+	external := func(direction string, amount int64, currency string) *Posting {
+		return &Posting{AccountType: LedgerAccountExternal, Direction: direction, Amount: amount, Currency: currency}
+	}
+	fx := func(direction string, amount int64, currency string) *Posting {
+		return &Posting{AccountType: LedgerAccountFX, Direction: direction, Amount: amount, Currency: currency}
+	}
+
+	tests := []struct {
+		name     string
+		postings []*Posting
+		wantErr  bool
+	}{
+		{"balanced", []*Posting{external("debit", 500, "USD"), user("credit", 500, "USD")}, false},
+		{"balanced with several postings", []*Posting{external("debit", 500, "USD"), user("credit", 300, "USD"), user("credit", 200, "USD")}, false},
+		{"balanced per currency", []*Posting{
+			user("debit", 1000, "USD"), fx("credit", 1000, "USD"),
+			fx("debit", 922, "EUR"), user("credit", 922, "EUR"),
+		}, false},
+		{"single posting", []*Posting{external("debit", 500, "USD")}, true},
+		{"no postings", nil, true},
+		{"unbalanced", []*Posting{external("debit", 500, "USD"), user("credit", 499, "USD")}, true},
+		{"balanced in total but not per currency", []*Posting{user("debit", 1000, "USD"), user("credit", 1000, "EUR")}, true},
+		{"one currency unbalanced", []*Posting{
+			user("debit", 1000, "USD"), fx("credit", 1000, "USD"),
+			fx("debit", 922, "EUR"), user("credit", 921, "EUR"),
+		}, true},
+		{"zero amount", []*Posting{external("debit", 0, "USD"), user("credit", 0, "USD")}, true},
+		{"negative amount", []*Posting{external("debit", -5, "USD"), user("credit", -5, "USD")}, true},
+		{"unsupported currency", []*Posting{external("debit", 500, "XXX"), user("credit", 500, "XXX")}, true},
+		{"invalid direction", []*Posting{external("debit", 500, "USD"), user("in", 500, "USD")}, true},
+		{"user posting without account", []*Posting{
+			external("debit", 500, "USD"),
+			{AccountType: LedgerAccountUser, UserID: &userID, Direction: PostingCredit, Amount: 500, Currency: "USD"},
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&JournalEntry{Postings: tt.postings}).Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
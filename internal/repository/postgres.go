@@ -3,15 +3,70 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"sort"
+	"time"
+
 	"backend/internal/models"
+
+	"github.com/lib/pq"
 )
 
+// dbtx is satisfied by both *sql.DB and *sql.Tx
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
 type PostgresRepository struct {
-	db *sql.DB
+	db   dbtx
+	conn *sql.DB // nil when the repository is bound to a transaction
 }
 
 func NewPostgresRepository(db *sql.DB) *PostgresRepository {
-	return &PostgresRepository{db: db}
+	return &PostgresRepository{db: db, conn: db}
+}
+
+// WithTx runs fn against a repository bound to a single database transaction,
+// committing if fn returns nil and rolling back otherwise. Calls made on a
+// repository that is already in a transaction join it.
+func (r *PostgresRepository) WithTx(ctx context.Context, fn func(repo Repository) error) error {
+	return r.withTx(ctx, func(tr *PostgresRepository) error {
+		return fn(tr)
+	})
+}
+
+func (r *PostgresRepository) withTx(ctx context.Context, fn func(tr *PostgresRepository) error) error {
+	if r.conn == nil {
+		return fn(r)
+	}
+
+	dbTx, err := r.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer dbTx.Rollback()
+
+	if err := fn(&PostgresRepository{db: dbTx}); err != nil {
+		return err
+	}
+	return dbTx.Commit()
+}
+
+// mapError translates Postgres constraint violations into repository errors.
+func mapError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+	switch pqErr.Code {
+	case "23505": // unique_violation
+		return ErrDuplicate
+	case "23503": // foreign_key_violation
+		return ErrInvalidReference
+	}
+	return err
 }
 
 // --- User Repository ---
@@ -22,30 +77,33 @@ func (r *PostgresRepository) CreateUser(ctx context.Context, user *models.User)
 	return err
 }
 
-func (r *PostgresRepository) GetUserByID(ctx context.Context, id int64) (*models.User, error) {
+const userColumns = `id, username, email, password_hash, role, verified, locked_until, created_at, updated_at,
+	closed_at, closed_by, COALESCE(closure_reason, ''), state, COALESCE(state_reason, ''), state_expires_at`
+
+func scanUser(row interface{ Scan(...interface{}) error }) (*models.User, error) {
 	u := &models.User{}
-	query := `SELECT id, username, email, password_hash, role, created_at, updated_at FROM users WHERE id = $1`
-	err := r.db.QueryRowContext(ctx, query, id).Scan(&u.ID, &u.Username, &u.Email, &u.PasswordHash, &u.Role, &u.CreatedAt, &u.UpdatedAt)
+	err := row.Scan(&u.ID, &u.Username, &u.Email, &u.PasswordHash, &u.Role, &u.Verified, &u.LockedUntil, &u.CreatedAt, &u.UpdatedAt,
+		&u.ClosedAt, &u.ClosedBy, &u.ClosureReason, &u.State, &u.StateReason, &u.StateExpiresAt)
 	if err != nil {
 		return nil, err
 	}
 	return u, nil
 }
 
+func (r *PostgresRepository) GetUserByID(ctx context.Context, id int64) (*models.User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+	return scanUser(r.db.QueryRowContext(ctx, query, id))
+}
+
 func (r *PostgresRepository) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
-	u := &models.User{}
-	query := `SELECT id, username, email, password_hash, role, created_at, updated_at FROM users WHERE email = $1`
-	err := r.db.QueryRowContext(ctx, query, email).Scan(&u.ID, &u.Username, &u.Email, &u.PasswordHash, &u.Role, &u.CreatedAt, &u.UpdatedAt)
-	if err != nil {
-		return nil, err
-	}
-	return u, nil
+	query := `SELECT ` + userColumns + ` FROM users WHERE email = $1`
+	return scanUser(r.db.QueryRowContext(ctx, query, email))
 }
 
 // --- Transaction Repository ---
 
 func (r *PostgresRepository) ListUsers(ctx context.Context) ([]*models.User, error) {
-	query := `SELECT id, username, email, password_hash, role, created_at, updated_at FROM users`
+	query := `SELECT ` + userColumns + ` FROM users`
 	rows, err := r.db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
@@ -54,8 +112,8 @@ func (r *PostgresRepository) ListUsers(ctx context.Context) ([]*models.User, err
 
 	var users []*models.User
 	for rows.Next() {
-		u := &models.User{}
-		if err := rows.Scan(&u.ID, &u.Username, &u.Email, &u.PasswordHash, &u.Role, &u.CreatedAt, &u.UpdatedAt); err != nil {
+		u, err := scanUser(rows)
+		if err != nil {
 			return nil, err
 		}
 		users = append(users, u)
@@ -64,37 +122,485 @@ func (r *PostgresRepository) ListUsers(ctx context.Context) ([]*models.User, err
 }
 
 func (r *PostgresRepository) UpdateUser(ctx context.Context, user *models.User) error {
-	query := `UPDATE users SET username = $1, email = $2, role = $3, updated_at = CURRENT_TIMESTAMP WHERE id = $4`
-	_, err := r.db.ExecContext(ctx, query, user.Username, user.Email, user.Role, user.ID)
+	// A new email address has to be verified again
+	query := `UPDATE users SET username = $1, email = $2, role = $3, verified = (verified AND email = $2), updated_at = CURRENT_TIMESTAMP WHERE id = $4`
+	return mapError(r.execAffected(ctx, query, user.Username, user.Email, user.Role, user.ID))
+}
+
+func (r *PostgresRepository) UpdateUserPassword(ctx context.Context, id int64, passwordHash string) error {
+	query := `UPDATE users SET password_hash = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`
+	return r.execAffected(ctx, query, passwordHash, id)
+}
+
+func (r *PostgresRepository) MarkUserVerified(ctx context.Context, id int64, email string) error {
+	query := `UPDATE users SET verified = TRUE, updated_at = CURRENT_TIMESTAMP WHERE id = $1 AND email = $2`
+	return r.execAffected(ctx, query, id, email)
+}
+
+func (r *PostgresRepository) ClaimVerificationSend(ctx context.Context, id int64, minInterval time.Duration) error {
+	query := `UPDATE users SET verification_sent_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND NOT verified
+			AND (verification_sent_at IS NULL OR verification_sent_at <= CURRENT_TIMESTAMP - $2 * INTERVAL '1 millisecond')`
+	return r.execAffected(ctx, query, id, minInterval.Milliseconds())
+}
+
+func (r *PostgresRepository) ClaimPasswordResetSend(ctx context.Context, id int64, minInterval time.Duration) error {
+	query := `UPDATE users SET password_reset_sent_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+			AND (password_reset_sent_at IS NULL OR password_reset_sent_at <= CURRENT_TIMESTAMP - $2 * INTERVAL '1 millisecond')`
+	return r.execAffected(ctx, query, id, minInterval.Milliseconds())
+}
+
+func (r *PostgresRepository) LockUser(ctx context.Context, id int64, until time.Time) error {
+	query := `UPDATE users SET locked_until = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $1`
+	return r.execAffected(ctx, query, id, until)
+}
+
+func (r *PostgresRepository) UnlockUser(ctx context.Context, id int64) error {
+	query := `UPDATE users SET locked_until = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = $1`
+	return r.execAffected(ctx, query, id)
+}
+
+func (r *PostgresRepository) SetUserState(ctx context.Context, id int64, state, reason string, expiresAt *time.Time) error {
+	query := `UPDATE users SET state = $2, state_reason = $3, state_expires_at = $4, updated_at = CURRENT_TIMESTAMP WHERE id = $1`
+	return r.execAffected(ctx, query, id, state, reason, expiresAt)
+}
+
+// ExpireUserStates resets every account state whose expiry has passed and
+// returns the states that lapsed, by user id.
+func (r *PostgresRepository) ExpireUserStates(ctx context.Context) (map[int64]string, error) {
+	query := `UPDATE users u SET state = 'active', state_reason = NULL, state_expires_at = NULL, updated_at = CURRENT_TIMESTAMP
+		FROM (SELECT id, state FROM users WHERE state_expires_at <= CURRENT_TIMESTAMP FOR UPDATE) old
+		WHERE u.id = old.id
+		RETURNING u.id, old.state`
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	expired := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var state string
+		if err := rows.Scan(&id, &state); err != nil {
+			return nil, err
+		}
+		expired[id] = state
+	}
+	return expired, rows.Err()
+}
+
+// CloseUser marks an open account as closed. The row and everything that
+// references it are kept.
+func (r *PostgresRepository) CloseUser(ctx context.Context, id, closedBy int64, reason string) error {
+	query := `UPDATE users SET closed_at = CURRENT_TIMESTAMP, closed_by = $2, closure_reason = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND closed_at IS NULL`
+	return r.execAffected(ctx, query, id, closedBy, reason)
+}
+
+// --- Refresh Token Repository ---
+
+func (r *PostgresRepository) CreateRefreshToken(ctx context.Context, t *models.RefreshToken) error {
+	query := `INSERT INTO refresh_tokens (user_id, family_id, token_hash, client_id, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at`
+	return r.db.QueryRowContext(ctx, query, t.UserID, t.FamilyID, t.TokenHash, t.ClientID, pq.Array(t.Scopes), t.ExpiresAt).Scan(&t.ID, &t.CreatedAt)
+}
+
+const refreshTokenColumns = `id, user_id, family_id, token_hash, client_id, scopes, expires_at, used_at, revoked_at, replaced_by, created_at`
+
+func (r *PostgresRepository) GetRefreshTokenByHash(ctx context.Context, hash string) (*models.RefreshToken, error) {
+	query := `SELECT ` + refreshTokenColumns + ` FROM refresh_tokens WHERE token_hash = $1`
+	return scanRefreshToken(r.db.QueryRowContext(ctx, query, hash))
+}
+
+func (r *PostgresRepository) GetRefreshTokenByHashForUpdate(ctx context.Context, hash string) (*models.RefreshToken, error) {
+	query := `SELECT ` + refreshTokenColumns + ` FROM refresh_tokens WHERE token_hash = $1 FOR UPDATE`
+	return scanRefreshToken(r.db.QueryRowContext(ctx, query, hash))
+}
+
+func scanRefreshToken(row interface{ Scan(...interface{}) error }) (*models.RefreshToken, error) {
+	t := &models.RefreshToken{}
+	err := row.Scan(&t.ID, &t.UserID, &t.FamilyID, &t.TokenHash, &t.ClientID, pq.Array(&t.Scopes), &t.ExpiresAt, &t.UsedAt, &t.RevokedAt, &t.ReplacedBy, &t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (r *PostgresRepository) MarkRefreshTokenUsed(ctx context.Context, id int64, replacedBy int64) error {
+	query := `UPDATE refresh_tokens SET used_at = CURRENT_TIMESTAMP, replaced_by = $2 WHERE id = $1`
+	_, err := r.db.ExecContext(ctx, query, id, replacedBy)
+	return err
+}
+
+func (r *PostgresRepository) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	query := `UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE family_id = $1 AND revoked_at IS NULL`
+	_, err := r.db.ExecContext(ctx, query, familyID)
+	return err
+}
+
+func (r *PostgresRepository) RevokeUserRefreshTokens(ctx context.Context, userID int64) error {
+	query := `UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND revoked_at IS NULL`
+	_, err := r.db.ExecContext(ctx, query, userID)
+	return err
+}
+
+func (r *PostgresRepository) RevokeClientRefreshTokens(ctx context.Context, clientID string) error {
+	query := `UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE client_id = $1 AND revoked_at IS NULL`
+	_, err := r.db.ExecContext(ctx, query, clientID)
 	return err
 }
 
-func (r *PostgresRepository) DeleteUser(ctx context.Context, id int64) error {
-	query := `DELETE FROM users WHERE id = $1`
+// --- Role Repository ---
+
+func (r *PostgresRepository) ListRoles(ctx context.Context) ([]*models.Role, error) {
+	query := `SELECT r.name, r.description,
+			COALESCE(array_agg(rp.permission ORDER BY rp.permission) FILTER (WHERE rp.permission IS NOT NULL), '{}')
+		FROM roles r LEFT JOIN role_permissions rp ON rp.role = r.name
+		GROUP BY r.name, r.description ORDER BY r.name`
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []*models.Role
+	for rows.Next() {
+		role := &models.Role{}
+		if err := rows.Scan(&role.Name, &role.Description, pq.Array(&role.Permissions)); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func (r *PostgresRepository) SaveRole(ctx context.Context, role *models.Role) error {
+	return r.withTx(ctx, func(tr *PostgresRepository) error {
+		query := `INSERT INTO roles (name, description) VALUES ($1, $2)
+			ON CONFLICT (name) DO UPDATE SET description = EXCLUDED.description`
+		if _, err := tr.db.ExecContext(ctx, query, role.Name, role.Description); err != nil {
+			return err
+		}
+		if _, err := tr.db.ExecContext(ctx, `DELETE FROM role_permissions WHERE role = $1`, role.Name); err != nil {
+			return err
+		}
+		for _, p := range role.Permissions {
+			if _, err := tr.db.ExecContext(ctx, `INSERT INTO role_permissions (role, permission) VALUES ($1, $2)`, role.Name, p); err != nil {
+				return mapError(err)
+			}
+		}
+		return nil
+	})
+}
+
+// --- OAuth Repository ---
+
+const oauthClientColumns = `id, client_id, secret_hash, name, redirect_uris, scopes, user_id, created_by, revoked_at, created_at`
+
+func scanOAuthClient(row interface{ Scan(...interface{}) error }) (*models.OAuthClient, error) {
+	c := &models.OAuthClient{}
+	err := row.Scan(&c.ID, &c.ClientID, &c.SecretHash, &c.Name, pq.Array(&c.RedirectURIs), pq.Array(&c.Scopes), &c.UserID, &c.CreatedBy, &c.RevokedAt, &c.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	c.Confidential = c.SecretHash != ""
+	return c, nil
+}
+
+func (r *PostgresRepository) CreateOAuthClient(ctx context.Context, c *models.OAuthClient) error {
+	query := `INSERT INTO oauth_clients (client_id, secret_hash, name, redirect_uris, scopes, user_id, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at`
+	err := r.db.QueryRowContext(ctx, query, c.ClientID, c.SecretHash, c.Name, pq.Array(c.RedirectURIs), pq.Array(c.Scopes), c.UserID, c.CreatedBy).Scan(&c.ID, &c.CreatedAt)
+	if err != nil {
+		return mapError(err)
+	}
+	c.Confidential = c.SecretHash != ""
+	return nil
+}
+
+func (r *PostgresRepository) GetOAuthClient(ctx context.Context, clientID string) (*models.OAuthClient, error) {
+	query := `SELECT ` + oauthClientColumns + ` FROM oauth_clients WHERE client_id = $1`
+	return scanOAuthClient(r.db.QueryRowContext(ctx, query, clientID))
+}
+
+func (r *PostgresRepository) ListOAuthClients(ctx context.Context) ([]*models.OAuthClient, error) {
+	query := `SELECT ` + oauthClientColumns + ` FROM oauth_clients ORDER BY id`
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clients []*models.OAuthClient
+	for rows.Next() {
+		c, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, rows.Err()
+}
+
+func (r *PostgresRepository) RevokeOAuthClient(ctx context.Context, id int64) (*models.OAuthClient, error) {
+	query := `UPDATE oauth_clients SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND revoked_at IS NULL
+		RETURNING ` + oauthClientColumns
+	return scanOAuthClient(r.db.QueryRowContext(ctx, query, id))
+}
+
+func (r *PostgresRepository) CreateAuthorizationCode(ctx context.Context, c *models.AuthorizationCode) error {
+	query := `INSERT INTO oauth_authorization_codes (code_hash, client_id, user_id, redirect_uri, scopes, code_challenge, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at`
+	return r.db.QueryRowContext(ctx, query, c.CodeHash, c.ClientID, c.UserID, c.RedirectURI, pq.Array(c.Scopes), c.CodeChallenge, c.ExpiresAt).Scan(&c.ID, &c.CreatedAt)
+}
+
+func (r *PostgresRepository) GetAuthorizationCodeForUpdate(ctx context.Context, hash string) (*models.AuthorizationCode, error) {
+	c := &models.AuthorizationCode{}
+	query := `SELECT id, code_hash, client_id, user_id, redirect_uri, scopes, code_challenge, family_id, expires_at, used_at, created_at
+		FROM oauth_authorization_codes WHERE code_hash = $1 FOR UPDATE`
+	err := r.db.QueryRowContext(ctx, query, hash).Scan(&c.ID, &c.CodeHash, &c.ClientID, &c.UserID, &c.RedirectURI, pq.Array(&c.Scopes), &c.CodeChallenge, &c.FamilyID, &c.ExpiresAt, &c.UsedAt, &c.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (r *PostgresRepository) UseAuthorizationCode(ctx context.Context, id int64, familyID string) error {
+	query := `UPDATE oauth_authorization_codes SET used_at = CURRENT_TIMESTAMP, family_id = $2 WHERE id = $1 AND used_at IS NULL`
+	return r.execAffected(ctx, query, id, familyID)
+}
+
+// --- API Key Repository ---
+
+const apiKeyColumns = `id, name, prefix, key_hash, user_id, scopes, created_by, expires_at, last_used_at, revoked_at, created_at`
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*models.APIKey, error) {
+	k := &models.APIKey{}
+	err := row.Scan(&k.ID, &k.Name, &k.Prefix, &k.KeyHash, &k.UserID, pq.Array(&k.Scopes), &k.CreatedBy, &k.ExpiresAt, &k.LastUsedAt, &k.RevokedAt, &k.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (r *PostgresRepository) CreateAPIKey(ctx context.Context, k *models.APIKey) error {
+	query := `INSERT INTO api_keys (name, prefix, key_hash, user_id, scopes, created_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at`
+	err := r.db.QueryRowContext(ctx, query, k.Name, k.Prefix, k.KeyHash, k.UserID, pq.Array(k.Scopes), k.CreatedBy, k.ExpiresAt).Scan(&k.ID, &k.CreatedAt)
+	return mapError(err)
+}
+
+func (r *PostgresRepository) GetAPIKeyByPrefix(ctx context.Context, prefix string) (*models.APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE prefix = $1`
+	return scanAPIKey(r.db.QueryRowContext(ctx, query, prefix))
+}
+
+func (r *PostgresRepository) ListAPIKeys(ctx context.Context) ([]*models.APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY id`
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*models.APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (r *PostgresRepository) RevokeAPIKey(ctx context.Context, id int64) error {
+	query := `UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND revoked_at IS NULL`
+	return r.execAffected(ctx, query, id)
+}
+
+func (r *PostgresRepository) TouchAPIKey(ctx context.Context, id int64) error {
+	query := `UPDATE api_keys SET last_used_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < CURRENT_TIMESTAMP - INTERVAL '1 minute')`
 	_, err := r.db.ExecContext(ctx, query, id)
 	return err
 }
 
+// --- Password Reset Repository ---
+
+func (r *PostgresRepository) CreatePasswordResetToken(ctx context.Context, t *models.PasswordResetToken) error {
+	query := `INSERT INTO password_reset_tokens (user_id, token_hash, expires_at) VALUES ($1, $2, $3) RETURNING id, created_at`
+	return r.db.QueryRowContext(ctx, query, t.UserID, t.TokenHash, t.ExpiresAt).Scan(&t.ID, &t.CreatedAt)
+}
+
+func (r *PostgresRepository) GetPasswordResetTokenByHashForUpdate(ctx context.Context, hash string) (*models.PasswordResetToken, error) {
+	t := &models.PasswordResetToken{}
+	query := `SELECT id, user_id, token_hash, expires_at, used_at, created_at FROM password_reset_tokens WHERE token_hash = $1 FOR UPDATE`
+	err := r.db.QueryRowContext(ctx, query, hash).Scan(&t.ID, &t.UserID, &t.TokenHash, &t.ExpiresAt, &t.UsedAt, &t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (r *PostgresRepository) UsePasswordResetTokens(ctx context.Context, userID int64) error {
+	query := `UPDATE password_reset_tokens SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND used_at IS NULL`
+	_, err := r.db.ExecContext(ctx, query, userID)
+	return err
+}
+
+// --- MFA Repository ---
+
+func (r *PostgresRepository) GetUserMFA(ctx context.Context, userID int64) (*models.UserMFA, error) {
+	m := &models.UserMFA{}
+	query := `SELECT user_id, secret, enabled_at, last_used_step, created_at FROM user_mfa WHERE user_id = $1`
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(&m.UserID, &m.Secret, &m.EnabledAt, &m.LastUsedStep, &m.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (r *PostgresRepository) SaveUserMFASecret(ctx context.Context, userID int64, secret []byte) error {
+	query := `INSERT INTO user_mfa (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, enabled_at = NULL, last_used_step = 0, created_at = CURRENT_TIMESTAMP`
+	_, err := r.db.ExecContext(ctx, query, userID, secret)
+	return mapError(err)
+}
+
+func (r *PostgresRepository) EnableUserMFA(ctx context.Context, userID int64, step int64) error {
+	query := `UPDATE user_mfa SET enabled_at = CURRENT_TIMESTAMP, last_used_step = $2 WHERE user_id = $1 AND enabled_at IS NULL`
+	return r.execAffected(ctx, query, userID, step)
+}
+
+func (r *PostgresRepository) UseMFAStep(ctx context.Context, userID int64, step int64) error {
+	query := `UPDATE user_mfa SET last_used_step = $2 WHERE user_id = $1 AND last_used_step < $2`
+	return r.execAffected(ctx, query, userID, step)
+}
+
+func (r *PostgresRepository) DeleteUserMFA(ctx context.Context, userID int64) error {
+	return r.withTx(ctx, func(tr *PostgresRepository) error {
+		if _, err := tr.db.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+			return err
+		}
+		_, err := tr.db.ExecContext(ctx, `DELETE FROM user_mfa WHERE user_id = $1`, userID)
+		return err
+	})
+}
+
+func (r *PostgresRepository) ReplaceRecoveryCodes(ctx context.Context, userID int64, hashes []string) error {
+	return r.withTx(ctx, func(tr *PostgresRepository) error {
+		if _, err := tr.db.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+			return err
+		}
+		for _, h := range hashes {
+			if _, err := tr.db.ExecContext(ctx, `INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, h); err != nil {
+				return mapError(err)
+			}
+		}
+		return nil
+	})
+}
+
+func (r *PostgresRepository) UseRecoveryCode(ctx context.Context, userID int64, hash string) error {
+	query := `UPDATE mfa_recovery_codes SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`
+	return r.execAffected(ctx, query, userID, hash)
+}
+
+// --- Signing Key Repository ---
+
+func (r *PostgresRepository) LockSigningKeys(ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, `LOCK TABLE signing_keys IN SHARE ROW EXCLUSIVE MODE`)
+	return err
+}
+
+func (r *PostgresRepository) ListSigningKeys(ctx context.Context) ([]*models.SigningKey, error) {
+	query := `SELECT id, kid, algorithm, private_key, public_key, created_at, retired_at, verify_until
+		FROM signing_keys WHERE verify_until IS NULL OR verify_until > CURRENT_TIMESTAMP ORDER BY created_at DESC, id DESC`
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*models.SigningKey
+	for rows.Next() {
+		k := &models.SigningKey{}
+		if err := rows.Scan(&k.ID, &k.KID, &k.Algorithm, &k.PrivateKey, &k.PublicKey, &k.CreatedAt, &k.RetiredAt, &k.VerifyUntil); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (r *PostgresRepository) CreateSigningKey(ctx context.Context, k *models.SigningKey) error {
+	query := `INSERT INTO signing_keys (kid, algorithm, private_key, public_key) VALUES ($1, $2, $3, $4) RETURNING id, created_at`
+	return r.db.QueryRowContext(ctx, query, k.KID, k.Algorithm, k.PrivateKey, k.PublicKey).Scan(&k.ID, &k.CreatedAt)
+}
+
+func (r *PostgresRepository) RetireSigningKeys(ctx context.Context, keepID int64, verifyUntil time.Time) error {
+	query := `UPDATE signing_keys SET retired_at = CURRENT_TIMESTAMP, verify_until = $2 WHERE id <> $1 AND retired_at IS NULL`
+	_, err := r.db.ExecContext(ctx, query, keepID, verifyUntil)
+	return err
+}
+
 // --- Transaction Repository ---
 
+const transactionColumns = `id, from_user_id, to_user_id, from_account_id, to_account_id, amount, currency, to_amount, to_currency, fx_rate::text, type, status, created_by, confirmation_expires_at, created_at`
+
+func scanTransaction(row interface{ Scan(...interface{}) error }) (*models.Transaction, error) {
+	tx := &models.Transaction{}
+	err := row.Scan(&tx.ID, &tx.FromUserID, &tx.ToUserID, &tx.FromAccountID, &tx.ToAccountID, &tx.Amount, &tx.Currency, &tx.ToAmount, &tx.ToCurrency, &tx.FXRate, &tx.Type, &tx.Status, &tx.CreatedBy, &tx.ConfirmationExpiresAt, &tx.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
 func (r *PostgresRepository) CreateTransaction(ctx context.Context, tx *models.Transaction) error {
-	query := `INSERT INTO transactions (from_user_id, to_user_id, amount, type, status) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at`
-	err := r.db.QueryRowContext(ctx, query, tx.FromUserID, tx.ToUserID, tx.Amount, tx.Type, tx.Status).Scan(&tx.ID, &tx.CreatedAt)
+	query := `INSERT INTO transactions (from_user_id, to_user_id, from_account_id, to_account_id, amount, currency, to_amount, to_currency, fx_rate, type, status, created_by, confirmation_expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) RETURNING id, created_at`
+	err := r.db.QueryRowContext(ctx, query, tx.FromUserID, tx.ToUserID, tx.FromAccountID, tx.ToAccountID, tx.Amount, tx.Currency, tx.ToAmount, tx.ToCurrency, tx.FXRate, tx.Type, tx.Status, tx.CreatedBy, tx.ConfirmationExpiresAt).Scan(&tx.ID, &tx.CreatedAt)
 	return err
 }
 
 func (r *PostgresRepository) GetTransactionByID(ctx context.Context, id int64) (*models.Transaction, error) {
-	tx := &models.Transaction{}
-	query := `SELECT id, from_user_id, to_user_id, amount, type, status, created_at FROM transactions WHERE id = $1`
-	err := r.db.QueryRowContext(ctx, query, id).Scan(&tx.ID, &tx.FromUserID, &tx.ToUserID, &tx.Amount, &tx.Type, &tx.Status, &tx.CreatedAt)
+	query := `SELECT ` + transactionColumns + ` FROM transactions WHERE id = $1`
+	return scanTransaction(r.db.QueryRowContext(ctx, query, id))
+}
+
+func (r *PostgresRepository) GetRecentTransactionsByUserID(ctx context.Context, userID int64, limit int) ([]*models.Transaction, error) {
+	query := `SELECT ` + transactionColumns + ` FROM transactions WHERE from_user_id = $1 OR to_user_id = $1 ORDER BY created_at DESC LIMIT $2`
+	rows, err := r.db.QueryContext(ctx, query, userID, limit)
 	if err != nil {
 		return nil, err
 	}
-	return tx, nil
+	defer rows.Close()
+
+	var txs []*models.Transaction
+	for rows.Next() {
+		tx, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		txs = append(txs, tx)
+	}
+	return txs, rows.Err()
+}
+
+func (r *PostgresRepository) HasUnsettledTransactions(ctx context.Context, userID int64) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM transactions WHERE (from_user_id = $1 OR to_user_id = $1) AND status IN ($2, $3))
+		OR EXISTS (SELECT 1 FROM holds WHERE from_user_id = $1 AND status = 'active' AND expires_at > CURRENT_TIMESTAMP)`
+	var exists bool
+	err := r.db.QueryRowContext(ctx, query, userID, models.TxStatusPending, models.TxStatusRequiresConfirmation).Scan(&exists)
+	return exists, err
 }
 
 func (r *PostgresRepository) GetTransactionsByUserID(ctx context.Context, userID int64) ([]*models.Transaction, error) {
-	query := `SELECT id, from_user_id, to_user_id, amount, type, status, created_at FROM transactions WHERE from_user_id = $1 OR to_user_id = $1 ORDER BY created_at DESC`
+	query := `SELECT ` + transactionColumns + ` FROM transactions WHERE from_user_id = $1 OR to_user_id = $1 ORDER BY created_at DESC`
 	rows, err := r.db.QueryContext(ctx, query, userID)
 	if err != nil {
 		return nil, err
@@ -103,8 +609,8 @@ func (r *PostgresRepository) GetTransactionsByUserID(ctx context.Context, userID
 
 	var txs []*models.Transaction
 	for rows.Next() {
-		tx := &models.Transaction{}
-		if err := rows.Scan(&tx.ID, &tx.FromUserID, &tx.ToUserID, &tx.Amount, &tx.Type, &tx.Status, &tx.CreatedAt); err != nil {
+		tx, err := scanTransaction(rows)
+		if err != nil {
 			return nil, err
 		}
 		txs = append(txs, tx)
@@ -112,46 +618,709 @@ func (r *PostgresRepository) GetTransactionsByUserID(ctx context.Context, userID
 	return txs, nil
 }
 
+// GetTransactionByIDForUpdate locks the transaction row until the surrounding
+// database transaction ends.
+func (r *PostgresRepository) GetTransactionByIDForUpdate(ctx context.Context, id int64) (*models.Transaction, error) {
+	query := `SELECT ` + transactionColumns + ` FROM transactions WHERE id = $1 FOR UPDATE`
+	return scanTransaction(r.db.QueryRowContext(ctx, query, id))
+}
+
 func (r *PostgresRepository) UpdateTransactionStatus(ctx context.Context, id int64, status string) error {
 	query := `UPDATE transactions SET status = $1 WHERE id = $2`
 	_, err := r.db.ExecContext(ctx, query, status, id)
 	return err
 }
 
+func (r *PostgresRepository) ExpireUnconfirmedTransactions(ctx context.Context) (int64, error) {
+	query := `UPDATE transactions SET status = 'expired'
+		WHERE status = 'requires_confirmation' AND confirmation_expires_at < CURRENT_TIMESTAMP`
+	res, err := r.db.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// --- Account Repository ---
+
+const accountColumns = `a.id, a.user_id, a.number, a.name, a.type, a.currency, a.status, a.is_default, COALESCE(b.amount, 0), COALESCE(b.amount, 0) - ` + heldAmount + `, a.created_at, a.closed_at`
+
+// heldAmount sums the active holds on account a.id.
+const heldAmount = `(SELECT COALESCE(SUM(h.amount), 0) FROM holds h WHERE h.from_account_id = a.id AND h.status = 'active' AND h.expires_at > CURRENT_TIMESTAMP)`
+
+// accountsFrom joins each account with its balance.
+const accountsFrom = ` FROM accounts a LEFT JOIN account_balances b ON b.account_id = a.id `
+
+func scanAccount(row interface{ Scan(...interface{}) error }) (*models.Account, error) {
+	a := &models.Account{}
+	err := row.Scan(&a.ID, &a.UserID, &a.Number, &a.Name, &a.Type, &a.Currency, &a.Status, &a.Default, &a.Balance, &a.Available, &a.CreatedAt, &a.ClosedAt)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (r *PostgresRepository) CreateAccount(ctx context.Context, a *models.Account) error {
+	query := `INSERT INTO accounts (user_id, name, type, currency, is_default)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id, number, status, created_at`
+	return r.db.QueryRowContext(ctx, query, a.UserID, a.Name, a.Type, a.Currency, a.Default).Scan(&a.ID, &a.Number, &a.Status, &a.CreatedAt)
+}
+
+func (r *PostgresRepository) GetAccountByID(ctx context.Context, id int64) (*models.Account, error) {
+	query := `SELECT ` + accountColumns + accountsFrom + `WHERE a.id = $1`
+	return scanAccount(r.db.QueryRowContext(ctx, query, id))
+}
+
+func (r *PostgresRepository) GetDefaultAccount(ctx context.Context, userID int64) (*models.Account, error) {
+	query := `SELECT ` + accountColumns + accountsFrom + `WHERE a.user_id = $1 AND a.is_default`
+	return scanAccount(r.db.QueryRowContext(ctx, query, userID))
+}
+
+func (r *PostgresRepository) ListAccountsByUserID(ctx context.Context, userID int64) ([]*models.Account, error) {
+	query := `SELECT ` + accountColumns + accountsFrom + `WHERE a.user_id = $1 ORDER BY a.is_default DESC, a.id`
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []*models.Account
+	for rows.Next() {
+		a, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+func (r *PostgresRepository) RenameAccount(ctx context.Context, id, userID int64, name string) error {
+	query := `UPDATE accounts SET name = $3 WHERE id = $1 AND user_id = $2`
+	return r.execAffected(ctx, query, id, userID, name)
+}
+
+func (r *PostgresRepository) CloseUserAccounts(ctx context.Context, userID int64) error {
+	query := `UPDATE accounts SET status = 'closed', closed_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND status <> 'closed'`
+	_, err := r.db.ExecContext(ctx, query, userID)
+	return err
+}
+
+// --- Hold Repository ---
+
+const holdColumns = `id, from_user_id, from_account_id, to_user_id, to_account_id, amount, currency, captured_amount, description, status, created_by, transaction_id, expires_at, created_at, closed_at`
+
+func scanHold(row interface{ Scan(...interface{}) error }) (*models.Hold, error) {
+	h := &models.Hold{}
+	err := row.Scan(&h.ID, &h.FromUserID, &h.FromAccountID, &h.ToUserID, &h.ToAccountID, &h.Amount, &h.Currency, &h.CapturedAmount, &h.Description, &h.Status, &h.CreatedBy, &h.TransactionID, &h.ExpiresAt, &h.CreatedAt, &h.ClosedAt)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (r *PostgresRepository) CreateHold(ctx context.Context, h *models.Hold) error {
+	query := `INSERT INTO holds (from_user_id, from_account_id, to_user_id, to_account_id, amount, currency, description, status, created_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id, created_at`
+	err := r.db.QueryRowContext(ctx, query, h.FromUserID, h.FromAccountID, h.ToUserID, h.ToAccountID, h.Amount, h.Currency, h.Description, h.Status, h.CreatedBy, h.ExpiresAt).Scan(&h.ID, &h.CreatedAt)
+	return mapError(err)
+}
+
+// GetHoldByIDForUpdate locks the hold row until the surrounding database
+// transaction ends.
+func (r *PostgresRepository) GetHoldByIDForUpdate(ctx context.Context, id int64) (*models.Hold, error) {
+	query := `SELECT ` + holdColumns + ` FROM holds WHERE id = $1 FOR UPDATE`
+	return scanHold(r.db.QueryRowContext(ctx, query, id))
+}
+
+func (r *PostgresRepository) ListHoldsByUserID(ctx context.Context, userID int64) ([]*models.Hold, error) {
+	query := `SELECT ` + holdColumns + ` FROM holds WHERE from_user_id = $1 OR created_by = $1 ORDER BY created_at DESC`
+	return r.listHolds(ctx, query, userID)
+}
+
+func (r *PostgresRepository) listHolds(ctx context.Context, query string, args ...interface{}) ([]*models.Hold, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var holds []*models.Hold
+	for rows.Next() {
+		h, err := scanHold(rows)
+		if err != nil {
+			return nil, err
+		}
+		holds = append(holds, h)
+	}
+	return holds, rows.Err()
+}
+
+func (r *PostgresRepository) CaptureHold(ctx context.Context, id, amount, transactionID int64) error {
+	query := `UPDATE holds SET status = 'captured', captured_amount = $2, transaction_id = $3, closed_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = 'active'`
+	return r.execAffected(ctx, query, id, amount, transactionID)
+}
+
+func (r *PostgresRepository) VoidHold(ctx context.Context, id int64) error {
+	query := `UPDATE holds SET status = 'voided', closed_at = CURRENT_TIMESTAMP WHERE id = $1 AND status = 'active'`
+	return r.execAffected(ctx, query, id)
+}
+
+func (r *PostgresRepository) ExpireHolds(ctx context.Context) ([]*models.Hold, error) {
+	query := `UPDATE holds SET status = 'expired', closed_at = CURRENT_TIMESTAMP
+		WHERE status = 'active' AND expires_at <= CURRENT_TIMESTAMP
+		RETURNING ` + holdColumns
+	return r.listHolds(ctx, query)
+}
+
+// --- Standing Order Repository ---
+
+const standingOrderColumns = `id, user_id, from_account_id, to_user_id, to_account_id, amount, description, frequency, start_date, end_date, on_insufficient_funds, status, next_run_date, next_attempt_at, attempts, run_count, last_run_at, last_transaction_id, last_error, created_at, updated_at`
+
+func scanStandingOrder(row interface{ Scan(...interface{}) error }) (*models.StandingOrder, error) {
+	o := &models.StandingOrder{}
+	err := row.Scan(&o.ID, &o.UserID, &o.FromAccountID, &o.ToUserID, &o.ToAccountID, &o.Amount, &o.Description, &o.Frequency, &o.StartDate, &o.EndDate, &o.OnInsufficientFunds, &o.Status, &o.NextRunDate, &o.NextAttemptAt, &o.Attempts, &o.RunCount, &o.LastRunAt, &o.LastTransactionID, &o.LastError, &o.CreatedAt, &o.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	o.StartDate, o.NextRunDate = o.StartDate.UTC(), o.NextRunDate.UTC()
+	if o.EndDate != nil {
+		end := o.EndDate.UTC()
+		o.EndDate = &end
+	}
+	return o, nil
+}
+
+// dateParam formats t as a DATE, so the session time zone cannot shift it.
+func dateParam(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format(time.DateOnly)
+}
+
+func (r *PostgresRepository) CreateStandingOrder(ctx context.Context, o *models.StandingOrder) error {
+	query := `INSERT INTO standing_orders (user_id, from_account_id, to_user_id, to_account_id, amount, description, frequency, start_date, end_date, on_insufficient_funds, status, next_run_date, next_attempt_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) RETURNING id, created_at, updated_at`
+	err := r.db.QueryRowContext(ctx, query, o.UserID, o.FromAccountID, o.ToUserID, o.ToAccountID, o.Amount, o.Description, o.Frequency,
+		dateParam(&o.StartDate), dateParam(o.EndDate), o.OnInsufficientFunds, o.Status, dateParam(&o.NextRunDate), o.NextAttemptAt).Scan(&o.ID, &o.CreatedAt, &o.UpdatedAt)
+	return mapError(err)
+}
+
+// GetStandingOrderByIDForUpdate locks the order row until the surrounding
+// database transaction ends.
+func (r *PostgresRepository) GetStandingOrderByIDForUpdate(ctx context.Context, id int64) (*models.StandingOrder, error) {
+	query := `SELECT ` + standingOrderColumns + ` FROM standing_orders WHERE id = $1 FOR UPDATE`
+	return scanStandingOrder(r.db.QueryRowContext(ctx, query, id))
+}
+
+func (r *PostgresRepository) ListStandingOrdersByUserID(ctx context.Context, userID int64) ([]*models.StandingOrder, error) {
+	query := `SELECT ` + standingOrderColumns + ` FROM standing_orders WHERE user_id = $1 ORDER BY created_at DESC`
+	return r.listStandingOrders(ctx, query, userID)
+}
+
+func (r *PostgresRepository) listStandingOrders(ctx context.Context, query string, args ...interface{}) ([]*models.StandingOrder, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []*models.StandingOrder
+	for rows.Next() {
+		o, err := scanStandingOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
+
+func (r *PostgresRepository) UpdateStandingOrder(ctx context.Context, o *models.StandingOrder) error {
+	query := `UPDATE standing_orders SET amount = $2, description = $3, end_date = $4, on_insufficient_funds = $5, status = $6, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 RETURNING updated_at`
+	err := r.db.QueryRowContext(ctx, query, o.ID, o.Amount, o.Description, dateParam(o.EndDate), o.OnInsufficientFunds, o.Status).Scan(&o.UpdatedAt)
+	return mapError(err)
+}
+
+func (r *PostgresRepository) ClaimDueStandingOrders(ctx context.Context, lease time.Duration, limit int) ([]*models.StandingOrder, error) {
+	query := `UPDATE standing_orders SET locked_until = CURRENT_TIMESTAMP + $1 * INTERVAL '1 millisecond'
+		WHERE id IN (
+			SELECT id FROM standing_orders
+			WHERE status = 'active' AND next_attempt_at <= CURRENT_TIMESTAMP
+				AND (locked_until IS NULL OR locked_until < CURRENT_TIMESTAMP)
+			ORDER BY next_attempt_at, id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + standingOrderColumns
+	return r.listStandingOrders(ctx, query, lease.Milliseconds(), limit)
+}
+
+func (r *PostgresRepository) SaveStandingOrderRun(ctx context.Context, o *models.StandingOrder) error {
+	query := `UPDATE standing_orders SET
+			status = CASE WHEN status = 'active' THEN $2 ELSE status END,
+			next_run_date = $3,
+			next_attempt_at = $4,
+			attempts = $5,
+			run_count = $6,
+			last_run_at = $7,
+			last_transaction_id = $8,
+			last_error = $9,
+			locked_until = NULL,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`
+	_, err := r.db.ExecContext(ctx, query, o.ID, o.Status, dateParam(&o.NextRunDate), o.NextAttemptAt, o.Attempts, o.RunCount, o.LastRunAt, o.LastTransactionID, o.LastError)
+	return mapError(err)
+}
+
+func (r *PostgresRepository) CancelUserStandingOrders(ctx context.Context, userID int64) error {
+	query := `UPDATE standing_orders SET status = 'cancelled', updated_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND status = 'active'`
+	_, err := r.db.ExecContext(ctx, query, userID)
+	return err
+}
+
 // --- Balance Repository ---
 
-func (r *PostgresRepository) GetBalanceByUserID(ctx context.Context, userID int64) (*models.Balance, error) {
+func (r *PostgresRepository) GetBalanceByAccountID(ctx context.Context, accountID int64) (*models.Balance, error) {
 	b := &models.Balance{}
-	query := `SELECT user_id, amount, last_updated_at FROM balances WHERE user_id = $1`
-	err := r.db.QueryRowContext(ctx, query, userID).Scan(&b.UserID, &b.Amount, &b.LastUpdatedAt)
+	query := `SELECT a.id, COALESCE(b.amount, 0), COALESCE(b.amount, 0) - ` + heldAmount + `, a.currency, COALESCE(b.last_updated_at, a.created_at)` + accountsFrom + `WHERE a.id = $1`
+	err := r.db.QueryRowContext(ctx, query, accountID).Scan(&b.AccountID, &b.Ledger, &b.Available, &b.Currency, &b.LastUpdatedAt)
 	if err != nil {
 		return nil, err
 	}
 	return b, nil
 }
 
-func (r *PostgresRepository) CreateBalance(ctx context.Context, balance *models.Balance) error {
-	query := `INSERT INTO balances (user_id, amount) VALUES ($1, $2)`
-	_, err := r.db.ExecContext(ctx, query, balance.UserID, balance.Amount)
+// GetBalancesForUpdate locks the balance rows of the given accounts one at a
+// time in ascending account id order, creating empty rows where needed, so
+// that concurrent callers always acquire locks in the same order.
+func (r *PostgresRepository) GetBalancesForUpdate(ctx context.Context, accountIDs []int64) (map[int64]*models.Balance, error) {
+	ids := append([]int64(nil), accountIDs...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	balances := make(map[int64]*models.Balance, len(ids))
+	for _, id := range ids {
+		if _, seen := balances[id]; seen {
+			continue
+		}
+		if _, err := r.db.ExecContext(ctx, `INSERT INTO account_balances (account_id, amount) VALUES ($1, 0) ON CONFLICT (account_id) DO NOTHING`, id); err != nil {
+			return nil, mapError(err)
+		}
+		b := &models.Balance{}
+		query := `SELECT b.account_id, b.amount, b.amount - ` + heldAmount + `, a.currency, b.last_updated_at
+			FROM account_balances b JOIN accounts a ON a.id = b.account_id WHERE b.account_id = $1 FOR UPDATE OF b`
+		if err := r.db.QueryRowContext(ctx, query, id).Scan(&b.AccountID, &b.Ledger, &b.Available, &b.Currency, &b.LastUpdatedAt); err != nil {
+			return nil, err
+		}
+		balances[id] = b
+	}
+	return balances, nil
+}
+
+// --- Ledger Repository ---
+
+// CreateJournalEntry inserts the entry with its postings and applies them to the
+// balances projection in a single database transaction.
+func (r *PostgresRepository) CreateJournalEntry(ctx context.Context, entry *models.JournalEntry) error {
+	return r.withTx(ctx, func(tr *PostgresRepository) error {
+		query := `INSERT INTO journal_entries (transaction_id, description) VALUES ($1, $2) RETURNING id, created_at`
+		if err := tr.db.QueryRowContext(ctx, query, entry.TransactionID, entry.Description).Scan(&entry.ID, &entry.CreatedAt); err != nil {
+			return err
+		}
+
+		for _, p := range entry.Postings {
+			p.JournalEntryID = entry.ID
+			query := `INSERT INTO postings (journal_entry_id, account_type, user_id, account_id, direction, amount, currency) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at`
+			if err := tr.db.QueryRowContext(ctx, query, p.JournalEntryID, p.AccountType, p.UserID, p.AccountID, p.Direction, p.Amount, p.Currency).Scan(&p.ID, &p.CreatedAt); err != nil {
+				return err
+			}
+			if p.AccountID == nil {
+				continue
+			}
+			query = `INSERT INTO account_balances (account_id, amount) VALUES ($1, $2)
+				ON CONFLICT (account_id) DO UPDATE SET amount = account_balances.amount + EXCLUDED.amount, last_updated_at = CURRENT_TIMESTAMP`
+			if _, err := tr.db.ExecContext(ctx, query, *p.AccountID, p.BalanceDelta()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *PostgresRepository) GetJournalEntriesByTransactionID(ctx context.Context, txID int64) ([]*models.JournalEntry, error) {
+	query := `SELECT id, transaction_id, description, created_at FROM journal_entries WHERE transaction_id = $1 ORDER BY id`
+	rows, err := r.db.QueryContext(ctx, query, txID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*models.JournalEntry
+	for rows.Next() {
+		e := &models.JournalEntry{}
+		if err := rows.Scan(&e.ID, &e.TransactionID, &e.Description, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		postings, err := r.getPostings(ctx, `WHERE journal_entry_id = $1`, e.ID)
+		if err != nil {
+			return nil, err
+		}
+		e.Postings = postings
+	}
+	return entries, nil
+}
+
+func (r *PostgresRepository) GetPostingsByUserID(ctx context.Context, userID int64) ([]*models.Posting, error) {
+	return r.getPostings(ctx, `WHERE user_id = $1`, userID)
+}
+
+func (r *PostgresRepository) getPostings(ctx context.Context, where string, arg interface{}) ([]*models.Posting, error) {
+	query := `SELECT id, journal_entry_id, account_type, user_id, account_id, direction, amount, currency, created_at FROM postings ` + where + ` ORDER BY id DESC`
+	rows, err := r.db.QueryContext(ctx, query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var postings []*models.Posting
+	for rows.Next() {
+		p := &models.Posting{}
+		if err := rows.Scan(&p.ID, &p.JournalEntryID, &p.AccountType, &p.UserID, &p.AccountID, &p.Direction, &p.Amount, &p.Currency, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		postings = append(postings, p)
+	}
+	return postings, rows.Err()
+}
+
+func (r *PostgresRepository) GetLedgerTotals(ctx context.Context) ([]*models.LedgerTotal, error) {
+	query := `SELECT currency,
+		COALESCE(SUM(amount) FILTER (WHERE direction = 'debit'), 0),
+		COALESCE(SUM(amount) FILTER (WHERE direction = 'credit'), 0)
+		FROM postings GROUP BY currency ORDER BY currency`
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var totals []*models.LedgerTotal
+	for rows.Next() {
+		t := &models.LedgerTotal{}
+		if err := rows.Scan(&t.Currency, &t.TotalDebits, &t.TotalCredits); err != nil {
+			return nil, err
+		}
+		totals = append(totals, t)
+	}
+	return totals, rows.Err()
+}
+
+// ListBalanceMismatches returns accounts whose projected balance differs from
+// the sum of their postings.
+func (r *PostgresRepository) ListBalanceMismatches(ctx context.Context) ([]*models.BalanceMismatch, error) {
+	query := `SELECT COALESCE(b.account_id, l.account_id), COALESCE(b.amount, 0), COALESCE(l.amount, 0)
+		FROM account_balances b
+		FULL OUTER JOIN (
+			SELECT account_id, SUM(CASE WHEN direction = 'credit' THEN amount ELSE -amount END) AS amount
+			FROM postings WHERE account_id IS NOT NULL GROUP BY account_id
+		) l ON l.account_id = b.account_id
+		WHERE COALESCE(b.amount, 0) <> COALESCE(l.amount, 0)`
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mismatches []*models.BalanceMismatch
+	for rows.Next() {
+		m := &models.BalanceMismatch{}
+		if err := rows.Scan(&m.AccountID, &m.Projected, &m.Ledger); err != nil {
+			return nil, err
+		}
+		mismatches = append(mismatches, m)
+	}
+	return mismatches, rows.Err()
+}
+
+// --- FX Rate Repository ---
+
+const fxRateColumns = `id, base, quote, rate::text, updated_by, updated_at`
+
+func scanFXRate(row interface{ Scan(...interface{}) error }) (*models.FXRate, error) {
+	f := &models.FXRate{}
+	err := row.Scan(&f.ID, &f.Base, &f.Quote, &f.Rate, &f.UpdatedBy, &f.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (r *PostgresRepository) ListFXRates(ctx context.Context) ([]*models.FXRate, error) {
+	query := `SELECT ` + fxRateColumns + ` FROM fx_rates ORDER BY base, quote`
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rates []*models.FXRate
+	for rows.Next() {
+		f, err := scanFXRate(rows)
+		if err != nil {
+			return nil, err
+		}
+		rates = append(rates, f)
+	}
+	return rates, rows.Err()
+}
+
+func (r *PostgresRepository) GetFXRate(ctx context.Context, base, quote string) (*models.FXRate, error) {
+	query := `SELECT ` + fxRateColumns + ` FROM fx_rates WHERE base = $1 AND quote = $2`
+	return scanFXRate(r.db.QueryRowContext(ctx, query, base, quote))
+}
+
+func (r *PostgresRepository) SaveFXRate(ctx context.Context, f *models.FXRate) error {
+	query := `INSERT INTO fx_rates (base, quote, rate, updated_by) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (base, quote) DO UPDATE SET rate = EXCLUDED.rate, updated_by = EXCLUDED.updated_by, updated_at = CURRENT_TIMESTAMP
+		RETURNING id, updated_at`
+	err := r.db.QueryRowContext(ctx, query, f.Base, f.Quote, f.Rate, f.UpdatedBy).Scan(&f.ID, &f.UpdatedAt)
+	return mapError(err)
+}
+
+func (r *PostgresRepository) DeleteFXRate(ctx context.Context, id int64) error {
+	return r.execAffected(ctx, `DELETE FROM fx_rates WHERE id = $1`, id)
+}
+
+// --- Idempotency Repository ---
+
+func (r *PostgresRepository) GetIdempotencyKey(ctx context.Context, userID int64, key string) (*models.IdempotencyKey, error) {
+	k := &models.IdempotencyKey{}
+	query := `SELECT user_id, key, request_hash, transaction_id, response_body, created_at, expires_at
+		FROM idempotency_keys WHERE user_id = $1 AND key = $2 AND expires_at > CURRENT_TIMESTAMP`
+	err := r.db.QueryRowContext(ctx, query, userID, key).Scan(&k.UserID, &k.Key, &k.RequestHash, &k.TransactionID, &k.ResponseBody, &k.CreatedAt, &k.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// CreateIdempotencyKey replaces an expired key with the same name, if any.
+func (r *PostgresRepository) CreateIdempotencyKey(ctx context.Context, k *models.IdempotencyKey) error {
+	query := `INSERT INTO idempotency_keys (user_id, key, request_hash, transaction_id, response_body, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id, key) DO UPDATE SET
+			request_hash = EXCLUDED.request_hash,
+			transaction_id = EXCLUDED.transaction_id,
+			response_body = EXCLUDED.response_body,
+			created_at = CURRENT_TIMESTAMP,
+			expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at <= CURRENT_TIMESTAMP
+		RETURNING created_at`
+	err := r.db.QueryRowContext(ctx, query, k.UserID, k.Key, k.RequestHash, k.TransactionID, k.ResponseBody, k.ExpiresAt).Scan(&k.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		// The conflicting key has not expired yet
+		return ErrDuplicate
+	}
+	return mapError(err)
+}
+
+func (r *PostgresRepository) DeleteExpiredIdempotencyKeys(ctx context.Context) error {
+	query := `DELETE FROM idempotency_keys WHERE expires_at <= CURRENT_TIMESTAMP`
+	_, err := r.db.ExecContext(ctx, query)
 	return err
 }
 
-func (r *PostgresRepository) UpdateBalance(ctx context.Context, balance *models.Balance) error {
-	query := `UPDATE balances SET amount = $1, last_updated_at = CURRENT_TIMESTAMP WHERE user_id = $2`
-	_, err := r.db.ExecContext(ctx, query, balance.Amount, balance.UserID)
+// --- Job Repository ---
+
+const jobColumns = `id, transaction_id, status, attempts, run_at, locked_by, lease_expires_at, heartbeat_at, last_error, dead_at, created_at, updated_at`
+
+func scanJob(row interface{ Scan(...interface{}) error }) (*models.Job, error) {
+	j := &models.Job{}
+	err := row.Scan(&j.ID, &j.TransactionID, &j.Status, &j.Attempts, &j.RunAt, &j.LockedBy, &j.LeaseExpiresAt, &j.HeartbeatAt, &j.LastError, &j.DeadAt, &j.CreatedAt, &j.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (r *PostgresRepository) EnqueueJob(ctx context.Context, transactionID int64) error {
+	query := `INSERT INTO jobs (transaction_id) VALUES ($1) ON CONFLICT (transaction_id) DO NOTHING`
+	_, err := r.db.ExecContext(ctx, query, transactionID)
 	return err
 }
 
+// ClaimJob picks up queued jobs as well as running jobs whose lease has
+// expired, which is how work left behind by a crashed instance is recovered.
+func (r *PostgresRepository) ClaimJob(ctx context.Context, owner string, lease time.Duration) (*models.Job, error) {
+	query := `UPDATE jobs SET
+			status = 'running',
+			locked_by = $1,
+			attempts = attempts + 1,
+			lease_expires_at = CURRENT_TIMESTAMP + $2 * INTERVAL '1 millisecond',
+			heartbeat_at = CURRENT_TIMESTAMP,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE (status = 'queued' AND run_at <= CURRENT_TIMESTAMP)
+				OR (status = 'running' AND lease_expires_at < CURRENT_TIMESTAMP)
+			ORDER BY id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + jobColumns
+	job, err := scanJob(r.db.QueryRowContext(ctx, query, owner, lease.Milliseconds()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	job.Transaction, err = r.GetTransactionByID(ctx, job.TransactionID)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (r *PostgresRepository) HeartbeatJob(ctx context.Context, id int64, owner string, lease time.Duration) error {
+	query := `UPDATE jobs SET
+			lease_expires_at = CURRENT_TIMESTAMP + $3 * INTERVAL '1 millisecond',
+			heartbeat_at = CURRENT_TIMESTAMP,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND locked_by = $2 AND status = 'running'`
+	return r.execOwned(ctx, query, id, owner, lease.Milliseconds())
+}
+
+func (r *PostgresRepository) CompleteJob(ctx context.Context, id int64, owner string) error {
+	query := `UPDATE jobs SET status = 'completed', locked_by = NULL, lease_expires_at = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND locked_by = $2 AND status = 'running'`
+	return r.execOwned(ctx, query, id, owner)
+}
+
+func (r *PostgresRepository) FailJob(ctx context.Context, id int64, owner string, reason string) error {
+	query := `UPDATE jobs SET status = 'failed', locked_by = NULL, lease_expires_at = NULL, last_error = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND locked_by = $2 AND status = 'running'`
+	return r.execOwned(ctx, query, id, owner, reason)
+}
+
+// RetryJob puts the job back in the queue to run again after delay.
+func (r *PostgresRepository) RetryJob(ctx context.Context, id int64, owner string, delay time.Duration, reason string) error {
+	query := `UPDATE jobs SET
+			status = 'queued',
+			run_at = CURRENT_TIMESTAMP + $3 * INTERVAL '1 millisecond',
+			locked_by = NULL,
+			lease_expires_at = NULL,
+			last_error = $4,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND locked_by = $2 AND status = 'running'`
+	return r.execOwned(ctx, query, id, owner, delay.Milliseconds(), reason)
+}
+
+func (r *PostgresRepository) DeadLetterJob(ctx context.Context, id int64, owner string, reason string) error {
+	query := `UPDATE jobs SET status = 'dead', dead_at = CURRENT_TIMESTAMP, locked_by = NULL, lease_expires_at = NULL, last_error = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND locked_by = $2 AND status = 'running'`
+	return r.execOwned(ctx, query, id, owner, reason)
+}
+
+func (r *PostgresRepository) ListDeadJobs(ctx context.Context) ([]*models.Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE status = 'dead' ORDER BY dead_at DESC`
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*models.Job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, j := range jobs {
+		if j.Transaction, err = r.GetTransactionByID(ctx, j.TransactionID); err != nil {
+			return nil, err
+		}
+	}
+	return jobs, nil
+}
+
+// GetDeadJobForUpdate locks a dead job. It returns sql.ErrNoRows if the job
+// does not exist or is not dead.
+func (r *PostgresRepository) GetDeadJobForUpdate(ctx context.Context, id int64) (*models.Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE id = $1 AND status = 'dead' FOR UPDATE`
+	return scanJob(r.db.QueryRowContext(ctx, query, id))
+}
+
+func (r *PostgresRepository) RequeueDeadJob(ctx context.Context, id int64) error {
+	query := `UPDATE jobs SET status = 'queued', attempts = 0, run_at = CURRENT_TIMESTAMP, dead_at = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = 'dead'`
+	return r.execAffected(ctx, query, id)
+}
+
+func (r *PostgresRepository) DiscardDeadJob(ctx context.Context, id int64) error {
+	query := `UPDATE jobs SET status = 'discarded', updated_at = CURRENT_TIMESTAMP WHERE id = $1 AND status = 'dead'`
+	return r.execAffected(ctx, query, id)
+}
+
+// execAffected runs an update and returns sql.ErrNoRows if it matched nothing.
+func (r *PostgresRepository) execAffected(ctx context.Context, query string, args ...interface{}) error {
+	res, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// execOwned runs an update that only applies while owner holds the job lease.
+func (r *PostgresRepository) execOwned(ctx context.Context, query string, args ...interface{}) error {
+	res, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
 // --- Audit Repository ---
 
 func (r *PostgresRepository) CreateAuditLog(ctx context.Context, log *models.AuditLog) error {
-	query := `INSERT INTO audit_logs (entity_type, entity_id, action, details) VALUES ($1, $2, $3, $4)`
-	_, err := r.db.ExecContext(ctx, query, log.EntityType, log.EntityID, log.Action, log.Details)
+	query := `INSERT INTO audit_logs (entity_type, entity_id, actor_id, action, details) VALUES ($1, $2, $3, $4, $5)`
+	_, err := r.db.ExecContext(ctx, query, log.EntityType, log.EntityID, log.ActorID, log.Action, log.Details)
 	return err
 }
 
 func (r *PostgresRepository) GetAuditLogsByEntity(ctx context.Context, entityType string, entityID int64) ([]*models.AuditLog, error) {
-   query := `SELECT id, entity_type, entity_id, action, details, created_at FROM audit_logs WHERE entity_type = $1 AND entity_id = $2 ORDER BY created_at DESC`
+   query := `SELECT id, entity_type, entity_id, actor_id, action, details, created_at FROM audit_logs WHERE entity_type = $1 AND entity_id = $2 ORDER BY created_at DESC`
 	rows, err := r.db.QueryContext(ctx, query, entityType, entityID)
 	if err != nil {
 		return nil, err
@@ -161,7 +1330,7 @@ func (r *PostgresRepository) GetAuditLogsByEntity(ctx context.Context, entityTyp
 	var logs []*models.AuditLog
 	for rows.Next() {
 		l := &models.AuditLog{}
-		if err := rows.Scan(&l.ID, &l.EntityType, &l.EntityID, &l.Action, &l.Details, &l.CreatedAt); err != nil {
+		if err := rows.Scan(&l.ID, &l.EntityType, &l.EntityID, &l.ActorID, &l.Action, &l.Details, &l.CreatedAt); err != nil {
 			return nil, err
 		}
 		logs = append(logs, l)
@@ -2,29 +2,221 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"time"
+
 	"backend/internal/models"
 )
 
+var (
+	// ErrDuplicate is returned when an insert or update violates a unique constraint.
+	ErrDuplicate = errors.New("duplicate record")
+	// ErrInvalidReference is returned when a foreign key points at a missing record.
+	ErrInvalidReference = errors.New("referenced record does not exist")
+	// ErrLeaseLost is returned when a worker no longer holds the lease on a job.
+	ErrLeaseLost = errors.New("job lease lost")
+)
+
 type UserRepository interface {
 	CreateUser(ctx context.Context, user *models.User) error
 	GetUserByID(ctx context.Context, id int64) (*models.User, error)
+	// GetUserByEmail expects email in the lowercase form users are stored with
 	GetUserByEmail(ctx context.Context, email string) (*models.User, error)
 	ListUsers(ctx context.Context) ([]*models.User, error)
+	// UpdateUser returns ErrDuplicate if the username or email is taken
 	UpdateUser(ctx context.Context, user *models.User) error
-	DeleteUser(ctx context.Context, id int64) error
+	UpdateUserPassword(ctx context.Context, id int64, passwordHash string) error
+	// MarkUserVerified returns sql.ErrNoRows if the user's email is no longer email
+	MarkUserVerified(ctx context.Context, id int64, email string) error
+	// ClaimVerificationSend records that a verification email is being sent. It
+	// returns sql.ErrNoRows if the user is verified or one was sent within minInterval.
+	ClaimVerificationSend(ctx context.Context, id int64, minInterval time.Duration) error
+	// ClaimPasswordResetSend records that a password reset email is being sent.
+	// It returns sql.ErrNoRows if one was sent within minInterval.
+	ClaimPasswordResetSend(ctx context.Context, id int64, minInterval time.Duration) error
+	LockUser(ctx context.Context, id int64, until time.Time) error
+	UnlockUser(ctx context.Context, id int64) error
+	SetUserState(ctx context.Context, id int64, state, reason string, expiresAt *time.Time) error
+	// ExpireUserStates resets lapsed account states to active and returns
+	// the previous states by user id
+	ExpireUserStates(ctx context.Context) (map[int64]string, error)
+	// CloseUser returns sql.ErrNoRows if there is no open account with the id
+	CloseUser(ctx context.Context, id, closedBy int64, reason string) error
+}
+
+type RefreshTokenRepository interface {
+	CreateRefreshToken(ctx context.Context, t *models.RefreshToken) error
+	GetRefreshTokenByHash(ctx context.Context, hash string) (*models.RefreshToken, error)
+	GetRefreshTokenByHashForUpdate(ctx context.Context, hash string) (*models.RefreshToken, error)
+	MarkRefreshTokenUsed(ctx context.Context, id int64, replacedBy int64) error
+	RevokeRefreshTokenFamily(ctx context.Context, familyID string) error
+	RevokeUserRefreshTokens(ctx context.Context, userID int64) error
+	RevokeClientRefreshTokens(ctx context.Context, clientID string) error
+}
+
+type RoleRepository interface {
+	ListRoles(ctx context.Context) ([]*models.Role, error)
+	// SaveRole creates or updates the role and replaces its permissions
+	SaveRole(ctx context.Context, role *models.Role) error
+}
+
+type OAuthRepository interface {
+	// CreateOAuthClient returns ErrDuplicate if the client id is already taken
+	CreateOAuthClient(ctx context.Context, c *models.OAuthClient) error
+	GetOAuthClient(ctx context.Context, clientID string) (*models.OAuthClient, error)
+	ListOAuthClients(ctx context.Context) ([]*models.OAuthClient, error)
+	// RevokeOAuthClient returns sql.ErrNoRows if there is no active client with the id
+	RevokeOAuthClient(ctx context.Context, id int64) (*models.OAuthClient, error)
+	CreateAuthorizationCode(ctx context.Context, c *models.AuthorizationCode) error
+	GetAuthorizationCodeForUpdate(ctx context.Context, hash string) (*models.AuthorizationCode, error)
+	// UseAuthorizationCode marks the code used and records the refresh token
+	// family issued for it
+	UseAuthorizationCode(ctx context.Context, id int64, familyID string) error
+}
+
+type APIKeyRepository interface {
+	CreateAPIKey(ctx context.Context, k *models.APIKey) error
+	GetAPIKeyByPrefix(ctx context.Context, prefix string) (*models.APIKey, error)
+	ListAPIKeys(ctx context.Context) ([]*models.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id int64) error
+	// TouchAPIKey records a use, writing at most once per minute per key
+	TouchAPIKey(ctx context.Context, id int64) error
+}
+
+type PasswordResetRepository interface {
+	CreatePasswordResetToken(ctx context.Context, t *models.PasswordResetToken) error
+	GetPasswordResetTokenByHashForUpdate(ctx context.Context, hash string) (*models.PasswordResetToken, error)
+	// UsePasswordResetTokens marks every outstanding token of the user as used
+	UsePasswordResetTokens(ctx context.Context, userID int64) error
+}
+
+type MFARepository interface {
+	GetUserMFA(ctx context.Context, userID int64) (*models.UserMFA, error)
+	// SaveUserMFASecret starts a new, not yet enabled, enrollment
+	SaveUserMFASecret(ctx context.Context, userID int64, secret []byte) error
+	EnableUserMFA(ctx context.Context, userID int64, step int64) error
+	// UseMFAStep records step as used. It returns sql.ErrNoRows if step is not
+	// newer than the last one used, so a code cannot be replayed.
+	UseMFAStep(ctx context.Context, userID int64, step int64) error
+	// DeleteUserMFA removes the enrollment and its recovery codes
+	DeleteUserMFA(ctx context.Context, userID int64) error
+	ReplaceRecoveryCodes(ctx context.Context, userID int64, hashes []string) error
+	// UseRecoveryCode returns sql.ErrNoRows if the code is unknown or already used
+	UseRecoveryCode(ctx context.Context, userID int64, hash string) error
+}
+
+type SigningKeyRepository interface {
+	// LockSigningKeys serialises key rotation across instances for the rest of the transaction
+	LockSigningKeys(ctx context.Context) error
+	// ListSigningKeys returns the keys that can still verify tokens, newest first
+	ListSigningKeys(ctx context.Context) ([]*models.SigningKey, error)
+	CreateSigningKey(ctx context.Context, k *models.SigningKey) error
+	// RetireSigningKeys stops every active key except keepID from signing
+	RetireSigningKeys(ctx context.Context, keepID int64, verifyUntil time.Time) error
 }
 
 type TransactionRepository interface {
 	CreateTransaction(ctx context.Context, tx *models.Transaction) error
 	GetTransactionByID(ctx context.Context, id int64) (*models.Transaction, error)
+	GetTransactionByIDForUpdate(ctx context.Context, id int64) (*models.Transaction, error)
 	GetTransactionsByUserID(ctx context.Context, userID int64) ([]*models.Transaction, error)
+	GetRecentTransactionsByUserID(ctx context.Context, userID int64, limit int) ([]*models.Transaction, error)
+	// HasUnsettledTransactions reports whether the user is party to a
+	// transaction that is still pending or awaiting confirmation, or has
+	// funds on hold
+	HasUnsettledTransactions(ctx context.Context, userID int64) (bool, error)
 	UpdateTransactionStatus(ctx context.Context, id int64, status string) error
+	// ExpireUnconfirmedTransactions expires transactions whose confirmation window has passed
+	ExpireUnconfirmedTransactions(ctx context.Context) (int64, error)
 }
 
+type AccountRepository interface {
+	CreateAccount(ctx context.Context, a *models.Account) error
+	GetAccountByID(ctx context.Context, id int64) (*models.Account, error)
+	GetDefaultAccount(ctx context.Context, userID int64) (*models.Account, error)
+	ListAccountsByUserID(ctx context.Context, userID int64) ([]*models.Account, error)
+	// RenameAccount returns sql.ErrNoRows if the user has no such account
+	RenameAccount(ctx context.Context, id, userID int64, name string) error
+	CloseUserAccounts(ctx context.Context, userID int64) error
+}
+
+type HoldRepository interface {
+	CreateHold(ctx context.Context, h *models.Hold) error
+	GetHoldByIDForUpdate(ctx context.Context, id int64) (*models.Hold, error)
+	// ListHoldsByUserID returns holds on the user's accounts or placed by
+	// the user, newest first
+	ListHoldsByUserID(ctx context.Context, userID int64) ([]*models.Hold, error)
+	// CaptureHold and VoidHold return sql.ErrNoRows if the hold is no longer active
+	CaptureHold(ctx context.Context, id, amount, transactionID int64) error
+	VoidHold(ctx context.Context, id int64) error
+	// ExpireHolds marks active holds past their expiry as expired and returns them
+	ExpireHolds(ctx context.Context) ([]*models.Hold, error)
+}
+
+type StandingOrderRepository interface {
+	CreateStandingOrder(ctx context.Context, o *models.StandingOrder) error
+	GetStandingOrderByIDForUpdate(ctx context.Context, id int64) (*models.StandingOrder, error)
+	ListStandingOrdersByUserID(ctx context.Context, userID int64) ([]*models.StandingOrder, error)
+	// UpdateStandingOrder saves the terms the user can change and the status
+	UpdateStandingOrder(ctx context.Context, o *models.StandingOrder) error
+	// ClaimDueStandingOrders leases up to limit active orders whose next
+	// attempt is due and that no other instance holds a lease on
+	ClaimDueStandingOrders(ctx context.Context, lease time.Duration, limit int) ([]*models.StandingOrder, error)
+	// SaveStandingOrderRun records the outcome of an attempt and releases the
+	// lease. An order cancelled or completed in the meantime keeps its status.
+	SaveStandingOrderRun(ctx context.Context, o *models.StandingOrder) error
+	CancelUserStandingOrders(ctx context.Context, userID int64) error
+}
+
+// BalanceRepository reads balances. Available amounts exclude active holds.
 type BalanceRepository interface {
-	GetBalanceByUserID(ctx context.Context, userID int64) (*models.Balance, error)
-	UpdateBalance(ctx context.Context, balance *models.Balance) error
-	CreateBalance(ctx context.Context, balance *models.Balance) error
+	GetBalanceByAccountID(ctx context.Context, accountID int64) (*models.Balance, error)
+	GetBalancesForUpdate(ctx context.Context, accountIDs []int64) (map[int64]*models.Balance, error)
+}
+
+// LedgerRepository stores journal entries. Balances are only ever changed as a
+// side effect of CreateJournalEntry.
+type LedgerRepository interface {
+	CreateJournalEntry(ctx context.Context, entry *models.JournalEntry) error
+	GetJournalEntriesByTransactionID(ctx context.Context, txID int64) ([]*models.JournalEntry, error)
+	GetPostingsByUserID(ctx context.Context, userID int64) ([]*models.Posting, error)
+	// GetLedgerTotals sums debits and credits per currency
+	GetLedgerTotals(ctx context.Context) ([]*models.LedgerTotal, error)
+	ListBalanceMismatches(ctx context.Context) ([]*models.BalanceMismatch, error)
+}
+
+type FXRateRepository interface {
+	ListFXRates(ctx context.Context) ([]*models.FXRate, error)
+	GetFXRate(ctx context.Context, base, quote string) (*models.FXRate, error)
+	// SaveFXRate creates or replaces the rate for the currency pair
+	SaveFXRate(ctx context.Context, f *models.FXRate) error
+	DeleteFXRate(ctx context.Context, id int64) error
+}
+
+type IdempotencyRepository interface {
+	// GetIdempotencyKey returns sql.ErrNoRows if the key is unknown or expired
+	GetIdempotencyKey(ctx context.Context, userID int64, key string) (*models.IdempotencyKey, error)
+	// CreateIdempotencyKey returns ErrDuplicate if the key is already in use
+	CreateIdempotencyKey(ctx context.Context, k *models.IdempotencyKey) error
+	DeleteExpiredIdempotencyKeys(ctx context.Context) error
+}
+
+// JobRepository is the durable queue behind worker.Pool. Jobs are claimed
+// with FOR UPDATE SKIP LOCKED so that several API instances can share it.
+type JobRepository interface {
+	EnqueueJob(ctx context.Context, transactionID int64) error
+	// ClaimJob leases the oldest runnable job to owner. It returns nil if no job is available.
+	ClaimJob(ctx context.Context, owner string, lease time.Duration) (*models.Job, error)
+	HeartbeatJob(ctx context.Context, id int64, owner string, lease time.Duration) error
+	CompleteJob(ctx context.Context, id int64, owner string) error
+	FailJob(ctx context.Context, id int64, owner string, reason string) error
+	RetryJob(ctx context.Context, id int64, owner string, delay time.Duration, reason string) error
+	DeadLetterJob(ctx context.Context, id int64, owner string, reason string) error
+
+	ListDeadJobs(ctx context.Context) ([]*models.Job, error)
+	GetDeadJobForUpdate(ctx context.Context, id int64) (*models.Job, error)
+	RequeueDeadJob(ctx context.Context, id int64) error
+	DiscardDeadJob(ctx context.Context, id int64) error
 }
 
 type AuditRepository interface {
@@ -34,7 +226,24 @@ type AuditRepository interface {
 
 type Repository interface {
 	UserRepository
+	RefreshTokenRepository
+	RoleRepository
+	OAuthRepository
+	APIKeyRepository
+	PasswordResetRepository
+	MFARepository
+	SigningKeyRepository
 	TransactionRepository
+	AccountRepository
+	HoldRepository
+	StandingOrderRepository
 	BalanceRepository
+	LedgerRepository
+	FXRateRepository
+	IdempotencyRepository
+	JobRepository
 	AuditRepository
+
+	// WithTx runs fn inside a single database transaction
+	WithTx(ctx context.Context, fn func(repo Repository) error) error
 }
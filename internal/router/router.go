@@ -20,8 +20,10 @@ func (r *Router) Use(mw ...middleware.Middleware) {
 	r.middlewares = append(r.middlewares, mw...)
 }
 
+// HandleFunc registers handler behind mw and the global middlewares. Routes
+// only accept API keys and OAuth tokens if mw includes a RequireScope.
 func (r *Router) HandleFunc(pattern string, handler http.HandlerFunc, mw ...middleware.Middleware) {
-	finalHandler := http.Handler(handler)
+	finalHandler := middleware.RequireSession(handler)
 	
 	finalHandler = middleware.Chain(finalHandler, mw...)
 	finalHandler = middleware.Chain(finalHandler, r.middlewares...)
@@ -30,7 +32,7 @@ func (r *Router) HandleFunc(pattern string, handler http.HandlerFunc, mw ...midd
 }
 
 func (r *Router) Handle(pattern string, handler http.Handler, mw ...middleware.Middleware) {
-	finalHandler := handler
+	finalHandler := middleware.RequireSession(handler)
 	finalHandler = middleware.Chain(finalHandler, mw...)
 	finalHandler = middleware.Chain(finalHandler, r.middlewares...)
 	r.mux.Handle(pattern, finalHandler)
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"backend/internal/models"
+	"backend/internal/repository"
+)
+
+var ErrInvalidAccount = errors.New("invalid account")
+
+const maxAccountNameLength = 100
+
+// AccountService manages the accounts users hold their money in.
+type AccountService struct {
+	repo repository.Repository
+}
+
+func NewAccountService(repo repository.Repository) *AccountService {
+	return &AccountService{repo: repo}
+}
+
+// List returns the user's accounts with their balances, default account first.
+func (s *AccountService) List(ctx context.Context, userID int64) ([]*models.Account, error) {
+	return s.repo.ListAccountsByUserID(ctx, userID)
+}
+
+// Get returns one of the user's accounts. Accounts of other users are
+// reported as sql.ErrNoRows. An accountID of 0 means the default account.
+func (s *AccountService) Get(ctx context.Context, userID, accountID int64) (*models.Account, error) {
+	if accountID == 0 {
+		return s.repo.GetDefaultAccount(ctx, userID)
+	}
+	return ownAccount(ctx, s.repo, userID, accountID)
+}
+
+// Open creates another account for the user, held in currency or, if that
+// is empty, in the default currency.
+func (s *AccountService) Open(ctx context.Context, userID int64, accountType, name, currency string) (*models.Account, error) {
+	if !slices.Contains(models.AccountTypes, accountType) {
+		return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidAccount, accountType)
+	}
+	currency = normalizeCurrency(currency)
+	if currency == "" {
+		currency = models.DefaultCurrency
+	}
+	if _, ok := models.Currencies[currency]; !ok {
+		return nil, fmt.Errorf("%w: %w %q", ErrInvalidAccount, ErrUnsupportedCurrency, currency)
+	}
+	name, err := accountName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	account := &models.Account{
+		UserID:   userID,
+		Name:     name,
+		Type:     accountType,
+		Currency: currency,
+	}
+	err = s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		user, err := repo.GetUserByID(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if user.Closed() {
+			return ErrAccountClosed
+		}
+		if err := repo.CreateAccount(ctx, account); err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   userID,
+			ActorID:    &userID,
+			Action:     "account_opened",
+			Details:    fmt.Sprintf("account_id: %d, type: %s, currency: %s", account.ID, account.Type, account.Currency),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// Rename changes the name of one of the user's accounts.
+func (s *AccountService) Rename(ctx context.Context, userID, accountID int64, name string) (*models.Account, error) {
+	name, err := accountName(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.RenameAccount(ctx, accountID, userID, name); err != nil {
+		return nil, err
+	}
+	return s.repo.GetAccountByID(ctx, accountID)
+}
+
+func accountName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("%w: a name is required", ErrInvalidAccount)
+	}
+	if len(name) > maxAccountNameLength {
+		return "", fmt.Errorf("%w: names are at most %d characters", ErrInvalidAccount, maxAccountNameLength)
+	}
+	return name, nil
+}
+
+func ownAccount(ctx context.Context, repo repository.Repository, userID, accountID int64) (*models.Account, error) {
+	account, err := repo.GetAccountByID(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if account.UserID != userID {
+		return nil, sql.ErrNoRows
+	}
+	return account, nil
+}
+
+// lockAccounts locks the balances of all of the user's accounts, and of the
+// accounts in also, so that nothing is posted to them until the surrounding
+// database transaction ends. All are locked in one call so that the locks
+// are taken in the same order as everywhere else.
+func lockAccounts(ctx context.Context, repo repository.Repository, userID int64, also ...int64) ([]*models.Account, map[int64]*models.Balance, error) {
+	accounts, err := repo.ListAccountsByUserID(ctx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := make([]int64, len(accounts), len(accounts)+len(also))
+	for i, a := range accounts {
+		ids[i] = a.ID
+	}
+	ids = append(ids, also...)
+	balances, err := repo.GetBalancesForUpdate(ctx, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	return accounts, balances, nil
+}
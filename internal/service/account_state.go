@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"backend/internal/models"
+	"backend/internal/repository"
+)
+
+var (
+	ErrInvalidAccountState = errors.New("invalid account state")
+	ErrAccountFrozen       = errors.New("account is frozen")
+	ErrAccountSuspended    = errors.New("account is suspended")
+)
+
+// SetAccountState restricts a user's account, or lifts a restriction by
+// setting it back to active. A reason is always required. If expiresAt is
+// set, the state reverts to active at that time. Suspending an account signs
+// the user out everywhere.
+func (s *UserService) SetAccountState(ctx context.Context, actorID, userID int64, state, reason string, expiresAt *time.Time) (*models.User, error) {
+	reason = strings.TrimSpace(reason)
+	if !slices.Contains(models.AccountStates, state) {
+		return nil, fmt.Errorf("%w: unknown state %q", ErrInvalidAccountState, state)
+	}
+	if reason == "" {
+		return nil, fmt.Errorf("%w: a reason is required", ErrInvalidAccountState)
+	}
+	if expiresAt != nil {
+		if state == models.AccountStateActive {
+			return nil, fmt.Errorf("%w: only restrictions can expire", ErrInvalidAccountState)
+		}
+		if !expiresAt.After(time.Now()) {
+			return nil, fmt.Errorf("%w: expires_at must be in the future", ErrInvalidAccountState)
+		}
+	}
+	stored := reason
+	if state == models.AccountStateActive {
+		stored = ""
+	}
+
+	var user *models.User
+	err := s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		var err error
+		user, err = repo.GetUserByID(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if user.Closed() {
+			return ErrAccountClosed
+		}
+		// Waits for transactions already posting against the account, so
+		// none complete under the old state after this returns
+		if _, _, err := lockAccounts(ctx, repo, userID); err != nil {
+			return err
+		}
+		if err := repo.SetUserState(ctx, userID, state, stored, expiresAt); err != nil {
+			return err
+		}
+
+		details := fmt.Sprintf("state: %s -> %s, reason: %s", user.CurrentState(time.Now()), state, reason)
+		if expiresAt != nil {
+			details += ", expires_at: " + expiresAt.UTC().Format(time.RFC3339)
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   userID,
+			ActorID:    &actorID,
+			Action:     "account_state_changed",
+			Details:    details,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	user.State, user.StateReason, user.StateExpiresAt = state, stored, expiresAt
+
+	if state == models.AccountStateSuspended {
+		if err := s.RevokeAllSessions(ctx, userID); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+// ExpireAccountStates resets lapsed account states every interval until ctx
+// is cancelled. Restrictions stop applying as soon as they expire; this
+// records that in the audit log and clears them.
+func (s *UserService) ExpireAccountStates(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, err := s.expireAccountStates(ctx)
+			if err != nil {
+				slog.Error("Failed to expire account states", "error", err)
+			} else if n > 0 {
+				slog.Info("Expired account states", "count", n)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *UserService) expireAccountStates(ctx context.Context) (int, error) {
+	n := 0
+	err := s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		expired, err := repo.ExpireUserStates(ctx)
+		if err != nil {
+			return err
+		}
+		for userID, state := range expired {
+			err := repo.CreateAuditLog(ctx, &models.AuditLog{
+				EntityType: "user",
+				EntityID:   userID,
+				Action:     "account_state_expired",
+				Details:    fmt.Sprintf("state: %s -> %s", state, models.AccountStateActive),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
+
+// checkSignIn returns an error if the user may not sign in or keep using
+// credentials issued to them.
+func checkSignIn(user *models.User) error {
+	if user.Closed() {
+		return ErrAccountClosed
+	}
+	if user.CurrentState(time.Now()) == models.AccountStateSuspended {
+		return ErrAccountSuspended
+	}
+	return nil
+}
+
+// checkMovement returns an error if the user's account may not be debited
+// (delta < 0) or credited (delta > 0).
+func checkMovement(user *models.User, delta int64) error {
+	if user.Closed() {
+		return fmt.Errorf("%w: user %d", ErrAccountClosed, user.ID)
+	}
+	switch user.CurrentState(time.Now()) {
+	case models.AccountStateDebitFrozen:
+		if delta < 0 {
+			return fmt.Errorf("%w: user %d cannot send money", ErrAccountFrozen, user.ID)
+		}
+	case models.AccountStateFrozen:
+		if delta != 0 {
+			return fmt.Errorf("%w: user %d", ErrAccountFrozen, user.ID)
+		}
+	case models.AccountStateSuspended:
+		if delta != 0 {
+			return fmt.Errorf("%w: user %d", ErrAccountSuspended, user.ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"backend/internal/models"
+	"backend/internal/repository"
+)
+
+var (
+	ErrInvalidUser = errors.New("invalid user")
+	ErrUserExists  = errors.New("username or email is already taken")
+	ErrUnknownRole = errors.New("unknown role")
+	ErrPrivileged  = errors.New("user has permissions you do not have")
+)
+
+// GetUser returns a user for the back office and records who looked them up.
+func (s *UserService) GetUser(ctx context.Context, actorID, id int64) (*models.User, error) {
+	user, err := s.repo.GetUserByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	err = s.repo.CreateAuditLog(ctx, &models.AuditLog{
+		EntityType: "user",
+		EntityID:   id,
+		ActorID:    &actorID,
+		Action:     "user_viewed",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// UpdateUser saves changes to a user's username, email and role made by
+// actorID, recording them in the audit log. A new email address has to be
+// verified again, and a role change signs the user out everywhere so tokens
+// carrying the old role stop working. Staff can only edit users, and assign
+// roles, whose permissions they have themselves.
+func (s *UserService) UpdateUser(ctx context.Context, actorID int64, user *models.User) error {
+	existing, err := s.repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if err := s.checkOutranks(ctx, actorID, existing.Role); err != nil {
+		return err
+	}
+	user.Email = normalizeEmail(user.Email)
+	if err := user.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidUser, err)
+	}
+
+	var changes []string
+	if user.Username != existing.Username {
+		changes = append(changes, fmt.Sprintf("username: %s -> %s", existing.Username, user.Username))
+	}
+	if user.Email != existing.Email {
+		changes = append(changes, fmt.Sprintf("email: %s -> %s", existing.Email, user.Email))
+	}
+	if user.Role != existing.Role {
+		ok, err := s.perms.RoleExists(ctx, user.Role)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownRole, user.Role)
+		}
+		if err := s.checkOutranks(ctx, actorID, user.Role); err != nil {
+			return err
+		}
+		changes = append(changes, fmt.Sprintf("role: %s -> %s", existing.Role, user.Role))
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	err = s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		if err := repo.UpdateUser(ctx, user); err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   user.ID,
+			ActorID:    &actorID,
+			Action:     "user_updated",
+			Details:    strings.Join(changes, ", "),
+		})
+	})
+	if errors.Is(err, repository.ErrDuplicate) {
+		return ErrUserExists
+	}
+	if err != nil {
+		return err
+	}
+
+	if user.Email != existing.Email {
+		user.Verified = false
+		if err := s.SendVerification(ctx, user.ID); err != nil {
+			slog.Error("Failed to send verification email", "user_id", user.ID, "error", err)
+		}
+	}
+	if user.Role != existing.Role {
+		return s.RevokeAllSessions(ctx, user.ID)
+	}
+	return nil
+}
+
+// UpdateProfile changes a user's username and email. Empty values are left
+// unchanged.
+func (s *UserService) UpdateProfile(ctx context.Context, actorID, id int64, username, email string) (*models.User, error) {
+	user, err := s.repo.GetUserByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if username != "" {
+		user.Username = username
+	}
+	if email != "" {
+		user.Email = email
+	}
+	if err := s.UpdateUser(ctx, actorID, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// ChangeRole assigns a different role to a user.
+func (s *UserService) ChangeRole(ctx context.Context, actorID, id int64, role string) (*models.User, error) {
+	user, err := s.repo.GetUserByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	user.Role = role
+	if err := s.UpdateUser(ctx, actorID, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// ResetMFA removes a user's two-factor enrollment, for users who lost both
+// their authenticator and their recovery codes. Like UpdateUser, it refuses
+// users with permissions the actor lacks.
+func (s *UserService) ResetMFA(ctx context.Context, actorID, userID int64) error {
+	user, err := s.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := s.checkOutranks(ctx, actorID, user.Role); err != nil {
+		return err
+	}
+	return s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		if _, err := repo.GetUserMFA(ctx, userID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrMFANotEnrolled
+			}
+			return err
+		}
+		if err := repo.DeleteUserMFA(ctx, userID); err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   userID,
+			ActorID:    &actorID,
+			Action:     "mfa_reset",
+		})
+	})
+}
+
+// checkOutranks returns ErrPrivileged unless actorID's role grants every
+// permission role does, so that staff cannot take over accounts that could
+// do more than they can.
+func (s *UserService) checkOutranks(ctx context.Context, actorID int64, role string) error {
+	actor, err := s.repo.GetUserByID(ctx, actorID)
+	if err != nil {
+		return err
+	}
+	ok, err := s.perms.Covers(ctx, actor.Role, role)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrPrivileged, role)
+	}
+	return nil
+}
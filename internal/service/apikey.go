@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"backend/internal/models"
+	"backend/internal/repository"
+)
+
+var (
+	ErrInvalidAPIKey = errors.New("invalid API key")
+	ErrInvalidScope  = errors.New("invalid scope")
+)
+
+// apiKeyPrefix marks our keys so they are easy to spot, e.g. by secret scanners.
+const apiKeyPrefix = "bk_"
+
+type APIKeyService struct {
+	repo repository.Repository
+}
+
+func NewAPIKeyService(repo repository.Repository) *APIKeyService {
+	return &APIKeyService{repo: repo}
+}
+
+// Create issues a key that acts as userID with the given scopes. The returned
+// secret is not stored and cannot be shown again. It returns sql.ErrNoRows if
+// the user does not exist.
+func (s *APIKeyService) Create(ctx context.Context, actorID int64, name string, userID int64, scopes []string, expiresAt *time.Time) (*models.APIKey, string, error) {
+	if err := validateScopes(scopes); err != nil {
+		return nil, "", err
+	}
+
+	id, err := randomToken(6)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	prefix := apiKeyPrefix + id
+	raw := prefix + "." + secret
+
+	key := &models.APIKey{
+		Name:      name,
+		Prefix:    prefix,
+		KeyHash:   hashToken(raw),
+		UserID:    userID,
+		Scopes:    scopes,
+		CreatedBy: &actorID,
+		ExpiresAt: expiresAt,
+	}
+	err = s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		if _, err := repo.GetUserByID(ctx, userID); err != nil {
+			return err
+		}
+		if err := repo.CreateAPIKey(ctx, key); err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "api_key",
+			EntityID:   key.ID,
+			ActorID:    &actorID,
+			Action:     "api_key_created",
+			Details:    fmt.Sprintf("user: %d, prefix: %s, scopes: %s", userID, prefix, strings.Join(scopes, " ")),
+		})
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return key, raw, nil
+}
+
+func (s *APIKeyService) List(ctx context.Context) ([]*models.APIKey, error) {
+	return s.repo.ListAPIKeys(ctx)
+}
+
+func (s *APIKeyService) Revoke(ctx context.Context, actorID, id int64) error {
+	return s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		if err := repo.RevokeAPIKey(ctx, id); err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "api_key",
+			EntityID:   id,
+			ActorID:    &actorID,
+			Action:     "api_key_revoked",
+		})
+	})
+}
+
+// Authenticate resolves a raw key to the key record and the user it acts as.
+func (s *APIKeyService) Authenticate(ctx context.Context, raw string) (*models.APIKey, *models.User, error) {
+	prefix, _, ok := strings.Cut(raw, ".")
+	if !ok || !strings.HasPrefix(prefix, apiKeyPrefix) {
+		return nil, nil, ErrInvalidAPIKey
+	}
+	key, err := s.repo.GetAPIKeyByPrefix(ctx, prefix)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(key.KeyHash), []byte(hashToken(raw))) != 1 {
+		return nil, nil, ErrInvalidAPIKey
+	}
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt)) {
+		return nil, nil, ErrInvalidAPIKey
+	}
+
+	user, err := s.repo.GetUserByID(ctx, key.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if checkSignIn(user) != nil {
+		return nil, nil, ErrInvalidAPIKey
+	}
+
+	if err := s.repo.TouchAPIKey(ctx, key.ID); err != nil {
+		slog.Warn("Failed to record API key use", "api_key", key.ID, "error", err)
+	}
+	return key, user, nil
+}
+
+// validateScopes checks that scopes is a non-empty list of known scopes.
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("%w: at least one scope is required", ErrInvalidScope)
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(models.Scopes, scope) {
+			return fmt.Errorf("%w: %s", ErrInvalidScope, scope)
+		}
+	}
+	return nil
+}
@@ -6,7 +6,6 @@ import (
 	"errors"
 	"encoding/json"
 	"fmt"
-	"sync"
 	"time"
 
 	"backend/internal/cache"
@@ -14,9 +13,13 @@ import (
 	"backend/internal/repository"
 )
 
+var (
+	ErrInsufficientFunds  = errors.New("insufficient funds")
+	ErrInvalidTransaction = errors.New("invalid transaction")
+)
+
 type BalanceService struct {
 	repo  repository.Repository
-	locks sync.Map
 	redis *cache.RedisClient
 }
 
@@ -27,18 +30,9 @@ func NewBalanceService(repo repository.Repository, redisClient *cache.RedisClien
 	}
 }
 
-func (s *BalanceService) getLock(userID int64) *sync.RWMutex {
-	lock, _ := s.locks.LoadOrStore(userID, &sync.RWMutex{})
-	return lock.(*sync.RWMutex)
-}
-
-func (s *BalanceService) GetBalance(ctx context.Context, userID int64) (*models.Balance, error) {
-	mu := s.getLock(userID)
-	mu.RLock()
-	defer mu.RUnlock()
-
+func (s *BalanceService) GetBalance(ctx context.Context, accountID int64) (*models.Balance, error) {
 	// Try cache
-	key := fmt.Sprintf("balance:%d", userID)
+	key := balanceCacheKey(accountID)
 	val, err := s.redis.Client.Get(ctx, key).Result()
 	if err == nil {
 		var bal models.Balance
@@ -47,10 +41,10 @@ func (s *BalanceService) GetBalance(ctx context.Context, userID int64) (*models.
 		}
 	}
 
-	bal, err := s.repo.GetBalanceByUserID(ctx, userID)
+	bal, err := s.repo.GetBalanceByAccountID(ctx, accountID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return &models.Balance{UserID: userID, Amount: 0}, nil
+			return &models.Balance{AccountID: accountID}, nil
 		}
 		return nil, err
 	}
@@ -64,77 +58,311 @@ func (s *BalanceService) GetBalance(ctx context.Context, userID int64) (*models.
 }
 
 func (s *BalanceService) GetHistory(ctx context.Context, userID int64) ([]*models.AuditLog, error) {
-    return s.repo.GetAuditLogsByEntity(ctx, "user", userID)
+	return s.repo.GetAuditLogsByEntity(ctx, "user", userID)
+}
+
+func (s *BalanceService) GetLedger(ctx context.Context, userID int64) ([]*models.Posting, error) {
+	return s.repo.GetPostingsByUserID(ctx, userID)
 }
 
-func (s *BalanceService) UpdateBalance(ctx context.Context, userID int64, amountDelta int64) error {
-	mu := s.getLock(userID)
-	mu.Lock()
-	defer mu.Unlock()
+// UpdateBalance moves money between an account and the external account.
+func (s *BalanceService) UpdateBalance(ctx context.Context, accountID int64, amountDelta int64) error {
+	if amountDelta == 0 {
+		return errors.New("invalid amount")
+	}
+	account, err := s.repo.GetAccountByID(ctx, accountID)
+	if err != nil {
+		return err
+	}
+
+	entry := externalEntry(account.UserID, accountID, amountDelta, account.Currency, models.PostingCredit, "balance adjustment")
+	if amountDelta < 0 {
+		entry = externalEntry(account.UserID, accountID, -amountDelta, account.Currency, models.PostingDebit, "balance adjustment")
+	}
 
-	balance, err := s.repo.GetBalanceByUserID(ctx, userID)
+	err = s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		return s.post(ctx, repo, entry)
+	})
 	if err != nil {
-		balance = &models.Balance{UserID: userID, Amount: amountDelta}
-		if err := s.repo.CreateBalance(ctx, balance); err != nil {
-            return err
-        }
-	} else {
-	    balance.Amount += amountDelta
-	    if err := s.repo.UpdateBalance(ctx, balance); err != nil {
-            return err
-        }
-    }
-    
-	// Invalidate cache
-	s.redis.Client.Del(ctx, fmt.Sprintf("balance:%d", userID))
-
-    // Audit Log
-    _ = s.repo.CreateAuditLog(ctx, &models.AuditLog{
-        EntityType: "user",
-        EntityID:   userID,
-        Action:     "balance_update",
-        Details:    fmt.Sprintf("amount_delta: %d", amountDelta),
-    })
-    
+		return err
+	}
+	s.invalidate(ctx, entry)
 	return nil
 }
 
+// Adjust corrects the balance of an account against the external account,
+// e.g. after reconciling with a payment network, recording who made the
+// correction and why.
+func (s *BalanceService) Adjust(ctx context.Context, actorID, accountID, amountDelta int64, reason string) (*models.JournalEntry, error) {
+	if amountDelta == 0 {
+		return nil, fmt.Errorf("%w: amount must not be zero", ErrInvalidTransaction)
+	}
+	if reason == "" {
+		return nil, fmt.Errorf("%w: a reason is required", ErrInvalidTransaction)
+	}
+	account, err := s.repo.GetAccountByID(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	description := "adjustment: " + reason
+	entry := externalEntry(account.UserID, accountID, amountDelta, account.Currency, models.PostingCredit, description)
+	if amountDelta < 0 {
+		entry = externalEntry(account.UserID, accountID, -amountDelta, account.Currency, models.PostingDebit, description)
+	}
+
+	err = s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		if err := s.post(ctx, repo, entry); err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   account.UserID,
+			ActorID:    &actorID,
+			Action:     "ledger_adjusted",
+			Details:    fmt.Sprintf("account_id: %d, amount_delta: %d, journal_entry: %d, reason: %s", accountID, amountDelta, entry.ID, reason),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.invalidate(ctx, entry)
+	return entry, nil
+}
 
-func (s *BalanceService) Credit(ctx context.Context, userID int64, amount int64) error {
+func (s *BalanceService) Credit(ctx context.Context, accountID int64, amount int64) error {
 	if amount <= 0 {
 		return errors.New("invalid amount")
 	}
-	return s.UpdateBalance(ctx, userID, amount)
+	return s.UpdateBalance(ctx, accountID, amount)
 }
 
-func (s *BalanceService) Debit(ctx context.Context, userID int64, amount int64) error {
+func (s *BalanceService) Debit(ctx context.Context, accountID int64, amount int64) error {
 	if amount <= 0 {
 		return errors.New("invalid amount")
 	}
+	return s.UpdateBalance(ctx, accountID, -amount)
+}
 
-	mu := s.getLock(userID)
-	mu.Lock()
-	defer mu.Unlock()
+// applyTransaction posts the journal entry for tx using repo, which must be
+// bound to a database transaction. The caller invalidates cached balances
+// after commit.
+func (s *BalanceService) applyTransaction(ctx context.Context, repo repository.Repository, tx *models.Transaction) (*models.JournalEntry, error) {
+	entry, err := journalEntryFor(tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.post(ctx, repo, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
 
-	balance, err := s.repo.GetBalanceByUserID(ctx, userID)
+// VerifyLedger checks that total debits equal total credits in every
+// currency and that every projected balance matches the postings behind it.
+func (s *BalanceService) VerifyLedger(ctx context.Context) (*models.LedgerReport, error) {
+	totals, err := s.repo.GetLedgerTotals(ctx)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return errors.New("insufficient funds")
+		return nil, err
+	}
+	mismatches, err := s.repo.ListBalanceMismatches(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if totals == nil {
+		totals = []*models.LedgerTotal{}
+	}
+	if mismatches == nil {
+		mismatches = []*models.BalanceMismatch{}
+	}
+	balanced := len(mismatches) == 0
+	for _, t := range totals {
+		if t.TotalDebits != t.TotalCredits {
+			balanced = false
 		}
-		return err
+	}
+	return &models.LedgerReport{
+		Totals:     totals,
+		Balanced:   balanced,
+		Mismatches: mismatches,
+	}, nil
+}
+
+// post locks every account balance touched by entry, rejects it if a debit
+// exceeds the available balance or an account may not move money in that
+// direction (see checkMovement), and records it. repo must be bound to a database transaction.
+func (s *BalanceService) post(ctx context.Context, repo repository.Repository, entry *models.JournalEntry) error {
+	if err := entry.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTransaction, err)
+	}
+
+	deltas := make(map[int64]int64)
+	owners := make(map[int64]int64)      // account -> user
+	currencies := make(map[int64]string) // account -> posting currency
+	var accountIDs []int64
+	for _, p := range entry.Postings {
+		if p.AccountID == nil {
+			continue
+		}
+		if _, ok := deltas[*p.AccountID]; !ok {
+			accountIDs = append(accountIDs, *p.AccountID)
+		}
+		deltas[*p.AccountID] += p.BalanceDelta()
+		owners[*p.AccountID] = *p.UserID
+		if c, ok := currencies[*p.AccountID]; ok && c != p.Currency {
+			return fmt.Errorf("%w: account %d posted in two currencies", ErrInvalidTransaction, *p.AccountID)
+		}
+		currencies[*p.AccountID] = p.Currency
 	}
 
-    if balance.Amount < amount {
-        return errors.New("insufficient funds")
-    }
+	balances, err := repo.GetBalancesForUpdate(ctx, accountIDs)
+	if err != nil {
+		return err
+	}
+	// Checked under the balance locks, which closing an account or changing
+	// its state also takes
+	for accountID, delta := range deltas {
+		if err := checkAccount(ctx, repo, accountID, owners[accountID], currencies[accountID], delta); err != nil {
+			return err
+		}
+	}
+	// Funds reserved by holds cannot be spent, so debits are limited by the
+	// available balance
+	for accountID, delta := range deltas {
+		if delta < 0 && balances[accountID].Available+delta < 0 {
+			return ErrInsufficientFunds
+		}
+	}
 
-	balance.Amount -= amount
-	if err := s.repo.UpdateBalance(ctx, balance); err != nil {
+	if err := repo.CreateJournalEntry(ctx, entry); err != nil {
 		return err
 	}
-	
-	// Invalidate cache
-	s.redis.Client.Del(ctx, fmt.Sprintf("balance:%d", userID))
-	
+
+	for _, p := range entry.Postings {
+		if p.UserID == nil {
+			continue
+		}
+		// Audit Log
+		if err := repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   *p.UserID,
+			Action:     "balance_update",
+			Details:    fmt.Sprintf("account_id: %d, amount_delta: %d, journal_entry: %d", *p.AccountID, p.BalanceDelta(), entry.ID),
+		}); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// invalidate drops cached balances for every account touched by entry.
+func (s *BalanceService) invalidate(ctx context.Context, entry *models.JournalEntry) {
+	for _, p := range entry.Postings {
+		if p.AccountID != nil {
+			s.invalidateAccount(ctx, *p.AccountID)
+		}
+	}
+}
+
+func (s *BalanceService) invalidateAccount(ctx context.Context, accountID int64) {
+	s.redis.Client.Del(ctx, balanceCacheKey(accountID))
+}
+
+func balanceCacheKey(accountID int64) string {
+	return fmt.Sprintf("account_balance:%d", accountID)
+}
+
+// checkAccount returns an error if accountID is not an open account of
+// userID held in currency, or the user may not move money that way.
+func checkAccount(ctx context.Context, repo repository.Repository, accountID, userID int64, currency string, delta int64) error {
+	account, err := repo.GetAccountByID(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	if account.UserID != userID {
+		return fmt.Errorf("%w: account %d does not belong to user %d", ErrInvalidTransaction, accountID, userID)
+	}
+	if account.Status == models.AccountStatusClosed {
+		return fmt.Errorf("%w: account %d", ErrAccountClosed, accountID)
+	}
+	if account.Currency != currency {
+		return fmt.Errorf("%w: account %d is held in %s, not %s", ErrInvalidTransaction, accountID, account.Currency, currency)
+	}
+	user, err := repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	return checkMovement(user, delta)
+}
+
+// externalEntry builds an entry between a user's account and the external
+// account. direction is the side of the posting on the user's account.
+func externalEntry(userID, accountID, amount int64, currency, direction, description string) *models.JournalEntry {
+	counter := models.PostingDebit
+	if direction == models.PostingDebit {
+		counter = models.PostingCredit
+	}
+	return &models.JournalEntry{
+		Description: description,
+		Postings: []*models.Posting{
+			{AccountType: models.LedgerAccountUser, UserID: &userID, AccountID: &accountID, Direction: direction, Amount: amount, Currency: currency},
+			{AccountType: models.LedgerAccountExternal, Direction: counter, Amount: amount, Currency: currency},
+		},
+	}
+}
+
+func journalEntryFor(tx *models.Transaction) (*models.JournalEntry, error) {
+	if tx.Amount <= 0 {
+		return nil, fmt.Errorf("%w: invalid amount", ErrInvalidTransaction)
+	}
+
+	var entry *models.JournalEntry
+	switch tx.Type {
+	case models.TxTypeDeposit:
+		if tx.ToUserID == nil || tx.ToAccountID == nil {
+			return nil, fmt.Errorf("%w: missing to_account", ErrInvalidTransaction)
+		}
+		entry = externalEntry(*tx.ToUserID, *tx.ToAccountID, tx.Amount, tx.Currency, models.PostingCredit, "deposit")
+
+	case models.TxTypeWithdraw:
+		if tx.FromUserID == nil || tx.FromAccountID == nil {
+			return nil, fmt.Errorf("%w: missing from_account", ErrInvalidTransaction)
+		}
+		entry = externalEntry(*tx.FromUserID, *tx.FromAccountID, tx.Amount, tx.Currency, models.PostingDebit, "withdraw")
+
+	case models.TxTypeTransfer:
+		if tx.FromUserID == nil || tx.ToUserID == nil || tx.FromAccountID == nil || tx.ToAccountID == nil {
+			return nil, fmt.Errorf("%w: invalid transfer accounts", ErrInvalidTransaction)
+		}
+		if *tx.FromAccountID == *tx.ToAccountID {
+			return nil, fmt.Errorf("%w: cannot transfer to the same account", ErrInvalidTransaction)
+		}
+		entry = transferEntry(tx)
+
+	default:
+		return nil, fmt.Errorf("%w: unknown transaction type", ErrInvalidTransaction)
+	}
+
+	entry.TransactionID = &tx.ID
+	return entry, nil
+}
+
+// transferEntry moves tx.Amount out of the source account and tx.ToAmount
+// into the destination. When the currencies differ, the FX account takes the
+// other side of each leg so that every currency balances.
+func transferEntry(tx *models.Transaction) *models.JournalEntry {
+	from := &models.Posting{AccountType: models.LedgerAccountUser, UserID: tx.FromUserID, AccountID: tx.FromAccountID, Direction: models.PostingDebit, Amount: tx.Amount, Currency: tx.Currency}
+	to := &models.Posting{AccountType: models.LedgerAccountUser, UserID: tx.ToUserID, AccountID: tx.ToAccountID, Direction: models.PostingCredit, Amount: tx.ToAmount, Currency: tx.ToCurrency}
+	if tx.Currency == tx.ToCurrency {
+		return &models.JournalEntry{Description: "transfer", Postings: []*models.Posting{from, to}}
+	}
+	return &models.JournalEntry{
+		Description: fmt.Sprintf("transfer %s/%s at %s", tx.Currency, tx.ToCurrency, *tx.FXRate),
+		Postings: []*models.Posting{
+			from,
+			{AccountType: models.LedgerAccountFX, Direction: models.PostingCredit, Amount: tx.Amount, Currency: tx.Currency},
+			{AccountType: models.LedgerAccountFX, Direction: models.PostingDebit, Amount: tx.ToAmount, Currency: tx.ToCurrency},
+			to,
+		},
+	}
+}
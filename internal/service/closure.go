@@ -0,0 +1,156 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"backend/internal/models"
+	"backend/internal/repository"
+)
+
+var (
+	ErrAccountClosed          = errors.New("account is closed")
+	ErrInvalidClosure         = errors.New("invalid account closure")
+	ErrBalanceNotZero         = errors.New("account still holds funds, a payout destination is required")
+	ErrTransactionsInProgress = errors.New("account has transactions in progress")
+)
+
+// CloseAccount closes a user and all of their accounts on behalf of actorID.
+// If any account holds funds, payoutTo must be given; the balances are then
+// transferred to that user's default account as part of the closure,
+// converted at the current rate if it is held in another currency. The
+// user and their ledger history are kept, but they can no longer sign in or
+// take part in transactions, and their standing orders are cancelled. The
+// returned transactions are the payouts.
+func (s *TransactionService) CloseAccount(ctx context.Context, actorID, userID int64, reason string, payoutTo *int64) ([]*models.Transaction, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return nil, fmt.Errorf("%w: a reason is required", ErrInvalidClosure)
+	}
+	if payoutTo != nil && *payoutTo == userID {
+		return nil, fmt.Errorf("%w: cannot pay out to the account being closed", ErrInvalidClosure)
+	}
+
+	payouts := []*models.Transaction{}
+	var entries []*models.JournalEntry
+	err := s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		user, err := repo.GetUserByID(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if user.Closed() {
+			return ErrAccountClosed
+		}
+		// The payout destination is locked together with the accounts being
+		// closed, in account id order like any other posting
+		var destination *int64
+		var lockAlso []int64
+		if payoutTo != nil {
+			if destination, err = payoutAccount(ctx, repo, *payoutTo); err != nil {
+				return err
+			}
+			lockAlso = append(lockAlso, *destination)
+		}
+		// Holding the balance locks keeps transactions from posting until
+		// the accounts are closed
+		accounts, balances, err := lockAccounts(ctx, repo, userID, lockAlso...)
+		if err != nil {
+			return err
+		}
+		unsettled, err := repo.HasUnsettledTransactions(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if unsettled {
+			return ErrTransactionsInProgress
+		}
+
+		details := "reason: " + reason
+		for _, account := range accounts {
+			amount := balances[account.ID].Ledger
+			if amount == 0 {
+				continue
+			}
+			if payoutTo == nil {
+				return ErrBalanceNotZero
+			}
+			payout := &models.Transaction{
+				FromUserID:    &userID,
+				ToUserID:      payoutTo,
+				FromAccountID: &account.ID,
+				ToAccountID:   destination,
+				Amount:        amount,
+				Type:          models.TxTypeTransfer,
+				Status:        models.TxStatusPending,
+				CreatedBy:     &actorID,
+			}
+			if err := s.price(ctx, repo, payout); err != nil {
+				return err
+			}
+			if err := repo.CreateTransaction(ctx, payout); err != nil {
+				return err
+			}
+			entry, err := s.balanceSvc.applyTransaction(ctx, repo, payout)
+			if err != nil {
+				return err
+			}
+			if err := repo.UpdateTransactionStatus(ctx, payout.ID, models.TxStatusCompleted); err != nil {
+				return err
+			}
+			payout.Status = models.TxStatusCompleted
+			payouts = append(payouts, payout)
+			entries = append(entries, entry)
+			details += fmt.Sprintf(", payout_transaction_id: %d", payout.ID)
+		}
+
+		if err := repo.CloseUserAccounts(ctx, userID); err != nil {
+			return err
+		}
+		if err := repo.CancelUserStandingOrders(ctx, userID); err != nil {
+			return err
+		}
+		if err := repo.CloseUser(ctx, userID, actorID, reason); err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   userID,
+			ActorID:    &actorID,
+			Action:     "account_closed",
+			Details:    details,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		s.balanceSvc.invalidate(ctx, entry)
+	}
+	if err := s.userSvc.RevokeAllSessions(ctx, userID); err != nil {
+		return nil, err
+	}
+	return payouts, nil
+}
+
+// payoutAccount returns the default account of the user receiving a payout.
+func payoutAccount(ctx context.Context, repo repository.Repository, userID int64) (*int64, error) {
+	user, err := repo.GetUserByID(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: unknown payout account", ErrInvalidClosure)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Closed() {
+		return nil, fmt.Errorf("%w: payout account is closed", ErrInvalidClosure)
+	}
+	account, err := repo.GetDefaultAccount(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &account.ID, nil
+}
@@ -0,0 +1,292 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"backend/internal/models"
+	"backend/internal/repository"
+)
+
+var (
+	ErrUnsupportedCurrency = errors.New("unsupported currency")
+	ErrInvalidFXRate       = errors.New("invalid exchange rate")
+	ErrFXRateUnavailable   = errors.New("no exchange rate available")
+	ErrFXRatesReadOnly     = errors.New("exchange rates are loaded from a file and cannot be changed")
+)
+
+// fxRateDecimals is the precision of rates the service derives itself, such
+// as the inverse of a configured rate.
+const fxRateDecimals = 10
+
+var decimalRate = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// RateProvider supplies exchange rates. Implementations for a market data
+// feed can be plugged in alongside the local ones below.
+type RateProvider interface {
+	// Rate returns the rate from base to quote, or sql.ErrNoRows if there is none
+	Rate(ctx context.Context, base, quote string) (*models.FXRate, error)
+	Rates(ctx context.Context) ([]*models.FXRate, error)
+}
+
+// NewRateProvider returns the rate provider named by kind: "table" or "file".
+func NewRateProvider(kind, path string, repo repository.Repository) (RateProvider, error) {
+	switch kind {
+	case "table", "":
+		return TableRates{repo: repo}, nil
+	case "file":
+		return LoadStaticRates(path)
+	default:
+		return nil, fmt.Errorf("unknown rate provider: %s", kind)
+	}
+}
+
+// TableRates reads rates from the fx_rates table, which staff maintain
+// through the API.
+type TableRates struct {
+	repo repository.Repository
+}
+
+func (t TableRates) Rate(ctx context.Context, base, quote string) (*models.FXRate, error) {
+	return t.repo.GetFXRate(ctx, base, quote)
+}
+
+func (t TableRates) Rates(ctx context.Context) ([]*models.FXRate, error) {
+	return t.repo.ListFXRates(ctx)
+}
+
+// StaticRates holds rates loaded once from a JSON file mapping "BASE/QUOTE"
+// pairs to decimal strings, e.g. {"EUR/USD": "1.0842"}.
+type StaticRates struct {
+	rates map[string]*models.FXRate
+}
+
+func LoadStaticRates(path string) (*StaticRates, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var pairs map[string]string
+	if err := json.NewDecoder(f).Decode(&pairs); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	s := &StaticRates{rates: make(map[string]*models.FXRate, len(pairs))}
+	for pair, rate := range pairs {
+		base, quote, ok := strings.Cut(pair, "/")
+		if !ok {
+			return nil, fmt.Errorf("%w: pair %q is not BASE/QUOTE", ErrInvalidFXRate, pair)
+		}
+		r, err := newFXRate(base, quote, rate)
+		if err != nil {
+			return nil, err
+		}
+		r.UpdatedAt = info.ModTime()
+		s.rates[r.Base+"/"+r.Quote] = r
+	}
+	return s, nil
+}
+
+func (s *StaticRates) Rate(ctx context.Context, base, quote string) (*models.FXRate, error) {
+	r, ok := s.rates[base+"/"+quote]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return r, nil
+}
+
+func (s *StaticRates) Rates(ctx context.Context) ([]*models.FXRate, error) {
+	rates := make([]*models.FXRate, 0, len(s.rates))
+	for _, r := range s.rates {
+		rates = append(rates, r)
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		if rates[i].Base != rates[j].Base {
+			return rates[i].Base < rates[j].Base
+		}
+		return rates[i].Quote < rates[j].Quote
+	})
+	return rates, nil
+}
+
+// FXService converts amounts between currencies using the configured rate
+// provider, and lets staff maintain rates when they are kept in the database.
+type FXService struct {
+	repo  repository.Repository
+	rates RateProvider
+}
+
+func NewFXService(repo repository.Repository, rates RateProvider) *FXService {
+	return &FXService{repo: repo, rates: rates}
+}
+
+func (s *FXService) Rates(ctx context.Context) ([]*models.FXRate, error) {
+	rates, err := s.rates.Rates(ctx)
+	if rates == nil {
+		rates = []*models.FXRate{}
+	}
+	return rates, err
+}
+
+// SetRate creates or replaces the rate from base to quote.
+func (s *FXService) SetRate(ctx context.Context, actorID int64, base, quote, rate string) (*models.FXRate, error) {
+	if _, ok := s.rates.(TableRates); !ok {
+		return nil, ErrFXRatesReadOnly
+	}
+	r, err := newFXRate(base, quote, rate)
+	if err != nil {
+		return nil, err
+	}
+	r.UpdatedBy = &actorID
+
+	err = s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		if err := repo.SaveFXRate(ctx, r); err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "fx_rate",
+			EntityID:   r.ID,
+			ActorID:    &actorID,
+			Action:     "fx_rate_set",
+			Details:    fmt.Sprintf("%s/%s: %s", r.Base, r.Quote, r.Rate),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// DeleteRate removes the rate from base to quote. It returns sql.ErrNoRows
+// if there is none.
+func (s *FXService) DeleteRate(ctx context.Context, actorID int64, base, quote string) error {
+	if _, ok := s.rates.(TableRates); !ok {
+		return ErrFXRatesReadOnly
+	}
+	base, quote = normalizeCurrency(base), normalizeCurrency(quote)
+	return s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		r, err := repo.GetFXRate(ctx, base, quote)
+		if err != nil {
+			return err
+		}
+		if err := repo.DeleteFXRate(ctx, r.ID); err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "fx_rate",
+			EntityID:   r.ID,
+			ActorID:    &actorID,
+			Action:     "fx_rate_deleted",
+			Details:    fmt.Sprintf("%s/%s: %s", r.Base, r.Quote, r.Rate),
+		})
+	})
+}
+
+// Convert returns amount, in minor units of from, in minor units of to,
+// rounded half up, together with the rate applied. The rate is nil if the
+// currencies are the same.
+func (s *FXService) Convert(ctx context.Context, amount int64, from, to string) (int64, *string, error) {
+	if from == to {
+		return amount, nil, nil
+	}
+	fromCur, ok := models.Currencies[from]
+	if !ok {
+		return 0, nil, fmt.Errorf("%w: %s", ErrUnsupportedCurrency, from)
+	}
+	toCur, ok := models.Currencies[to]
+	if !ok {
+		return 0, nil, fmt.Errorf("%w: %s", ErrUnsupportedCurrency, to)
+	}
+	rate, err := s.rate(ctx, from, to)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	r, ok := new(big.Rat).SetString(rate)
+	if !ok || r.Sign() <= 0 {
+		return 0, nil, fmt.Errorf("%w: %s/%s: %q", ErrInvalidFXRate, from, to, rate)
+	}
+	v := new(big.Rat).Mul(new(big.Rat).SetInt64(amount), r)
+	v.Mul(v, new(big.Rat).SetFrac(pow10(toCur.MinorUnits), pow10(fromCur.MinorUnits)))
+
+	q, m := new(big.Int).DivMod(v.Num(), v.Denom(), new(big.Int))
+	if m.Lsh(m, 1).Cmp(v.Denom()) >= 0 {
+		q.Add(q, big.NewInt(1))
+	}
+	if !q.IsInt64() {
+		return 0, nil, fmt.Errorf("%w: converted amount is too large", ErrInvalidTransaction)
+	}
+	if q.Sign() <= 0 {
+		return 0, nil, fmt.Errorf("%w: amount is too small to convert", ErrInvalidTransaction)
+	}
+	return q.Int64(), &rate, nil
+}
+
+// rate returns the rate from base to quote as a decimal string, deriving it
+// from the rate for the opposite direction if only that one is known.
+func (s *FXService) rate(ctx context.Context, base, quote string) (string, error) {
+	r, err := s.rates.Rate(ctx, base, quote)
+	if err == nil {
+		return r.Rate, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	r, err = s.rates.Rate(ctx, quote, base)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("%w: %s/%s", ErrFXRateUnavailable, base, quote)
+	}
+	if err != nil {
+		return "", err
+	}
+	inverse, ok := new(big.Rat).SetString(r.Rate)
+	if !ok || inverse.Sign() <= 0 {
+		return "", fmt.Errorf("%w: %s/%s: %q", ErrInvalidFXRate, quote, base, r.Rate)
+	}
+	rate := strings.TrimRight(strings.TrimRight(inverse.Inv(inverse).FloatString(fxRateDecimals), "0"), ".")
+	if rate == "0" {
+		return "", fmt.Errorf("%w: %s/%s", ErrFXRateUnavailable, base, quote)
+	}
+	return rate, nil
+}
+
+func newFXRate(base, quote, rate string) (*models.FXRate, error) {
+	base, quote, rate = normalizeCurrency(base), normalizeCurrency(quote), strings.TrimSpace(rate)
+	for _, code := range []string{base, quote} {
+		if _, ok := models.Currencies[code]; !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnsupportedCurrency, code)
+		}
+	}
+	if base == quote {
+		return nil, fmt.Errorf("%w: base and quote must differ", ErrInvalidFXRate)
+	}
+	if !decimalRate.MatchString(rate) {
+		return nil, fmt.Errorf("%w: %q is not a decimal number", ErrInvalidFXRate, rate)
+	}
+	if r, _ := new(big.Rat).SetString(rate); r.Sign() <= 0 {
+		return nil, fmt.Errorf("%w: rate must be positive", ErrInvalidFXRate)
+	}
+	return &models.FXRate{Base: base, Quote: quote, Rate: rate, UpdatedAt: time.Now()}, nil
+}
+
+func normalizeCurrency(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"backend/internal/models"
+)
+
+func TestFXServiceConvert(t *testing.T) {
+	svc := NewFXService(nil, &StaticRates{rates: map[string]*models.FXRate{
+		"EUR/USD": {Base: "EUR", Quote: "USD", Rate: "1.0842"},
+		"USD/JPY": {Base: "USD", Quote: "JPY", Rate: "149.5"},
+		"KWD/USD": {Base: "KWD", Quote: "USD", Rate: "3.25"},
+		"GBP/USD": {Base: "GBP", Quote: "USD", Rate: "1.25"},
+	}})
+
+	tests := []struct {
+		name     string
+		amount   int64
+		from, to string
+		want     int64
+		wantErr  error
+	}{
+		{"same currency", 1234, "USD", "USD", 1234, nil},
+		{"direct rate", 10000, "EUR", "USD", 10842, nil},
+		{"rounds half up", 50, "EUR", "USD", 54, nil},         // 54.21
+		{"rounds down below half", 10, "EUR", "USD", 11, nil}, // 10.842
+		{"exact half rounds up", 2, "GBP", "USD", 3, nil},     // 2.5
+		{"to zero minor units", 1000, "USD", "JPY", 1495, nil},
+		{"from zero minor units", 1495, "JPY", "USD", 1000, nil}, // inverse rate
+		{"from three minor units", 1234, "KWD", "USD", 401, nil}, // 401.05
+		{"inverse rate", 10842, "USD", "EUR", 10000, nil},
+		{"too small to convert", 1, "KWD", "USD", 0, ErrInvalidTransaction}, // 0.325
+		{"no rate", 100, "EUR", "GBP", 0, ErrFXRateUnavailable},
+		{"unsupported currency", 100, "XXX", "USD", 0, ErrUnsupportedCurrency},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := svc.Convert(context.Background(), tt.amount, tt.from, tt.to)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Convert() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Convert(%d %s -> %s) = %d, want %d", tt.amount, tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,337 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"backend/internal/models"
+	"backend/internal/repository"
+)
+
+var (
+	ErrInvalidHold   = errors.New("invalid hold")
+	ErrHoldNotActive = errors.New("hold is no longer active")
+	ErrHoldExpired   = errors.New("hold has expired")
+)
+
+const maxHoldDescriptionLength = 255
+
+// HoldRequest describes funds to reserve. The destination is optional; a
+// hold without one is captured as a withdrawal. Holds from the step-up
+// threshold up need the actor's password or MFA code, as their capture
+// is posted without asking again.
+type HoldRequest struct {
+	Amount        int64
+	FromUserID    *int64
+	FromAccountID *int64
+	ToUserID      *int64
+	ToAccountID   *int64
+	Description   string
+	ExpiresAt     *time.Time // Defaults to HoldTTL from now
+	Password      string
+	Code          string
+}
+
+// AuthorizeHold reserves funds in the source account, which the actor must be
+// allowed to debit as for a withdrawal or transfer. The funds stop counting
+// towards the available balance until the hold is captured, voided or expires.
+func (s *TransactionService) AuthorizeHold(ctx context.Context, actor Actor, req HoldRequest) (*models.Hold, error) {
+	if req.Amount <= 0 {
+		return nil, fmt.Errorf("%w: amount must be positive", ErrInvalidHold)
+	}
+	description := strings.TrimSpace(req.Description)
+	if len(description) > maxHoldDescriptionLength {
+		return nil, fmt.Errorf("%w: descriptions are at most %d characters", ErrInvalidHold, maxHoldDescriptionLength)
+	}
+	now := time.Now()
+	expiresAt := now.Add(s.cfg.HoldTTL)
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(now) {
+			return nil, fmt.Errorf("%w: expires_at must be in the future", ErrInvalidHold)
+		}
+		if req.ExpiresAt.After(now.Add(s.cfg.HoldMaxTTL)) {
+			return nil, fmt.Errorf("%w: holds expire within %s", ErrInvalidHold, s.cfg.HoldMaxTTL)
+		}
+		expiresAt = *req.ExpiresAt
+	}
+
+	txType := models.TxTypeWithdraw
+	if req.ToUserID != nil || req.ToAccountID != nil {
+		txType = models.TxTypeTransfer
+	}
+	txReq, err := s.prepare(ctx, actor, TransactionRequest{
+		Type:          txType,
+		Amount:        req.Amount,
+		FromUserID:    req.FromUserID,
+		ToUserID:      req.ToUserID,
+		FromAccountID: req.FromAccountID,
+		ToAccountID:   req.ToAccountID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if txReq.ToAccountID != nil && *txReq.ToAccountID == *txReq.FromAccountID {
+		return nil, fmt.Errorf("%w: cannot hold funds for the same account", ErrInvalidHold)
+	}
+	if err := s.requireVerifiedSender(ctx, txReq.FromUserID); err != nil {
+		return nil, err
+	}
+	if err := s.checkParties(ctx, txReq.FromUserID, txReq.ToUserID); err != nil {
+		return nil, err
+	}
+
+	hold := &models.Hold{
+		FromUserID:    *txReq.FromUserID,
+		FromAccountID: *txReq.FromAccountID,
+		ToUserID:      txReq.ToUserID,
+		ToAccountID:   txReq.ToAccountID,
+		Amount:        req.Amount,
+		Description:   description,
+		Status:        models.HoldStatusActive,
+		CreatedBy:     actor.UserID,
+		ExpiresAt:     expiresAt,
+	}
+	err = s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		account, err := repo.GetAccountByID(ctx, hold.FromAccountID)
+		if err != nil {
+			return err
+		}
+		hold.Currency = account.Currency
+		if err := s.stepUpHold(ctx, repo, actor, txType, hold, req.Password, req.Code); err != nil {
+			return err
+		}
+
+		// Checked under the balance lock, like a debit being posted
+		balances, err := repo.GetBalancesForUpdate(ctx, []int64{hold.FromAccountID})
+		if err != nil {
+			return err
+		}
+		if err := checkAccount(ctx, repo, hold.FromAccountID, hold.FromUserID, hold.Currency, -hold.Amount); err != nil {
+			return err
+		}
+		if balances[hold.FromAccountID].Available < hold.Amount {
+			return ErrInsufficientFunds
+		}
+		if err := repo.CreateHold(ctx, hold); err != nil {
+			return err
+		}
+
+		details := fmt.Sprintf("hold_id: %d, account_id: %d, amount: %d %s", hold.ID, hold.FromAccountID, hold.Amount, hold.Currency)
+		if actor.OnBehalfOf != nil {
+			details += ", on_behalf, reason: " + actor.Reason
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   hold.FromUserID,
+			ActorID:    &actor.UserID,
+			Action:     "hold_authorized",
+			Details:    details,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.balanceSvc.invalidateAccount(ctx, hold.FromAccountID)
+	return hold, nil
+}
+
+// stepUpHold re-authenticates the actor if the hold is large enough to need
+// it.
+func (s *TransactionService) stepUpHold(ctx context.Context, repo repository.Repository, actor Actor, txType string, hold *models.Hold, password, code string) error {
+	if actor.Preauthorized {
+		return nil
+	}
+	required, err := s.requiresStepUp(ctx, txType, hold.Amount, hold.Currency)
+	if err != nil || !required {
+		return err
+	}
+	if password == "" && code == "" {
+		return fmt.Errorf("%w: a password or code is required for holds of this amount", ErrReauthFailed)
+	}
+	return s.userSvc.reauthenticate(ctx, repo, actor.UserID, password, code)
+}
+
+// ListHolds returns the holds on the user's accounts and those the user placed.
+func (s *TransactionService) ListHolds(ctx context.Context, userID int64) ([]*models.Hold, error) {
+	holds, err := s.repo.ListHoldsByUserID(ctx, userID)
+	if holds == nil {
+		holds = []*models.Hold{}
+	}
+	return holds, err
+}
+
+// CaptureHold turns amount of the hold, or all of it if amount is nil, into
+// a completed transaction and releases the rest. Only the user who placed
+// the hold can capture it; other users' holds are reported as sql.ErrNoRows.
+func (s *TransactionService) CaptureHold(ctx context.Context, userID, holdID int64, amount *int64) (*models.Hold, *models.Transaction, error) {
+	var (
+		hold  *models.Hold
+		tx    *models.Transaction
+		entry *models.JournalEntry
+	)
+	err := s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		var err error
+		hold, err = s.activeHold(ctx, repo, userID, holdID)
+		if err != nil {
+			return err
+		}
+		captured := hold.Amount
+		if amount != nil {
+			if *amount <= 0 || *amount > hold.Amount {
+				return fmt.Errorf("%w: amount must be between 1 and %d", ErrInvalidHold, hold.Amount)
+			}
+			captured = *amount
+		}
+
+		tx = &models.Transaction{
+			FromUserID:    &hold.FromUserID,
+			ToUserID:      hold.ToUserID,
+			FromAccountID: &hold.FromAccountID,
+			ToAccountID:   hold.ToAccountID,
+			Amount:        captured,
+			Type:          models.TxTypeWithdraw,
+			Status:        models.TxStatusPending,
+			CreatedBy:     &hold.CreatedBy,
+		}
+		if hold.ToAccountID != nil {
+			tx.Type = models.TxTypeTransfer
+		}
+		if err := s.price(ctx, repo, tx); err != nil {
+			return err
+		}
+		if err := repo.CreateTransaction(ctx, tx); err != nil {
+			return err
+		}
+		// Releases the hold before posting, so the capture can spend the
+		// funds it reserved
+		if err := repo.CaptureHold(ctx, hold.ID, captured, tx.ID); err != nil {
+			return err
+		}
+		if entry, err = s.balanceSvc.applyTransaction(ctx, repo, tx); err != nil {
+			return err
+		}
+		if err := repo.UpdateTransactionStatus(ctx, tx.ID, models.TxStatusCompleted); err != nil {
+			return err
+		}
+		tx.Status = models.TxStatusCompleted
+		hold.Status, hold.CapturedAmount, hold.TransactionID = models.HoldStatusCaptured, &captured, &tx.ID
+
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   hold.FromUserID,
+			ActorID:    &userID,
+			Action:     "hold_captured",
+			Details:    fmt.Sprintf("hold_id: %d, amount: %d of %d %s, transaction_id: %d", hold.ID, captured, hold.Amount, hold.Currency, tx.ID),
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	s.balanceSvc.invalidate(ctx, entry)
+	return hold, tx, nil
+}
+
+// VoidHold releases the hold without moving any money. Only the user who
+// placed it can void it.
+func (s *TransactionService) VoidHold(ctx context.Context, userID, holdID int64) (*models.Hold, error) {
+	var hold *models.Hold
+	err := s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		var err error
+		hold, err = s.activeHold(ctx, repo, userID, holdID)
+		if err != nil {
+			return err
+		}
+		if err := repo.VoidHold(ctx, hold.ID); err != nil {
+			return err
+		}
+		hold.Status = models.HoldStatusVoided
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   hold.FromUserID,
+			ActorID:    &userID,
+			Action:     "hold_voided",
+			Details:    fmt.Sprintf("hold_id: %d, amount: %d %s", hold.ID, hold.Amount, hold.Currency),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.balanceSvc.invalidateAccount(ctx, hold.FromAccountID)
+	return hold, nil
+}
+
+// activeHold locks the hold, which must have been placed by userID and still
+// be active.
+func (s *TransactionService) activeHold(ctx context.Context, repo repository.Repository, userID, holdID int64) (*models.Hold, error) {
+	hold, err := repo.GetHoldByIDForUpdate(ctx, holdID)
+	if err != nil {
+		return nil, err
+	}
+	if hold.CreatedBy != userID {
+		return nil, sql.ErrNoRows
+	}
+	switch hold.CurrentStatus(time.Now()) {
+	case models.HoldStatusActive:
+		return hold, nil
+	case models.HoldStatusExpired:
+		return nil, ErrHoldExpired
+	default:
+		return nil, ErrHoldNotActive
+	}
+}
+
+// ExpireHolds marks lapsed holds as expired every interval until ctx is
+// cancelled. Expired holds stop reserving funds as soon as they lapse; this
+// records that in the audit log.
+func (s *TransactionService) ExpireHolds(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, err := s.expireHolds(ctx)
+			if err != nil {
+				slog.Error("Failed to expire holds", "error", err)
+			} else if n > 0 {
+				slog.Info("Expired holds", "count", n)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *TransactionService) expireHolds(ctx context.Context) (int, error) {
+	var expired []*models.Hold
+	err := s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		var err error
+		expired, err = repo.ExpireHolds(ctx)
+		if err != nil {
+			return err
+		}
+		for _, hold := range expired {
+			err := repo.CreateAuditLog(ctx, &models.AuditLog{
+				EntityType: "user",
+				EntityID:   hold.FromUserID,
+				Action:     "hold_expired",
+				Details:    fmt.Sprintf("hold_id: %d, amount: %d %s", hold.ID, hold.Amount, hold.Currency),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, hold := range expired {
+		s.balanceSvc.invalidateAccount(ctx, hold.FromAccountID)
+	}
+	return len(expired), nil
+}
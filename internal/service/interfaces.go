@@ -7,19 +7,22 @@ import (
 
 type UserServiceInterface interface {
 	Register(ctx context.Context, username, email, password string) (*models.User, error)
-	Authenticate(ctx context.Context, email, password string) (*models.User, error)
+	Authenticate(ctx context.Context, email, password, ip string) (*LoginResult, error)
+	CompleteMFALogin(ctx context.Context, mfaToken, code, ip string) (*models.User, *models.AuthTokens, error)
+	Refresh(ctx context.Context, refreshToken string) (*models.AuthTokens, error)
+	Logout(ctx context.Context, refreshToken string) error
 	// Add other methods as needed
 }
 
 type TransactionServiceInterface interface {
-	Create(ctx context.Context, fromID, toID *int64, amount int64, typeStr string) (*models.Transaction, error)
+	Create(ctx context.Context, actor Actor, req TransactionRequest) (*models.Transaction, error)
 	ProcessTransaction(ctx context.Context, tx *models.Transaction) error
 	// GetHistory(ctx context.Context, userID int64) ([]*models.Transaction, error) // To be implemented
 }
 
 type BalanceServiceInterface interface {
-	GetBalance(ctx context.Context, userID int64) (*models.Balance, error)
-	UpdateBalance(ctx context.Context, userID int64, amountDelta int64) error
-	Credit(ctx context.Context, userID int64, amount int64) error
-	Debit(ctx context.Context, userID int64, amount int64) error
+	GetBalance(ctx context.Context, accountID int64) (*models.Balance, error)
+	UpdateBalance(ctx context.Context, accountID int64, amountDelta int64) error
+	Credit(ctx context.Context, accountID int64, amount int64) error
+	Debit(ctx context.Context, accountID int64, amount int64) error
 }
@@ -0,0 +1,297 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"sync"
+	"time"
+
+	"backend/internal/models"
+	"backend/internal/repository"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	AlgEdDSA = "EdDSA"
+	AlgRS256 = "RS256"
+)
+
+type KeyConfig struct {
+	Algorithm        string        // AlgEdDSA or AlgRS256, used for new keys
+	RotationInterval time.Duration // How long a key signs before it is replaced
+	GracePeriod      time.Duration // How long a replaced key still verifies
+	EncryptionSecret string        // Encrypts private keys at rest
+}
+
+type signingKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+// KeyManager signs and verifies JWTs with keys kept in the database so every
+// instance uses the same set. The newest active key signs; retired keys keep
+// verifying for the grace period so tokens already issued stay valid.
+type KeyManager struct {
+	repo repository.Repository
+	cfg  KeyConfig
+	box  *secretBox
+
+	mu       sync.RWMutex
+	keys     map[string]*signingKey
+	current  *signingKey
+	loadedAt time.Time
+}
+
+func NewKeyManager(ctx context.Context, repo repository.Repository, cfg KeyConfig) (*KeyManager, error) {
+	if cfg.Algorithm != AlgEdDSA && cfg.Algorithm != AlgRS256 {
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", cfg.Algorithm)
+	}
+
+	m := &KeyManager{repo: repo, cfg: cfg, box: newSecretBox(cfg.EncryptionSecret)}
+	if err := m.rotateIfDue(ctx); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Run rotates keys when they are due and reloads keys rotated by other
+// instances, until ctx is cancelled.
+func (m *KeyManager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.rotateIfDue(ctx); err != nil {
+				slog.Error("Failed to rotate signing keys", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Sign signs claims with the current key and sets the kid header.
+func (m *KeyManager) Sign(claims jwt.Claims) (string, error) {
+	m.mu.RLock()
+	key := m.current
+	m.mu.RUnlock()
+	if key == nil {
+		return "", errors.New("no signing key available")
+	}
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// Keyfunc resolves the verification key for a token from its kid header.
+func (m *KeyManager) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key := m.lookup(kid)
+	if key == nil {
+		// It may have been created by another instance since the last load
+		m.reloadIfStale(10 * time.Second)
+		if key = m.lookup(kid); key == nil {
+			return nil, fmt.Errorf("unknown signing key: %q", kid)
+		}
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.public, nil
+}
+
+// ValidMethods lists the algorithms accepted when parsing tokens.
+func (m *KeyManager) ValidMethods() []string {
+	return []string{AlgEdDSA, AlgRS256}
+}
+
+// JWKS returns the public half of every key that can still verify tokens.
+func (m *KeyManager) JWKS() *models.JWKS {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	jwks := &models.JWKS{Keys: []models.JWK{}}
+	for _, k := range m.keys {
+		jwk := models.JWK{Kid: k.kid, Use: "sig", Alg: k.method.Alg()}
+		switch pub := k.public.(type) {
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		default:
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
+
+func (m *KeyManager) lookup(kid string) *signingKey {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.keys[kid]
+}
+
+func (m *KeyManager) reloadIfStale(maxAge time.Duration) {
+	m.mu.RLock()
+	stale := time.Since(m.loadedAt) > maxAge
+	m.mu.RUnlock()
+	if !stale {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.load(ctx, m.repo); err != nil {
+		slog.Error("Failed to reload signing keys", "error", err)
+	}
+}
+
+// rotateIfDue creates a new signing key when there is none or the current one
+// is older than the rotation interval, then reloads the key set.
+func (m *KeyManager) rotateIfDue(ctx context.Context) error {
+	return m.repo.WithTx(ctx, func(repo repository.Repository) error {
+		if err := repo.LockSigningKeys(ctx); err != nil {
+			return err
+		}
+		keys, err := repo.ListSigningKeys(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if k.RetiredAt == nil && time.Since(k.CreatedAt) < m.cfg.RotationInterval {
+				return m.loadKeys(keys)
+			}
+		}
+
+		record, err := m.generate()
+		if err != nil {
+			return err
+		}
+		if err := repo.CreateSigningKey(ctx, record); err != nil {
+			return err
+		}
+		if err := repo.RetireSigningKeys(ctx, record.ID, time.Now().Add(m.cfg.GracePeriod)); err != nil {
+			return err
+		}
+		slog.Info("Rotated JWT signing key", "kid", record.KID, "algorithm", record.Algorithm)
+		return m.load(ctx, repo)
+	})
+}
+
+func (m *KeyManager) load(ctx context.Context, repo repository.Repository) error {
+	keys, err := repo.ListSigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+	return m.loadKeys(keys)
+}
+
+// loadKeys replaces the in-memory key set. keys must be ordered newest first.
+func (m *KeyManager) loadKeys(records []*models.SigningKey) error {
+	keys := make(map[string]*signingKey, len(records))
+	var current *signingKey
+	for _, rec := range records {
+		k, err := m.decode(rec)
+		if err != nil {
+			return fmt.Errorf("signing key %s: %w", rec.KID, err)
+		}
+		keys[k.kid] = k
+		if current == nil && rec.RetiredAt == nil {
+			current = k
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys = keys
+	m.current = current
+	m.loadedAt = time.Now()
+	return nil
+}
+
+func (m *KeyManager) generate() (*models.SigningKey, error) {
+	var private crypto.Signer
+	var err error
+	switch m.cfg.Algorithm {
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	public, err := x509.MarshalPKIXPublicKey(private.Public())
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := m.box.seal(der)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := randomToken(12)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.SigningKey{
+		KID:        kid,
+		Algorithm:  m.cfg.Algorithm,
+		PrivateKey: encrypted,
+		PublicKey:  public,
+	}, nil
+}
+
+func (m *KeyManager) decode(rec *models.SigningKey) (*signingKey, error) {
+	public, err := x509.ParsePKIXPublicKey(rec.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	der, err := m.box.open(rec.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key cannot sign")
+	}
+
+	var method jwt.SigningMethod
+	switch rec.Algorithm {
+	case AlgEdDSA:
+		method = jwt.SigningMethodEdDSA
+	case AlgRS256:
+		method = jwt.SigningMethodRS256
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %s", rec.Algorithm)
+	}
+	return &signingKey{kid: rec.KID, method: method, private: private, public: public}, nil
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"backend/internal/models"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrAccountLocked      = errors.New("account is temporarily locked after too many failed logins")
+	ErrTooManyAttempts    = errors.New("too many failed login attempts, try again later")
+)
+
+// LockoutConfig limits password and MFA guessing. Failures are counted per
+// account and per client IP within FailureWindow. Each failure delays the
+// response a little longer, an account is locked once it reaches
+// MaxAccountFailures and an IP is refused once it reaches MaxIPFailures.
+type LockoutConfig struct {
+	MaxAccountFailures int
+	MaxIPFailures      int
+	FailureWindow      time.Duration
+	LockoutDuration    time.Duration
+	DelayBase          time.Duration
+	DelayMax           time.Duration
+}
+
+// UnlockUser lifts a lockout before it expires.
+func (s *UserService) UnlockUser(ctx context.Context, actorID, userID int64) error {
+	user, err := s.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.UnlockUser(ctx, userID); err != nil {
+		return err
+	}
+	if err := s.attempts.Reset(ctx, accountAttemptsKey(user.Email)); err != nil {
+		return err
+	}
+	return s.repo.CreateAuditLog(ctx, &models.AuditLog{
+		EntityType: "user",
+		EntityID:   userID,
+		ActorID:    &actorID,
+		Action:     "account_unlocked",
+	})
+}
+
+// checkLoginAllowed refuses IPs with too many recent failures and locked accounts.
+func (s *UserService) checkLoginAllowed(ctx context.Context, user *models.User, ip string) error {
+	if ip != "" && s.cfg.Lockout.MaxIPFailures > 0 {
+		n, err := s.attempts.Count(ctx, ipAttemptsKey(ip))
+		if err != nil {
+			return err
+		}
+		if n >= int64(s.cfg.Lockout.MaxIPFailures) {
+			return ErrTooManyAttempts
+		}
+	}
+	if user != nil && user.LockedUntil != nil && time.Now().Before(*user.LockedUntil) {
+		return ErrAccountLocked
+	}
+	return nil
+}
+
+// recordLoginFailure counts a failed password or MFA code, locks the account
+// if it has reached the limit, and waits before returning. user is nil when
+// no account has the email. It reports whether the account is now locked.
+func (s *UserService) recordLoginFailure(ctx context.Context, user *models.User, email, ip string) (bool, error) {
+	cfg := s.cfg.Lockout
+	accountFailures, err := s.attempts.Add(ctx, accountAttemptsKey(email), cfg.FailureWindow)
+	if err != nil {
+		return false, err
+	}
+	failures := accountFailures
+	if ip != "" {
+		ipFailures, err := s.attempts.Add(ctx, ipAttemptsKey(ip), cfg.FailureWindow)
+		if err != nil {
+			return false, err
+		}
+		failures = max(failures, ipFailures)
+	}
+	defer s.delay(ctx, failures)
+	return s.lockIfExceeded(ctx, user, email, ip, accountFailures)
+}
+
+// countLoginFailure is recordLoginFailure for the account alone, without
+// waiting.
+func (s *UserService) countLoginFailure(ctx context.Context, user *models.User, email, ip string) (bool, error) {
+	accountFailures, err := s.attempts.Add(ctx, accountAttemptsKey(email), s.cfg.Lockout.FailureWindow)
+	if err != nil {
+		return false, err
+	}
+	return s.lockIfExceeded(ctx, user, email, ip, accountFailures)
+}
+
+// lockIfExceeded locks the account once accountFailures reaches the limit.
+func (s *UserService) lockIfExceeded(ctx context.Context, user *models.User, email, ip string, accountFailures int64) (bool, error) {
+	cfg := s.cfg.Lockout
+	if user == nil || cfg.MaxAccountFailures <= 0 || accountFailures < int64(cfg.MaxAccountFailures) {
+		return false, nil
+	}
+
+	until := time.Now().Add(cfg.LockoutDuration)
+	if err := s.repo.LockUser(ctx, user.ID, until); err != nil {
+		return false, err
+	}
+	if err := s.attempts.Reset(ctx, accountAttemptsKey(email)); err != nil {
+		return false, err
+	}
+	slog.Warn("Account locked after failed logins", "user_id", user.ID, "ip", ip)
+	return true, s.repo.CreateAuditLog(ctx, &models.AuditLog{
+		EntityType: "user",
+		EntityID:   user.ID,
+		Action:     "account_locked",
+		Details:    fmt.Sprintf("failures: %d, ip: %s, locked_until: %s", accountFailures, ip, until.Format(time.RFC3339)),
+	})
+}
+
+// recordLoginSuccess clears the account's failure count and audits the login.
+func (s *UserService) recordLoginSuccess(ctx context.Context, user *models.User, ip string) error {
+	if err := s.attempts.Reset(ctx, accountAttemptsKey(user.Email)); err != nil {
+		return err
+	}
+	return s.repo.CreateAuditLog(ctx, &models.AuditLog{
+		EntityType: "user",
+		EntityID:   user.ID,
+		ActorID:    &user.ID,
+		Action:     "login_success",
+		Details:    fmt.Sprintf("ip: %s", ip),
+	})
+}
+
+// delay doubles with every failure, up to DelayMax.
+func (s *UserService) delay(ctx context.Context, failures int64) {
+	d := s.cfg.Lockout.DelayBase
+	if d <= 0 {
+		return
+	}
+	for i := int64(1); i < failures && d < s.cfg.Lockout.DelayMax; i++ {
+		d *= 2
+	}
+	d = min(d, s.cfg.Lockout.DelayMax)
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+func accountAttemptsKey(email string) string {
+	return "login:account:" + normalizeEmail(email)
+}
+
+func ipAttemptsKey(ip string) string {
+	return "login:ip:" + ip
+}
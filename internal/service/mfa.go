@@ -0,0 +1,327 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"backend/internal/models"
+	"backend/internal/repository"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrMFAAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnrolled    = errors.New("two-factor authentication is not set up")
+	ErrInvalidMFACode    = errors.New("invalid authentication code")
+	ErrInvalidMFAToken   = errors.New("invalid or expired MFA token")
+	ErrReauthFailed      = errors.New("re-authentication failed")
+)
+
+const recoveryCodeCount = 10
+
+// EnrollMFA generates a new TOTP secret for the user. It has no effect on
+// login until it is confirmed with ConfirmMFA.
+func (s *UserService) EnrollMFA(ctx context.Context, userID int64) (*models.MFAEnrollment, error) {
+	user, err := s.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := s.repo.GetUserMFA(ctx, userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if existing != nil && existing.EnabledAt != nil {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := s.box.seal(secret)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.SaveUserMFASecret(ctx, userID, sealed); err != nil {
+		return nil, err
+	}
+
+	return &models.MFAEnrollment{
+		Secret:     base32NoPad.EncodeToString(secret),
+		OTPAuthURI: otpauthURI(s.cfg.MFAIssuer, user.Email, secret),
+	}, nil
+}
+
+// ConfirmMFA enables a pending enrollment once the user proves their
+// authenticator works, and returns recovery codes. They are only shown once.
+func (s *UserService) ConfirmMFA(ctx context.Context, userID int64, code string) ([]string, error) {
+	var codes []string
+	err := s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		m, secret, err := s.loadMFA(ctx, repo, userID)
+		if err != nil {
+			return err
+		}
+		if m.EnabledAt != nil {
+			return ErrMFAAlreadyEnabled
+		}
+
+		step, ok := matchTOTP(secret, code, time.Now())
+		if !ok {
+			return ErrInvalidMFACode
+		}
+		if err := repo.EnableUserMFA(ctx, userID, step); err != nil {
+			return err
+		}
+		if codes, err = s.replaceRecoveryCodes(ctx, repo, userID); err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   userID,
+			ActorID:    &userID,
+			Action:     "mfa_enabled",
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableMFA turns two-factor authentication off after checking a current
+// code or recovery code.
+func (s *UserService) DisableMFA(ctx context.Context, userID int64, code string) error {
+	return s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		if err := s.verifyMFA(ctx, repo, userID, code); err != nil {
+			return err
+		}
+		if err := repo.DeleteUserMFA(ctx, userID); err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   userID,
+			ActorID:    &userID,
+			Action:     "mfa_disabled",
+		})
+	})
+}
+
+// RegenerateRecoveryCodes replaces every recovery code of the user.
+func (s *UserService) RegenerateRecoveryCodes(ctx context.Context, userID int64, code string) ([]string, error) {
+	var codes []string
+	err := s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		if err := s.verifyMFA(ctx, repo, userID, code); err != nil {
+			return err
+		}
+		var err error
+		codes, err = s.replaceRecoveryCodes(ctx, repo, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// CompleteMFALogin exchanges the challenge token returned by Authenticate and
+// a TOTP or recovery code for a token pair. Each challenge can be used once.
+// Wrong codes count as failed logins.
+func (s *UserService) CompleteMFALogin(ctx context.Context, mfaToken, code, ip string) (*models.User, *models.AuthTokens, error) {
+	token, err := s.parseToken(mfaToken, tokenUseMFA)
+	if err != nil {
+		return nil, nil, ErrInvalidMFAToken
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if revoked, err := s.IsRevoked(ctx, claims); err != nil || revoked {
+		return nil, nil, ErrInvalidMFAToken
+	}
+	userID, _ := claims["user_id"].(float64)
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return nil, nil, ErrInvalidMFAToken
+	}
+
+	user, err := s.repo.GetUserByID(ctx, int64(userID))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.checkLoginAllowed(ctx, user, ip); err != nil {
+		return nil, nil, err
+	}
+
+	var tokens *models.AuthTokens
+	err = s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		if err := s.verifyMFA(ctx, repo, user.ID, code); err != nil {
+			return err
+		}
+		familyID, err := randomToken(16)
+		if err != nil {
+			return err
+		}
+		tokens, _, err = s.issueTokens(ctx, repo, user, familyID, nil)
+		return err
+	})
+	if errors.Is(err, ErrInvalidMFACode) {
+		locked, err := s.recordLoginFailure(ctx, user, user.Email, ip)
+		if err != nil {
+			return nil, nil, err
+		}
+		if locked {
+			return nil, nil, ErrAccountLocked
+		}
+		return nil, nil, ErrInvalidMFACode
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	jti, _ := claims["jti"].(string)
+	if err := s.revoked.Revoke(ctx, jti, exp.Time); err != nil {
+		return nil, nil, err
+	}
+	if err := s.recordLoginSuccess(ctx, user, ip); err != nil {
+		return nil, nil, err
+	}
+	return user, tokens, nil
+}
+
+// reauthenticate checks that the user is present. Users with MFA enabled
+// must give a TOTP or recovery code, and the password too if they give one;
+// other users must give their password. Failures count towards the same
+// lockout as failed logins.
+func (s *UserService) reauthenticate(ctx context.Context, repo repository.Repository, userID int64, password, code string) error {
+	user, err := repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := s.checkLoginAllowed(ctx, user, ""); err != nil {
+		return err
+	}
+
+	if password != "" && bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return s.reauthFailed(ctx, user)
+	}
+	m, err := repo.GetUserMFA(ctx, userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err == nil && m.EnabledAt != nil {
+		if code == "" {
+			return fmt.Errorf("%w: a code from your authenticator app is required", ErrReauthFailed)
+		}
+		err := s.verifyMFA(ctx, repo, userID, code)
+		if errors.Is(err, ErrInvalidMFACode) {
+			return s.reauthFailed(ctx, user)
+		}
+		if err != nil {
+			return err
+		}
+	} else if password == "" {
+		return fmt.Errorf("%w: your password is required", ErrReauthFailed)
+	}
+	return s.attempts.Reset(ctx, accountAttemptsKey(user.Email))
+}
+
+// reauthFailed counts a failed re-authentication and returns the error for
+// it. It doesn't wait like failed logins do, since callers hold row locks.
+func (s *UserService) reauthFailed(ctx context.Context, user *models.User) error {
+	locked, err := s.countLoginFailure(ctx, user, user.Email, "")
+	if err != nil {
+		return err
+	}
+	if locked {
+		return ErrAccountLocked
+	}
+	return ErrReauthFailed
+}
+
+// mfaEnabled reports whether the user has confirmed a TOTP enrollment.
+func (s *UserService) mfaEnabled(ctx context.Context, userID int64) (bool, error) {
+	m, err := s.repo.GetUserMFA(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return m.EnabledAt != nil, nil
+}
+
+// issueMFAChallenge returns a short-lived token proving the password check
+// passed. It is not accepted by the auth middleware.
+func (s *UserService) issueMFAChallenge(user *models.User) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return s.keys.Sign(jwt.MapClaims{
+		"jti":       jti,
+		"user_id":   user.ID,
+		"token_use": tokenUseMFA,
+		"iat":       numericDate(now),
+		"exp":       now.Add(s.cfg.MFAChallengeTTL).Unix(),
+	})
+}
+
+// verifyMFA checks code against the user's enabled TOTP secret, falling back
+// to recovery codes. Accepted codes are used up.
+func (s *UserService) verifyMFA(ctx context.Context, repo repository.Repository, userID int64, code string) error {
+	m, secret, err := s.loadMFA(ctx, repo, userID)
+	if err != nil {
+		return err
+	}
+	if m.EnabledAt == nil {
+		return ErrMFANotEnrolled
+	}
+
+	if isTOTPCode(code) {
+		step, ok := matchTOTP(secret, code, time.Now())
+		if !ok {
+			return ErrInvalidMFACode
+		}
+		err = repo.UseMFAStep(ctx, userID, step)
+	} else {
+		err = repo.UseRecoveryCode(ctx, userID, hashRecoveryCode(code))
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidMFACode
+	}
+	return err
+}
+
+func (s *UserService) loadMFA(ctx context.Context, repo repository.Repository, userID int64) (*models.UserMFA, []byte, error) {
+	m, err := repo.GetUserMFA(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrMFANotEnrolled
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := s.box.open(m.Secret)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decrypt MFA secret: %w", err)
+	}
+	return m, secret, nil
+}
+
+func (s *UserService) replaceRecoveryCodes(ctx context.Context, repo repository.Repository, userID int64) ([]string, error) {
+	codes, err := generateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, c := range codes {
+		hashes[i] = hashRecoveryCode(c)
+	}
+	if err := repo.ReplaceRecoveryCodes(ctx, userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
@@ -0,0 +1,574 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/internal/models"
+	"backend/internal/repository"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrInvalidClientMetadata = errors.New("invalid client metadata")
+
+// OAuthError is an error response defined by RFC 6749, section 5.2. Code is
+// one of the error codes listed there, such as invalid_grant.
+type OAuthError struct {
+	Code        string
+	Description string
+}
+
+func (e *OAuthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func oauthError(code, description string) *OAuthError {
+	return &OAuthError{Code: code, Description: description}
+}
+
+// pkceVerifier matches a code_verifier as defined by RFC 7636, section 4.1.
+var pkceVerifier = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+
+type OAuthConfig struct {
+	CodeTTL time.Duration // How long an authorization code can be exchanged
+}
+
+// AuthorizeRequest holds the parameters of an authorization request. Only the
+// code flow with an S256 PKCE challenge is supported.
+type AuthorizeRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// TokenRequest holds the parameters of a token request. ClientSecret is empty
+// for public clients.
+type TokenRequest struct {
+	GrantType    string
+	ClientID     string
+	ClientSecret string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+	RefreshToken string
+	Scope        string
+}
+
+// OAuthService lets third-party clients act for users with the scopes they
+// approve. Access and refresh tokens are issued by UserService, so they are
+// verified, refreshed and revoked like first-party ones.
+type OAuthService struct {
+	repo  repository.Repository
+	users *UserService
+	cfg   OAuthConfig
+}
+
+func NewOAuthService(repo repository.Repository, users *UserService, cfg OAuthConfig) *OAuthService {
+	return &OAuthService{repo: repo, users: users, cfg: cfg}
+}
+
+// RegisterClient registers a client. Confidential clients get a secret, which
+// is returned once and not stored. Setting userID lets the client use the
+// client credentials grant as that user.
+func (s *OAuthService) RegisterClient(ctx context.Context, actorID int64, name string, redirectURIs, scopes []string, confidential bool, userID *int64) (*models.OAuthClient, string, error) {
+	if err := validateScopes(scopes); err != nil {
+		return nil, "", err
+	}
+	for _, uri := range redirectURIs {
+		if err := validateRedirectURI(uri); err != nil {
+			return nil, "", err
+		}
+	}
+	if userID != nil && !confidential {
+		return nil, "", fmt.Errorf("%w: only confidential clients can act as a user", ErrInvalidClientMetadata)
+	}
+	if len(redirectURIs) == 0 && userID == nil {
+		return nil, "", fmt.Errorf("%w: redirect_uris or user_id is required", ErrInvalidClientMetadata)
+	}
+
+	clientID, err := randomToken(16)
+	if err != nil {
+		return nil, "", err
+	}
+	client := &models.OAuthClient{
+		ClientID:     clientID,
+		Name:         name,
+		RedirectURIs: redirectURIs,
+		Scopes:       scopes,
+		UserID:       userID,
+		CreatedBy:    &actorID,
+	}
+	var secret string
+	if confidential {
+		if secret, err = randomToken(32); err != nil {
+			return nil, "", err
+		}
+		client.SecretHash = hashToken(secret)
+	}
+
+	err = s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		if userID != nil {
+			if _, err := repo.GetUserByID(ctx, *userID); err != nil {
+				return err
+			}
+		}
+		if err := repo.CreateOAuthClient(ctx, client); err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "oauth_client",
+			EntityID:   client.ID,
+			ActorID:    &actorID,
+			Action:     "oauth_client_registered",
+			Details:    fmt.Sprintf("client_id: %s, scopes: %s", clientID, strings.Join(scopes, " ")),
+		})
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return client, secret, nil
+}
+
+func (s *OAuthService) ListClients(ctx context.Context) ([]*models.OAuthClient, error) {
+	return s.repo.ListOAuthClients(ctx)
+}
+
+// RevokeClient disables a client and revokes its refresh tokens. Access
+// tokens already issued stay valid until they expire.
+func (s *OAuthService) RevokeClient(ctx context.Context, actorID, id int64) error {
+	return s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		client, err := repo.RevokeOAuthClient(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := repo.RevokeClientRefreshTokens(ctx, client.ClientID); err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "oauth_client",
+			EntityID:   id,
+			ActorID:    &actorID,
+			Action:     "oauth_client_revoked",
+			Details:    fmt.Sprintf("client_id: %s", client.ClientID),
+		})
+	})
+}
+
+// PrepareAuthorization validates an authorization request and describes it
+// for the consent screen.
+func (s *OAuthService) PrepareAuthorization(ctx context.Context, req AuthorizeRequest) (*models.OAuthConsent, error) {
+	client, err := s.activeClient(ctx, req.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	redirectURI := req.RedirectURI
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		return nil, oauthError("invalid_request", "redirect_uri is not registered for this client")
+	}
+	if req.ResponseType != "code" {
+		return nil, oauthError("unsupported_response_type", "only the code response type is supported")
+	}
+	if req.CodeChallengeMethod != "S256" || len(req.CodeChallenge) != 43 {
+		return nil, oauthError("invalid_request", "a PKCE code_challenge with method S256 is required")
+	}
+	scopes, err := requestedScopes(req.Scope, client)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.OAuthConsent{
+		ClientID:    client.ClientID,
+		ClientName:  client.Name,
+		Scopes:      scopes,
+		RedirectURI: redirectURI,
+		State:       req.State,
+	}, nil
+}
+
+// Authorize records the user's decision on an authorization request and
+// returns the URL to send the user back to the client with. If the user
+// approved, it carries a single-use authorization code.
+func (s *OAuthService) Authorize(ctx context.Context, userID int64, req AuthorizeRequest, approve bool) (string, error) {
+	consent, err := s.PrepareAuthorization(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	if !approve {
+		return redirectWith(consent.RedirectURI, "error", "access_denied", "state", consent.State)
+	}
+
+	code, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	err = s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		err := repo.CreateAuthorizationCode(ctx, &models.AuthorizationCode{
+			CodeHash:      hashToken(code),
+			ClientID:      consent.ClientID,
+			UserID:        userID,
+			RedirectURI:   consent.RedirectURI,
+			Scopes:        consent.Scopes,
+			CodeChallenge: req.CodeChallenge,
+			ExpiresAt:     time.Now().Add(s.cfg.CodeTTL),
+		})
+		if err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   userID,
+			ActorID:    &userID,
+			Action:     "oauth_authorized",
+			Details:    fmt.Sprintf("client_id: %s, scopes: %s", consent.ClientID, strings.Join(consent.Scopes, " ")),
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+	return redirectWith(consent.RedirectURI, "code", code, "state", consent.State)
+}
+
+// Token handles the token endpoint for the authorization_code,
+// refresh_token and client_credentials grants.
+func (s *OAuthService) Token(ctx context.Context, req TokenRequest) (*models.OAuthToken, error) {
+	client, err := s.authenticateClient(ctx, req.ClientID, req.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.GrantType {
+	case "authorization_code":
+		return s.exchangeCode(ctx, client, req)
+	case "refresh_token":
+		tokens, err := s.users.refresh(ctx, req.RefreshToken, client.ClientID)
+		if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) {
+			return nil, oauthError("invalid_grant", err.Error())
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &models.OAuthToken{
+			AccessToken:  tokens.AccessToken,
+			TokenType:    "Bearer",
+			ExpiresIn:    tokens.ExpiresIn,
+			RefreshToken: tokens.RefreshToken,
+		}, nil
+	case "client_credentials":
+		return s.clientCredentials(ctx, client, req)
+	default:
+		return nil, oauthError("unsupported_grant_type", "grant_type must be authorization_code, refresh_token or client_credentials")
+	}
+}
+
+// exchangeCode redeems an authorization code. A code presented a second time
+// revokes the tokens issued for it, since it has leaked.
+func (s *OAuthService) exchangeCode(ctx context.Context, client *models.OAuthClient, req TokenRequest) (*models.OAuthToken, error) {
+	var (
+		tokens *models.AuthTokens
+		scopes []string
+	)
+	err := s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		code, err := repo.GetAuthorizationCodeForUpdate(ctx, hashToken(req.Code))
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && code.ClientID != client.ClientID) {
+			return oauthError("invalid_grant", "invalid authorization code")
+		}
+		if err != nil {
+			return err
+		}
+		if code.UsedAt != nil {
+			if code.FamilyID == nil {
+				return nil
+			}
+			return repo.RevokeRefreshTokenFamily(ctx, *code.FamilyID)
+		}
+		if time.Now().After(code.ExpiresAt) {
+			return oauthError("invalid_grant", "authorization code has expired")
+		}
+		if req.RedirectURI != "" && req.RedirectURI != code.RedirectURI {
+			return oauthError("invalid_grant", "redirect_uri does not match the authorization request")
+		}
+		if !verifyPKCE(req.CodeVerifier, code.CodeChallenge) {
+			return oauthError("invalid_grant", "code_verifier does not match the code challenge")
+		}
+
+		user, err := repo.GetUserByID(ctx, code.UserID)
+		if err != nil {
+			return err
+		}
+		if err := checkSignIn(user); err != nil {
+			return oauthError("invalid_grant", err.Error())
+		}
+		familyID, err := randomToken(16)
+		if err != nil {
+			return err
+		}
+		scopes = code.Scopes
+		tokens, _, err = s.users.issueTokens(ctx, repo, user, familyID, &oauthGrant{ClientID: client.ClientID, Scopes: scopes})
+		if err != nil {
+			return err
+		}
+		return repo.UseAuthorizationCode(ctx, code.ID, familyID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if tokens == nil {
+		// The code was already used and its tokens were revoked above
+		return nil, oauthError("invalid_grant", "authorization code has already been used")
+	}
+	return &models.OAuthToken{
+		AccessToken:  tokens.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    tokens.ExpiresIn,
+		RefreshToken: tokens.RefreshToken,
+		Scope:        strings.Join(scopes, " "),
+	}, nil
+}
+
+// clientCredentials issues an access token for the client's own user. No
+// refresh token is issued since the client can always ask for a new one.
+func (s *OAuthService) clientCredentials(ctx context.Context, client *models.OAuthClient, req TokenRequest) (*models.OAuthToken, error) {
+	if !client.Confidential || client.UserID == nil {
+		return nil, oauthError("unauthorized_client", "client is not allowed to use the client_credentials grant")
+	}
+	scopes, err := requestedScopes(req.Scope, client)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.repo.GetUserByID(ctx, *client.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSignIn(user); err != nil {
+		return nil, oauthError("unauthorized_client", err.Error())
+	}
+	access, err := s.users.generateToken(user, &oauthGrant{ClientID: client.ClientID, Scopes: scopes})
+	if err != nil {
+		return nil, err
+	}
+	return &models.OAuthToken{
+		AccessToken: access,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(s.users.cfg.AccessTokenTTL.Seconds()),
+		Scope:       strings.Join(scopes, " "),
+	}, nil
+}
+
+// Introspect describes an access or refresh token issued to the calling
+// client, which must be confidential. Tokens of other clients, and first-party
+// tokens, are reported as inactive.
+func (s *OAuthService) Introspect(ctx context.Context, clientID, clientSecret, token string) (*models.TokenIntrospection, error) {
+	client, err := s.authenticateClient(ctx, clientID, clientSecret)
+	if err != nil {
+		return nil, err
+	}
+	if !client.Confidential {
+		return nil, oauthError("invalid_client", "only confidential clients can introspect tokens")
+	}
+	inactive := &models.TokenIntrospection{Active: false}
+
+	if claims := s.accessTokenClaims(ctx, client, token); claims != nil {
+		userID, _ := claims["user_id"].(float64)
+		scope, _ := claims["scope"].(string)
+		email, _ := claims["email"].(string)
+		result := &models.TokenIntrospection{
+			Active:    true,
+			Scope:     scope,
+			ClientID:  client.ClientID,
+			Username:  email,
+			TokenType: "Bearer",
+			Sub:       strconv.FormatInt(int64(userID), 10),
+		}
+		if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+			result.Exp = exp.Unix()
+		}
+		if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+			result.Iat = iat.Unix()
+		}
+		return result, nil
+	}
+
+	refresh, err := s.refreshToken(ctx, client, token)
+	if err != nil || refresh == nil {
+		return inactive, err
+	}
+	if refresh.UsedAt != nil || refresh.RevokedAt != nil || time.Now().After(refresh.ExpiresAt) {
+		return inactive, nil
+	}
+	return &models.TokenIntrospection{
+		Active:    true,
+		Scope:     strings.Join(refresh.Scopes, " "),
+		ClientID:  client.ClientID,
+		TokenType: "refresh_token",
+		Sub:       strconv.FormatInt(refresh.UserID, 10),
+		Exp:       refresh.ExpiresAt.Unix(),
+		Iat:       refresh.CreatedAt.Unix(),
+	}, nil
+}
+
+// Revoke revokes an access or refresh token issued to the calling client.
+// Revoking a refresh token revokes every token rotated from the same grant.
+// As RFC 7009 requires, unknown tokens are not an error.
+func (s *OAuthService) Revoke(ctx context.Context, clientID, clientSecret, token string) error {
+	client, err := s.authenticateClient(ctx, clientID, clientSecret)
+	if err != nil {
+		return err
+	}
+	if claims := s.accessTokenClaims(ctx, client, token); claims != nil {
+		return s.users.RevokeAccessToken(ctx, token)
+	}
+	refresh, err := s.refreshToken(ctx, client, token)
+	if err != nil || refresh == nil {
+		return err
+	}
+	return s.repo.RevokeRefreshTokenFamily(ctx, refresh.FamilyID)
+}
+
+// authenticateClient loads an active client and checks its secret. Public
+// clients must not send one.
+func (s *OAuthService) authenticateClient(ctx context.Context, clientID, clientSecret string) (*models.OAuthClient, error) {
+	client, err := s.activeClient(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+	if !client.Confidential {
+		if clientSecret != "" {
+			return nil, oauthError("invalid_client", "client authentication failed")
+		}
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(hashToken(clientSecret))) != 1 {
+		return nil, oauthError("invalid_client", "client authentication failed")
+	}
+	return client, nil
+}
+
+func (s *OAuthService) activeClient(ctx context.Context, clientID string) (*models.OAuthClient, error) {
+	if clientID == "" {
+		return nil, oauthError("invalid_client", "client_id is required")
+	}
+	client, err := s.repo.GetOAuthClient(ctx, clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, oauthError("invalid_client", "unknown client")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if client.RevokedAt != nil {
+		return nil, oauthError("invalid_client", "client has been revoked")
+	}
+	return client, nil
+}
+
+// accessTokenClaims returns the claims of token if it is a live access token
+// issued to client, and nil otherwise.
+func (s *OAuthService) accessTokenClaims(ctx context.Context, client *models.OAuthClient, token string) jwt.MapClaims {
+	parsed, err := s.users.ValidateToken(token)
+	if err != nil || !parsed.Valid {
+		return nil
+	}
+	claims, ok := parsed.Claims.(jwt.MapClaims)
+	if !ok || claims["client_id"] != client.ClientID {
+		return nil
+	}
+	if revoked, err := s.users.IsRevoked(ctx, claims); err != nil || revoked {
+		return nil
+	}
+	return claims
+}
+
+// refreshToken returns the refresh token record if token was issued to
+// client, and nil otherwise.
+func (s *OAuthService) refreshToken(ctx context.Context, client *models.OAuthClient, token string) (*models.RefreshToken, error) {
+	refresh, err := s.repo.GetRefreshTokenByHash(ctx, hashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if grantOf(refresh).clientID() != client.ClientID {
+		return nil, nil
+	}
+	return refresh, nil
+}
+
+// requestedScopes parses a space-separated scope parameter, defaulting to
+// every scope the client is registered for.
+func requestedScopes(scope string, client *models.OAuthClient) ([]string, error) {
+	scopes := strings.Fields(scope)
+	if len(scopes) == 0 {
+		return client.Scopes, nil
+	}
+	for _, sc := range scopes {
+		if !slices.Contains(client.Scopes, sc) {
+			return nil, oauthError("invalid_scope", fmt.Sprintf("scope %s is not allowed for this client", sc))
+		}
+	}
+	return scopes, nil
+}
+
+// validateRedirectURI accepts absolute URLs without a fragment. Plain http is
+// only allowed for loopback addresses used by native apps.
+func validateRedirectURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" || u.Fragment != "" {
+		return fmt.Errorf("%w: invalid redirect URI %q", ErrInvalidClientMetadata, uri)
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		if host := u.Hostname(); host == "localhost" || host == "127.0.0.1" || host == "::1" {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: redirect URI %q must use https", ErrInvalidClientMetadata, uri)
+}
+
+// verifyPKCE checks a code_verifier against an S256 code_challenge.
+func verifyPKCE(verifier, challenge string) bool {
+	if !pkceVerifier.MatchString(verifier) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// redirectWith adds query parameters to a redirect URI, skipping empty values.
+// pairs alternates names and values.
+func redirectWith(uri string, pairs ...string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			q.Set(pairs[i], pairs[i+1])
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"backend/internal/models"
+	"backend/internal/notify"
+	"backend/internal/repository"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidResetToken = errors.New("invalid or expired reset token")
+
+// RequestPasswordReset mails the user a single-use reset link, replacing any
+// earlier one. Unknown emails are ignored so the response does not reveal
+// whether an account exists. Closed accounts are ignored too, as are requests
+// within the resend interval of the last link.
+func (s *UserService) RequestPasswordReset(ctx context.Context, email string) error {
+	user, err := s.repo.GetUserByEmail(ctx, normalizeEmail(email))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.Closed() {
+		return nil
+	}
+	if err := s.repo.ClaimPasswordResetSend(ctx, user.ID, s.cfg.PasswordResetResendInterval); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	err = s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		if err := repo.UsePasswordResetTokens(ctx, user.ID); err != nil {
+			return err
+		}
+		return repo.CreatePasswordResetToken(ctx, &models.PasswordResetToken{
+			UserID:    user.ID,
+			TokenHash: hashToken(token),
+			ExpiresAt: time.Now().Add(s.cfg.PasswordResetTTL),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	msg := notify.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Use the link below to choose a new password. It expires in %s.\n\n%s%s",
+			s.cfg.PasswordResetTTL, s.cfg.PasswordResetURL, token),
+	}
+	if err := s.notifier.Send(ctx, msg); err != nil {
+		// Not returned, as that would reveal that the account exists
+		slog.Error("Failed to send password reset", "user_id", user.ID, "error", err)
+	}
+	return nil
+}
+
+// ResetPassword sets a new password using a token from RequestPasswordReset
+// and signs the user out everywhere.
+func (s *UserService) ResetPassword(ctx context.Context, token, newPassword string) error {
+	var userID int64
+	err := s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		t, err := repo.GetPasswordResetTokenByHashForUpdate(ctx, hashToken(token))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidResetToken
+		}
+		if err != nil {
+			return err
+		}
+		if t.UsedAt != nil || time.Now().After(t.ExpiresAt) {
+			return ErrInvalidResetToken
+		}
+
+		userID = t.UserID
+		if err := s.setPassword(ctx, repo, userID, newPassword); err != nil {
+			return err
+		}
+		if err := repo.UsePasswordResetTokens(ctx, userID); err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   userID,
+			Action:     "password_reset",
+			Details:    fmt.Sprintf("reset_token: %d", t.ID),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return s.RevokeAllSessions(ctx, userID)
+}
+
+// ChangePassword replaces the password of a signed-in user who knows the
+// current one, and their MFA code if they have it enabled, then signs them out
+// everywhere. Failures are counted against the account and ip like failed
+// logins.
+func (s *UserService) ChangePassword(ctx context.Context, userID int64, currentPassword, code, newPassword, ip string) error {
+	if err := s.checkLoginAllowed(ctx, nil, ip); err != nil {
+		return err
+	}
+	if currentPassword == "" {
+		return fmt.Errorf("%w: your current password is required", ErrReauthFailed)
+	}
+	err := s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		if err := s.reauthenticate(ctx, repo, userID, currentPassword, code); err != nil {
+			return err
+		}
+		if err := s.setPassword(ctx, repo, userID, newPassword); err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   userID,
+			ActorID:    &userID,
+			Action:     "password_changed",
+		})
+	})
+	if errors.Is(err, ErrReauthFailed) || errors.Is(err, ErrAccountLocked) {
+		if ip != "" {
+			if _, err := s.attempts.Add(ctx, ipAttemptsKey(ip), s.cfg.Lockout.FailureWindow); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return s.RevokeAllSessions(ctx, userID)
+}
+
+// setPassword checks newPassword against the policy and stores its hash.
+func (s *UserService) setPassword(ctx context.Context, repo repository.Repository, userID int64, newPassword string) error {
+	user, err := repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := s.cfg.Password.Check(newPassword, user.Username, user.Email); err != nil {
+		return err
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return repo.UpdateUserPassword(ctx, userID, string(hashed))
+}
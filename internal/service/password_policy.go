@@ -0,0 +1,166 @@
+package service
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+var ErrWeakPassword = errors.New("password does not meet the password policy")
+
+// PasswordPolicy is checked whenever a user chooses a password.
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int // bcrypt ignores everything after 72 bytes
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	Breached      *BreachedPasswords // Optional
+}
+
+// PasswordViolation is one rule a password broke. Code is stable for clients.
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every rule a password broke.
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.Message
+	}
+	return fmt.Sprintf("%s: %s", ErrWeakPassword, strings.Join(msgs, "; "))
+}
+
+func (e *PasswordPolicyError) Unwrap() error {
+	return ErrWeakPassword
+}
+
+// Check returns a *PasswordPolicyError if password breaks any rule, or nil.
+func (p PasswordPolicy) Check(password, username, email string) error {
+	var violations []PasswordViolation
+	add := func(code, format string, args ...interface{}) {
+		violations = append(violations, PasswordViolation{Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if n := len([]rune(password)); n < p.MinLength {
+		add("too_short", "must be at least %d characters", p.MinLength)
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		add("too_long", "must be at most %d bytes", p.MaxLength)
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		add("missing_uppercase", "must contain an uppercase letter")
+	}
+	if p.RequireLower && !lower {
+		add("missing_lowercase", "must contain a lowercase letter")
+	}
+	if p.RequireDigit && !digit {
+		add("missing_digit", "must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		add("missing_symbol", "must contain a symbol")
+	}
+
+	lowered := strings.ToLower(password)
+	if len(username) >= 3 && strings.Contains(lowered, strings.ToLower(username)) {
+		add("contains_username", "must not contain the username")
+	}
+	local, _, _ := strings.Cut(email, "@")
+	if len(local) >= 3 && strings.Contains(lowered, strings.ToLower(local)) {
+		add("contains_email", "must not contain the email address")
+	}
+
+	if p.Breached != nil && p.Breached.Contains(password) {
+		add("breached", "has appeared in a data breach, choose a different one")
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// BreachedPasswords is a set of SHA-1 hashes of known breached passwords,
+// bucketed by the first five hex characters of the hash in the same way as
+// the Pwned Passwords range API.
+type BreachedPasswords struct {
+	buckets map[string]map[string]struct{}
+	count   int
+}
+
+// LoadBreachedPasswords reads a file with one uppercase or lowercase SHA-1 hex
+// hash per line, optionally followed by ":count" as in the Pwned Passwords
+// downloads. Blank lines and lines starting with # are ignored.
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := &BreachedPasswords{buckets: make(map[string]map[string]struct{})}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		hash, _, _ := strings.Cut(text, ":")
+		hash = strings.ToUpper(hash)
+		if len(hash) != sha1.Size*2 {
+			return nil, fmt.Errorf("%s:%d: not a SHA-1 hash", path, line)
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		bucket, ok := b.buckets[hash[:5]]
+		if !ok {
+			bucket = make(map[string]struct{})
+			b.buckets[hash[:5]] = bucket
+		}
+		bucket[hash[5:]] = struct{}{}
+		b.count++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Len returns the number of hashes loaded.
+func (b *BreachedPasswords) Len() int {
+	return b.count
+}
+
+func (b *BreachedPasswords) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	_, ok := b.buckets[hash[:5]][hash[5:]]
+	return ok
+}
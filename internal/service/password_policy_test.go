@@ -0,0 +1,54 @@
+package service
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	strict := PasswordPolicy{MinLength: 12, MaxLength: 72, RequireUpper: true, RequireLower: true, RequireDigit: true, RequireSymbol: true}
+
+	tests := []struct {
+		name     string
+		policy   PasswordPolicy
+		password string
+		username string
+		email    string
+		want     []string // Violation codes in order
+	}{
+		{"meets every rule", strict, "Correct-Horse-9", "alice", "alice@example.com", nil},
+		{"too short", strict, "Sh0rt!", "", "", []string{"too_short"}},
+		{"length counts characters not bytes", PasswordPolicy{MinLength: 4}, "ééé", "", "", []string{"too_short"}},
+		{"too long", strict, "Aa1!" + strings.Repeat("x", 69), "", "", []string{"too_long"}},
+		{"no max length", PasswordPolicy{}, strings.Repeat("x", 200), "", "", nil},
+		{"missing classes", strict, "alllowercaseletters", "", "", []string{"missing_uppercase", "missing_digit", "missing_symbol"}},
+		{"space counts as symbol", strict, "Correct Horse 9", "", "", nil},
+		{"contains username", strict, "My-ALICE-pass-9", "alice", "", []string{"contains_username"}},
+		{"short username ignored", strict, "Correct-Horse-9", "al", "", nil},
+		{"contains email local part", strict, "Bob.smith-pass-9", "", "bob.smith@example.com", []string{"contains_email"}},
+		{"several violations", strict, "alice", "alice", "", []string{"too_short", "missing_uppercase", "missing_digit", "missing_symbol", "contains_username"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Check(tt.password, tt.username, tt.email)
+			var got []string
+			if err != nil {
+				var pe *PasswordPolicyError
+				if !errors.As(err, &pe) {
+					t.Fatalf("Check() error = %T, want *PasswordPolicyError", err)
+				}
+				if !errors.Is(err, ErrWeakPassword) {
+					t.Errorf("Check() error does not wrap ErrWeakPassword")
+				}
+				for _, v := range pe.Violations {
+					got = append(got, v.Code)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Check() violations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"backend/internal/models"
+	"backend/internal/repository"
+)
+
+var (
+	ErrInvalidRole       = errors.New("invalid role")
+	ErrInvalidPermission = errors.New("invalid permission")
+)
+
+var roleName = regexp.MustCompile(`^[a-z][a-z0-9-]{0,49}$`)
+
+// How long role permissions are cached. Changes made on another instance
+// take effect within this time.
+const permissionCacheTTL = 30 * time.Second
+
+// PermissionService resolves what a role may do from the role permissions
+// stored in the database. Tokens only carry the role, so changes apply to
+// existing sessions too.
+type PermissionService struct {
+	repo repository.Repository
+
+	mu       sync.RWMutex
+	roles    map[string][]string // role -> permissions
+	loadedAt time.Time
+}
+
+func NewPermissionService(repo repository.Repository) *PermissionService {
+	return &PermissionService{repo: repo}
+}
+
+// HasPermission reports whether role grants perm. Unknown roles grant nothing.
+func (s *PermissionService) HasPermission(ctx context.Context, role, perm string) (bool, error) {
+	roles, err := s.load(ctx)
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(roles[role], perm), nil
+}
+
+// RoleExists reports whether role can be assigned to users.
+func (s *PermissionService) RoleExists(ctx context.Context, role string) (bool, error) {
+	roles, err := s.load(ctx)
+	if err != nil {
+		return false, err
+	}
+	_, ok := roles[role]
+	return ok, nil
+}
+
+// Covers reports whether role grants every permission other does.
+func (s *PermissionService) Covers(ctx context.Context, role, other string) (bool, error) {
+	roles, err := s.load(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range roles[other] {
+		if !slices.Contains(roles[role], p) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (s *PermissionService) ListRoles(ctx context.Context) ([]*models.Role, error) {
+	return s.repo.ListRoles(ctx)
+}
+
+// SaveRole creates a role or replaces its description and permissions. The
+// admin role must keep roles.manage so that roles can still be managed.
+func (s *PermissionService) SaveRole(ctx context.Context, actorID int64, name, description string, permissions []string) (*models.Role, error) {
+	if !roleName.MatchString(name) {
+		return nil, fmt.Errorf("%w: names use lowercase letters, digits and dashes", ErrInvalidRole)
+	}
+	for _, p := range permissions {
+		if !slices.Contains(models.Permissions, p) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidPermission, p)
+		}
+	}
+	if name == models.RoleAdmin && !slices.Contains(permissions, models.PermRolesManage) {
+		return nil, fmt.Errorf("%w: the admin role must keep %s", ErrInvalidPermission, models.PermRolesManage)
+	}
+	permissions = slices.Compact(slices.Sorted(slices.Values(permissions)))
+
+	role := &models.Role{Name: name, Description: description, Permissions: permissions}
+	err := s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		if err := repo.SaveRole(ctx, role); err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   actorID,
+			ActorID:    &actorID,
+			Action:     "role_saved",
+			Details:    fmt.Sprintf("role: %s, permissions: %s", name, strings.Join(permissions, " ")),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.loadedAt = time.Time{} // Reload on next use
+	s.mu.Unlock()
+	return role, nil
+}
+
+func (s *PermissionService) load(ctx context.Context) (map[string][]string, error) {
+	s.mu.RLock()
+	roles, fresh := s.roles, time.Since(s.loadedAt) < permissionCacheTTL
+	s.mu.RUnlock()
+	if fresh {
+		return roles, nil
+	}
+
+	list, err := s.repo.ListRoles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	roles = make(map[string][]string, len(list))
+	for _, r := range list {
+		roles[r.Name] = r.Permissions
+	}
+
+	s.mu.Lock()
+	s.roles = roles
+	s.loadedAt = time.Now()
+	s.mu.Unlock()
+	return roles, nil
+}
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
+// secretBox encrypts secrets stored in the database with a key derived from
+// AUTH_SECRET.
+type secretBox struct {
+	aead cipher.AEAD
+}
+
+func newSecretBox(secret string) *secretBox {
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err) // Only possible with an invalid key size
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &secretBox{aead: aead}
+}
+
+func (b *secretBox) seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return b.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (b *secretBox) open(ciphertext []byte) ([]byte, error) {
+	n := b.aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, errors.New("ciphertext too short")
+	}
+	return b.aead.Open(nil, ciphertext[:n], ciphertext[n:], nil)
+}
@@ -0,0 +1,574 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"backend/internal/models"
+	"backend/internal/repository"
+)
+
+var (
+	ErrInvalidStandingOrder   = errors.New("invalid standing order")
+	ErrStandingOrderNotActive = errors.New("standing order is no longer active")
+	ErrPaymentFailed          = errors.New("payment failed")
+)
+
+const (
+	maxStandingOrderDescriptionLength = 255
+	// standingOrderLease is how long an instance has to run a due order
+	// before another instance may take it over.
+	standingOrderLease = 5 * time.Minute
+	standingOrderBatch = 100
+)
+
+type StandingOrderConfig struct {
+	// A payment the account cannot cover is retried every RetryInterval, up
+	// to MaxRetries times, before it is skipped. Orders set to skip do not
+	// retry.
+	RetryInterval time.Duration
+	MaxRetries    int
+}
+
+// StandingOrderService stores users' standing orders and submits their
+// payments through TransactionService as they fall due.
+type StandingOrderService struct {
+	repo    repository.Repository
+	txSvc   *TransactionService
+	userSvc *UserService
+	cfg     StandingOrderConfig
+}
+
+func NewStandingOrderService(repo repository.Repository, txSvc *TransactionService, userSvc *UserService, cfg StandingOrderConfig) *StandingOrderService {
+	return &StandingOrderService{
+		repo:    repo,
+		txSvc:   txSvc,
+		userSvc: userSvc,
+		cfg:     cfg,
+	}
+}
+
+// StandingOrderRequest describes a standing order to set up. The source is
+// one of the user's accounts, the default one if not given; the destination
+// is given as for a transfer. Orders large enough to need step-up
+// authentication need the user's Password or a TOTP Code.
+type StandingOrderRequest struct {
+	FromAccountID       *int64
+	ToUserID            *int64
+	ToAccountID         *int64
+	Amount              int64
+	Description         string
+	Frequency           string
+	StartDate           time.Time
+	EndDate             *time.Time
+	OnInsufficientFunds string // Defaults to retry
+	Password            string
+	Code                string
+}
+
+// StandingOrderUpdate changes the terms of a standing order. Nil fields are
+// left as they are; ClearEndDate makes a recurring order run indefinitely.
+type StandingOrderUpdate struct {
+	Amount              *int64
+	Description         *string
+	EndDate             *time.Time
+	ClearEndDate        bool
+	OnInsufficientFunds *string
+	Password            string
+	Code                string
+}
+
+func (s *StandingOrderService) List(ctx context.Context, userID int64) ([]*models.StandingOrder, error) {
+	orders, err := s.repo.ListStandingOrdersByUserID(ctx, userID)
+	if orders == nil {
+		orders = []*models.StandingOrder{}
+	}
+	return orders, err
+}
+
+// Create sets up a standing order for userID. The first payment is due on
+// StartDate, which may be today.
+func (s *StandingOrderService) Create(ctx context.Context, userID int64, req StandingOrderRequest) (*models.StandingOrder, error) {
+	if req.Amount <= 0 {
+		return nil, fmt.Errorf("%w: amount must be positive", ErrInvalidStandingOrder)
+	}
+	description, err := standingOrderDescription(req.Description)
+	if err != nil {
+		return nil, err
+	}
+	switch req.Frequency {
+	case models.FrequencyOnce, models.FrequencyDaily, models.FrequencyWeekly, models.FrequencyMonthly:
+	default:
+		return nil, fmt.Errorf("%w: frequency must be once, daily, weekly or monthly", ErrInvalidStandingOrder)
+	}
+	onInsufficientFunds, err := insufficientFundsRule(req.OnInsufficientFunds)
+	if err != nil {
+		return nil, err
+	}
+	start := civilDate(req.StartDate)
+	if start.Before(civilDate(time.Now())) {
+		return nil, fmt.Errorf("%w: start_date cannot be in the past", ErrInvalidStandingOrder)
+	}
+	var end *time.Time
+	if req.EndDate != nil {
+		if end, err = endDate(req.Frequency, start, *req.EndDate); err != nil {
+			return nil, err
+		}
+	}
+	if req.ToUserID == nil && req.ToAccountID == nil {
+		return nil, fmt.Errorf("%w: to_user_id or to_account_id is required", ErrInvalidStandingOrder)
+	}
+
+	txReq, err := s.txSvc.prepare(ctx, Actor{UserID: userID}, TransactionRequest{
+		Type:          models.TxTypeTransfer,
+		Amount:        req.Amount,
+		FromAccountID: req.FromAccountID,
+		ToUserID:      req.ToUserID,
+		ToAccountID:   req.ToAccountID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if *txReq.ToAccountID == *txReq.FromAccountID {
+		return nil, fmt.Errorf("%w: cannot pay into the account paying out", ErrInvalidStandingOrder)
+	}
+	if err := s.txSvc.requireVerifiedSender(ctx, txReq.FromUserID); err != nil {
+		return nil, err
+	}
+	if err := s.txSvc.checkParties(ctx, txReq.FromUserID, txReq.ToUserID); err != nil {
+		return nil, err
+	}
+
+	order := &models.StandingOrder{
+		UserID:              userID,
+		FromAccountID:       *txReq.FromAccountID,
+		ToUserID:            *txReq.ToUserID,
+		ToAccountID:         *txReq.ToAccountID,
+		Amount:              req.Amount,
+		Description:         description,
+		Frequency:           req.Frequency,
+		StartDate:           start,
+		EndDate:             end,
+		OnInsufficientFunds: onInsufficientFunds,
+		Status:              models.StandingOrderStatusActive,
+		NextRunDate:         start,
+		NextAttemptAt:       start,
+	}
+	err = s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		if err := s.stepUp(ctx, repo, userID, order.FromAccountID, order.Amount, req.Password, req.Code); err != nil {
+			return err
+		}
+		if err := repo.CreateStandingOrder(ctx, order); err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   userID,
+			ActorID:    &userID,
+			Action:     "standing_order_created",
+			Details: fmt.Sprintf("standing_order_id: %d, %s from %s, amount: %d, from_account_id: %d, to_account_id: %d",
+				order.ID, order.Frequency, order.StartDate.Format(time.DateOnly), order.Amount, order.FromAccountID, order.ToAccountID),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// Update changes the terms of one of the user's active standing orders.
+// Raising the amount to one that needs step-up authentication needs the
+// user's password or a TOTP code. Moving the end date before the next
+// payment completes the order. Other users' orders are reported as
+// sql.ErrNoRows.
+func (s *StandingOrderService) Update(ctx context.Context, userID, orderID int64, req StandingOrderUpdate) (*models.StandingOrder, error) {
+	var order *models.StandingOrder
+	err := s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		var err error
+		order, err = activeStandingOrder(ctx, repo, userID, orderID)
+		if err != nil {
+			return err
+		}
+
+		var changes []string
+		if req.Amount != nil && *req.Amount != order.Amount {
+			if *req.Amount <= 0 {
+				return fmt.Errorf("%w: amount must be positive", ErrInvalidStandingOrder)
+			}
+			if *req.Amount > order.Amount {
+				if err := s.stepUp(ctx, repo, userID, order.FromAccountID, *req.Amount, req.Password, req.Code); err != nil {
+					return err
+				}
+			}
+			changes = append(changes, fmt.Sprintf("amount: %d -> %d", order.Amount, *req.Amount))
+			order.Amount = *req.Amount
+		}
+		if req.Description != nil {
+			if order.Description, err = standingOrderDescription(*req.Description); err != nil {
+				return err
+			}
+			changes = append(changes, "description")
+		}
+		if req.OnInsufficientFunds != nil {
+			if order.OnInsufficientFunds, err = insufficientFundsRule(*req.OnInsufficientFunds); err != nil {
+				return err
+			}
+			changes = append(changes, "on_insufficient_funds: "+order.OnInsufficientFunds)
+		}
+		switch {
+		case req.ClearEndDate:
+			if order.Frequency == models.FrequencyOnce {
+				return fmt.Errorf("%w: one-off orders have no end_date", ErrInvalidStandingOrder)
+			}
+			order.EndDate = nil
+			changes = append(changes, "end_date: none")
+		case req.EndDate != nil:
+			if order.EndDate, err = endDate(order.Frequency, order.StartDate, *req.EndDate); err != nil {
+				return err
+			}
+			changes = append(changes, "end_date: "+order.EndDate.Format(time.DateOnly))
+			if order.EndDate.Before(order.NextRunDate) {
+				order.Status = models.StandingOrderStatusCompleted
+			}
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+
+		if err := repo.UpdateStandingOrder(ctx, order); err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   userID,
+			ActorID:    &userID,
+			Action:     "standing_order_updated",
+			Details:    fmt.Sprintf("standing_order_id: %d, %s", order.ID, strings.Join(changes, ", ")),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// Cancel stops one of the user's active standing orders. A payment already
+// submitted is not affected.
+func (s *StandingOrderService) Cancel(ctx context.Context, userID, orderID int64) (*models.StandingOrder, error) {
+	var order *models.StandingOrder
+	err := s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		var err error
+		order, err = activeStandingOrder(ctx, repo, userID, orderID)
+		if err != nil {
+			return err
+		}
+		order.Status = models.StandingOrderStatusCancelled
+		if err := repo.UpdateStandingOrder(ctx, order); err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   userID,
+			ActorID:    &userID,
+			Action:     "standing_order_cancelled",
+			Details:    fmt.Sprintf("standing_order_id: %d", order.ID),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// activeStandingOrder locks the order, which must belong to userID and still
+// be active.
+func activeStandingOrder(ctx context.Context, repo repository.Repository, userID, orderID int64) (*models.StandingOrder, error) {
+	order, err := repo.GetStandingOrderByIDForUpdate(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if order.UserID != userID {
+		return nil, sql.ErrNoRows
+	}
+	if order.Status != models.StandingOrderStatusActive {
+		return nil, ErrStandingOrderNotActive
+	}
+	return order, nil
+}
+
+// stepUp re-authenticates the user if amount, paid from fromAccountID, is
+// large enough to need it. The payments of the order are then made without
+// asking again.
+func (s *StandingOrderService) stepUp(ctx context.Context, repo repository.Repository, userID, fromAccountID, amount int64, password, code string) error {
+	account, err := repo.GetAccountByID(ctx, fromAccountID)
+	if err != nil {
+		return err
+	}
+	required, err := s.txSvc.requiresStepUp(ctx, models.TxTypeTransfer, amount, account.Currency)
+	if err != nil || !required {
+		return err
+	}
+	if password == "" && code == "" {
+		return fmt.Errorf("%w: a password or code is required for standing orders of this amount", ErrReauthFailed)
+	}
+	return s.userSvc.reauthenticate(ctx, repo, userID, password, code)
+}
+
+// Run submits the payments of standing orders as they fall due, checking
+// every interval until ctx is cancelled. Several instances can run it at
+// once; each due order is leased to one of them.
+func (s *StandingOrderService) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, err := s.runDue(ctx)
+			if err != nil {
+				slog.Error("Failed to run standing orders", "error", err)
+			} else if n > 0 {
+				slog.Info("Ran standing orders", "count", n)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *StandingOrderService) runDue(ctx context.Context) (int, error) {
+	orders, err := s.repo.ClaimDueStandingOrders(ctx, standingOrderLease, standingOrderBatch)
+	if err != nil {
+		return 0, err
+	}
+	for _, order := range orders {
+		// The lease runs out on failure, so the order is tried again later
+		if err := s.run(ctx, order); err != nil {
+			slog.Error("Failed to run standing order", "standing_order_id", order.ID, "error", err)
+		}
+	}
+	return len(orders), nil
+}
+
+// run makes the payment the order has due. It is submitted through
+// TransactionService like any transfer of the user's, under an idempotency
+// key for the payment date and attempt so that an order run twice pays only
+// once, and posted straight away rather than left to the worker pool. The
+// order only moves on once the transaction has completed; if the run fails
+// midway, the lease runs out and the next run picks up the same transaction,
+// even if the order's amount has been changed since.
+func (s *StandingOrderService) run(ctx context.Context, order *models.StandingOrder) error {
+	now := time.Now()
+	order.LastRunAt = &now
+	due := order.NextRunDate
+
+	balance, err := s.repo.GetBalanceByAccountID(ctx, order.FromAccountID)
+	if err != nil {
+		return err
+	}
+	if balance.Available < order.Amount {
+		return s.insufficientFunds(ctx, order, now, ErrInsufficientFunds)
+	}
+
+	key := fmt.Sprintf("standing-order:%d:%s", order.ID, due.Format(time.DateOnly))
+	if order.Attempts > 0 {
+		// A failed transaction would otherwise be replayed on every retry
+		key += fmt.Sprintf(":%d", order.Attempts)
+	}
+	tx, _, err := s.txSvc.CreateIdempotent(ctx, Actor{UserID: order.UserID, Preauthorized: true}, key, TransactionRequest{
+		Type:          models.TxTypeTransfer,
+		Amount:        order.Amount,
+		FromUserID:    &order.UserID,
+		ToUserID:      &order.ToUserID,
+		FromAccountID: &order.FromAccountID,
+		ToAccountID:   &order.ToAccountID,
+	})
+	if errors.Is(err, ErrIdempotencyConflict) {
+		tx, err = s.submitted(ctx, order.UserID, key)
+	}
+	if err == nil {
+		err = s.post(ctx, tx)
+	}
+	switch {
+	case err == nil:
+		order.LastTransactionID, order.LastError = &tx.ID, ""
+		s.advance(order)
+		return s.record(ctx, order, due, "standing_order_paid", fmt.Sprintf("transaction_id: %d", tx.ID))
+	case errors.Is(err, ErrInsufficientFunds), errors.Is(err, ErrPaymentFailed):
+		if tx != nil {
+			order.LastTransactionID = &tx.ID
+		}
+		return s.insufficientFunds(ctx, order, now, err)
+	case errors.Is(err, ErrAccountClosed):
+		order.Status, order.LastError = models.StandingOrderStatusCancelled, err.Error()
+		return s.record(ctx, order, due, "standing_order_cancelled", "reason: "+err.Error())
+	case isBusinessError(err), errors.Is(err, ErrForbidden), errors.Is(err, ErrEmailNotVerified),
+		errors.Is(err, ErrFXRateUnavailable), errors.Is(err, ErrUnsupportedCurrency):
+		order.LastError = err.Error()
+		s.advance(order)
+		return s.record(ctx, order, due, "standing_order_skipped", "reason: "+err.Error())
+	default:
+		return err
+	}
+}
+
+// submitted returns the transaction an earlier run submitted under key, for
+// an amount the order no longer has.
+func (s *StandingOrderService) submitted(ctx context.Context, userID int64, key string) (*models.Transaction, error) {
+	k, err := s.repo.GetIdempotencyKey(ctx, userID, key)
+	if err != nil {
+		return nil, err
+	}
+	if k.TransactionID == nil {
+		return nil, fmt.Errorf("idempotency key %q has no transaction", key)
+	}
+	return s.repo.GetTransactionByID(ctx, *k.TransactionID)
+}
+
+// post processes the submitted transaction, unless the worker pool already
+// has, and reports why it failed. The reason for transactions the pool
+// failed is not kept, so the accounts are checked again: closed, frozen or
+// suspended accounts are reported as such, anything else as
+// ErrPaymentFailed.
+func (s *StandingOrderService) post(ctx context.Context, tx *models.Transaction) error {
+	if err := s.txSvc.ProcessTransaction(ctx, tx); err != nil {
+		return err
+	}
+	current, err := s.repo.GetTransactionByID(ctx, tx.ID)
+	if err != nil {
+		return err
+	}
+	switch current.Status {
+	case models.TxStatusCompleted:
+		return nil
+	case models.TxStatusFailed:
+		if err := checkAccount(ctx, s.repo, *current.FromAccountID, *current.FromUserID, current.Currency, -current.Amount); err != nil {
+			return err
+		}
+		if err := checkAccount(ctx, s.repo, *current.ToAccountID, *current.ToUserID, current.ToCurrency, current.ToAmount); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: transaction %d failed", ErrPaymentFailed, tx.ID)
+	default:
+		return fmt.Errorf("transaction %d is %s", tx.ID, current.Status)
+	}
+}
+
+// insufficientFunds retries the payment later if the order allows it and
+// the retry comes before the following payment, and skips it otherwise.
+// reason is why the payment could not be made.
+func (s *StandingOrderService) insufficientFunds(ctx context.Context, order *models.StandingOrder, now time.Time, reason error) error {
+	due := order.NextRunDate
+	order.LastError = reason.Error()
+	if order.OnInsufficientFunds == models.InsufficientFundsRetry && order.Attempts < s.cfg.MaxRetries {
+		retryAt := now.Add(s.cfg.RetryInterval)
+		if next, ok := nextRunDate(order, order.RunCount+1); !ok || retryAt.Before(next) {
+			order.Attempts++
+			order.NextAttemptAt = retryAt
+			return s.record(ctx, order, due, "standing_order_retry_scheduled",
+				fmt.Sprintf("reason: %s, attempt: %d, retry_at: %s", order.LastError, order.Attempts, retryAt.UTC().Format(time.RFC3339)))
+		}
+	}
+	s.advance(order)
+	return s.record(ctx, order, due, "standing_order_skipped", "reason: "+order.LastError)
+}
+
+// advance moves the order on to its next payment, completing it if there
+// is none.
+func (s *StandingOrderService) advance(order *models.StandingOrder) {
+	order.RunCount++
+	order.Attempts = 0
+	next, ok := nextRunDate(order, order.RunCount)
+	if !ok {
+		order.Status = models.StandingOrderStatusCompleted
+		return
+	}
+	order.NextRunDate, order.NextAttemptAt = next, next
+}
+
+// record saves the outcome of a run for the payment due on due, releasing
+// the order's lease.
+func (s *StandingOrderService) record(ctx context.Context, order *models.StandingOrder, due time.Time, action, details string) error {
+	return s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		if err := repo.SaveStandingOrderRun(ctx, order); err != nil {
+			return err
+		}
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   order.UserID,
+			Action:     action,
+			Details:    fmt.Sprintf("standing_order_id: %d, payment_date: %s, %s", order.ID, due.Format(time.DateOnly), details),
+		})
+	})
+}
+
+// nextRunDate returns the date of payment n of the order, counting from 0,
+// and false if the order makes no such payment.
+func nextRunDate(order *models.StandingOrder, n int) (time.Time, bool) {
+	start := order.StartDate
+	var date time.Time
+	switch order.Frequency {
+	case models.FrequencyDaily:
+		date = start.AddDate(0, 0, n)
+	case models.FrequencyWeekly:
+		date = start.AddDate(0, 0, 7*n)
+	case models.FrequencyMonthly:
+		// Clamped to the end of shorter months rather than overflowing
+		// into the next one, always counting from the start date
+		year, month := start.Year(), start.Month()+time.Month(n)
+		day := start.Day()
+		if last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day(); day > last {
+			day = last
+		}
+		date = time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	default:
+		if n > 0 {
+			return time.Time{}, false
+		}
+		date = start
+	}
+	if order.EndDate != nil && date.After(*order.EndDate) {
+		return time.Time{}, false
+	}
+	return date, true
+}
+
+func standingOrderDescription(description string) (string, error) {
+	description = strings.TrimSpace(description)
+	if len(description) > maxStandingOrderDescriptionLength {
+		return "", fmt.Errorf("%w: descriptions are at most %d characters", ErrInvalidStandingOrder, maxStandingOrderDescriptionLength)
+	}
+	return description, nil
+}
+
+func insufficientFundsRule(rule string) (string, error) {
+	switch rule {
+	case "":
+		return models.InsufficientFundsRetry, nil
+	case models.InsufficientFundsRetry, models.InsufficientFundsSkip:
+		return rule, nil
+	default:
+		return "", fmt.Errorf("%w: on_insufficient_funds must be retry or skip", ErrInvalidStandingOrder)
+	}
+}
+
+func endDate(frequency string, start, end time.Time) (*time.Time, error) {
+	if frequency == models.FrequencyOnce {
+		return nil, fmt.Errorf("%w: one-off orders have no end_date", ErrInvalidStandingOrder)
+	}
+	end = civilDate(end)
+	if end.Before(start) {
+		return nil, fmt.Errorf("%w: end_date cannot be before start_date", ErrInvalidStandingOrder)
+	}
+	return &end, nil
+}
+
+// civilDate returns midnight UTC on the day of t in UTC.
+func civilDate(t time.Time) time.Time {
+	year, month, day := t.UTC().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"backend/internal/models"
+)
+
+func TestNextRunDate(t *testing.T) {
+	date := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	endDate := func(s string) *time.Time {
+		d := date(s)
+		return &d
+	}
+
+	tests := []struct {
+		name      string
+		frequency string
+		start     string
+		end       *time.Time
+		want      []string // Dates for n = 0, 1, ... until the schedule ends
+		more      bool     // Whether the schedule continues after want
+	}{
+		{"once", models.FrequencyOnce, "2026-03-15", nil, []string{"2026-03-15"}, false},
+		{"daily across month end", models.FrequencyDaily, "2026-02-27", endDate("2026-03-02"), []string{"2026-02-27", "2026-02-28", "2026-03-01", "2026-03-02"}, false},
+		{"weekly", models.FrequencyWeekly, "2026-12-24", nil, []string{"2026-12-24", "2026-12-31", "2027-01-07"}, true},
+		{"monthly clamps to month end", models.FrequencyMonthly, "2026-10-31", endDate("2027-03-31"),
+			[]string{"2026-10-31", "2026-11-30", "2026-12-31", "2027-01-31", "2027-02-28", "2027-03-31"}, false},
+		{"monthly leap year", models.FrequencyMonthly, "2028-01-30", nil, []string{"2028-01-30", "2028-02-29", "2028-03-30"}, true},
+		{"monthly mid month", models.FrequencyMonthly, "2026-01-15", endDate("2026-03-14"), []string{"2026-01-15", "2026-02-15"}, false},
+		{"end date inclusive", models.FrequencyDaily, "2026-05-01", endDate("2026-05-01"), []string{"2026-05-01"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := &models.StandingOrder{Frequency: tt.frequency, StartDate: date(tt.start), EndDate: tt.end}
+			for n, want := range tt.want {
+				got, ok := nextRunDate(order, n)
+				if !ok || !got.Equal(date(want)) {
+					t.Fatalf("nextRunDate(%d) = (%s, %v), want (%s, true)", n, got.Format("2006-01-02"), ok, want)
+				}
+			}
+			if _, ok := nextRunDate(order, len(tt.want)); ok != tt.more {
+				t.Errorf("nextRunDate(%d) ok = %v, want %v", len(tt.want), ok, tt.more)
+			}
+		})
+	}
+}
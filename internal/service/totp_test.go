@@ -0,0 +1,58 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors from RFC 6238 appendix B, truncated to six digits.
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+var rfc6238Secret = []byte("12345678901234567890")
+
+func TestTOTPCode(t *testing.T) {
+	for _, tt := range rfc6238Vectors {
+		t.Run(tt.code, func(t *testing.T) {
+			if got := totpCode(rfc6238Secret, tt.unix/totpPeriod); got != tt.code {
+				t.Errorf("totpCode() at %d = %s, want %s", tt.unix, got, tt.code)
+			}
+		})
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", "050471", step, true},
+		{"previous step", totpCode(rfc6238Secret, step-1), step - 1, true},
+		{"next step", totpCode(rfc6238Secret, step+1), step + 1, true},
+		{"outside skew", totpCode(rfc6238Secret, step-totpSkew-1), 0, false},
+		{"wrong code", "000000", 0, false},
+		{"empty", "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, ok := matchTOTP(rfc6238Secret, tt.code, now)
+			if ok != tt.wantOK || gotStep != tt.wantStep {
+				t.Errorf("matchTOTP() = (%d, %v), want (%d, %v)", gotStep, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
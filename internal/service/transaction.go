@@ -2,22 +2,74 @@ package service
 
 import (
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
 	"backend/internal/models"
 	"backend/internal/repository"
 	"backend/internal/worker"
 )
 
+var (
+	ErrTransactionNotPending   = errors.New("transaction is no longer pending")
+	ErrIdempotencyConflict     = errors.New("idempotency key was already used with a different request")
+	ErrForbidden               = errors.New("forbidden")
+	ErrNotAwaitingConfirmation = errors.New("transaction is not awaiting confirmation")
+	ErrConfirmationExpired     = errors.New("confirmation window has expired")
+)
+
+// Actor is the authenticated caller creating a transaction. Admins may set
+// OnBehalfOf, together with a Reason, to debit another user's account; every
+// such transaction is audited. Preauthorized skips step-up authentication,
+// for transactions the user re-authenticated for in advance, such as the
+// payments of a standing order.
+type Actor struct {
+	UserID        int64
+	Role          string
+	OnBehalfOf    *int64
+	Reason        string
+	Preauthorized bool
+}
+
+type TransactionConfig struct {
+	IdempotencyTTL time.Duration
+	// Transfers and withdrawals of at least StepUpThreshold, in minor units
+	// of StepUpCurrency, wait for the creator to re-authenticate, for up to
+	// StepUpTTL. Zero disables this.
+	StepUpThreshold int64
+	StepUpCurrency  string
+	StepUpTTL       time.Duration
+	// Holds expire after HoldTTL unless given an expiry, which may be at
+	// most HoldMaxTTL away.
+	HoldTTL    time.Duration
+	HoldMaxTTL time.Duration
+}
+
 type TransactionService struct {
-	repo       repository.TransactionRepository
+	repo       repository.Repository
 	balanceSvc *BalanceService
+	userSvc    *UserService
+	perms      *PermissionService
+	fx         *FXService
 	pool       *worker.Pool
+	cfg        TransactionConfig
 }
 
-func NewTransactionService(repo repository.TransactionRepository, balanceSvc *BalanceService) *TransactionService {
+func NewTransactionService(repo repository.Repository, balanceSvc *BalanceService, userSvc *UserService, perms *PermissionService, fx *FXService, cfg TransactionConfig) *TransactionService {
 	return &TransactionService{
 		repo:       repo,
 		balanceSvc: balanceSvc,
+		userSvc:    userSvc,
+		perms:      perms,
+		fx:         fx,
+		cfg:        cfg,
 	}
 }
 
@@ -29,69 +81,574 @@ func (s *TransactionService) GetHistory(ctx context.Context, userID int64) ([]*m
 	return s.repo.GetTransactionsByUserID(ctx, userID)
 }
 
+// GetRecent returns the user's latest transactions, newest first.
+func (s *TransactionService) GetRecent(ctx context.Context, userID int64, limit int) ([]*models.Transaction, error) {
+	return s.repo.GetRecentTransactionsByUserID(ctx, userID, limit)
+}
 
-func (s *TransactionService) Create(ctx context.Context, fromID, toID *int64, amount int64, typeStr string) (*models.Transaction, error) {
-	tx := &models.Transaction{
-		FromUserID: fromID,
-		ToUserID:   toID,
-		Amount:     amount,
-		Type:       typeStr,
-		Status:     models.TxStatusPending,
+// TransactionRequest describes a transaction to create. Each side can be
+// given as a user, an account or both; a user without an account means the
+// user's default account.
+type TransactionRequest struct {
+	Type          string
+	Amount        int64
+	FromUserID    *int64
+	ToUserID      *int64
+	FromAccountID *int64
+	ToAccountID   *int64
+}
+
+func (s *TransactionService) Create(ctx context.Context, actor Actor, req TransactionRequest) (*models.Transaction, error) {
+	req, err := s.prepare(ctx, actor, req)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := s.repo.CreateTransaction(ctx, tx); err != nil {
+	if err := s.requireVerifiedSender(ctx, req.FromUserID); err != nil {
+		return nil, err
+	}
+	if err := s.checkParties(ctx, req.FromUserID, req.ToUserID); err != nil {
 		return nil, err
 	}
 
-	if s.pool != nil {
-		s.pool.Submit(tx)
-	} else {
-		return nil, errors.New("worker pool not initialized")
+	tx, err := s.newTransaction(ctx, actor, req)
+	if err != nil {
+		return nil, err
+	}
+	err = s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		return s.insert(ctx, repo, actor, tx)
+	})
+	if err != nil {
+		return nil, err
 	}
 
+	s.notify()
 	return tx, nil
 }
 
-func (s *TransactionService) ProcessTransaction(ctx context.Context, tx *models.Transaction) error {
+// CreateIdempotent behaves like Create, except that a repeated call with the
+// same actor and key within the retention window returns the originally created
+// transaction instead of creating a new one. replayed reports whether that
+// happened. Reusing a key for a different request returns ErrIdempotencyConflict.
+func (s *TransactionService) CreateIdempotent(ctx context.Context, actor Actor, key string, req TransactionRequest) (tx *models.Transaction, replayed bool, err error) {
+	namesAccounts := req.FromAccountID != nil || req.ToAccountID != nil
+	req, err = s.prepare(ctx, actor, req)
+	if err != nil {
+		return nil, false, err
+	}
+	userID := actor.UserID
+	fingerprint := requestFingerprint(req, namesAccounts)
+
+	if tx, err := s.replay(ctx, userID, key, fingerprint); err == nil || !errors.Is(err, sql.ErrNoRows) {
+		return tx, err == nil, err
+	}
+
+	if err := s.requireVerifiedSender(ctx, req.FromUserID); err != nil {
+		return nil, false, err
+	}
+	if err := s.checkParties(ctx, req.FromUserID, req.ToUserID); err != nil {
+		return nil, false, err
+	}
+
+	tx, err = s.newTransaction(ctx, actor, req)
+	if err != nil {
+		return nil, false, err
+	}
+	err = s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		if err := s.insert(ctx, repo, actor, tx); err != nil {
+			return err
+		}
+		body, err := json.Marshal(tx)
+		if err != nil {
+			return err
+		}
+		return repo.CreateIdempotencyKey(ctx, &models.IdempotencyKey{
+			UserID:        userID,
+			Key:           key,
+			RequestHash:   fingerprint,
+			TransactionID: &tx.ID,
+			ResponseBody:  string(body),
+			ExpiresAt:     time.Now().Add(s.cfg.IdempotencyTTL),
+		})
+	})
+	if errors.Is(err, repository.ErrDuplicate) {
+		// A concurrent request with the same key got there first
+		tx, err := s.replay(ctx, userID, key, fingerprint)
+		return tx, err == nil, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	s.notify()
+	return tx, false, nil
+}
+
+// requireVerifiedSender stops money leaving the account of a user who has not
+// verified their email address.
+func (s *TransactionService) requireVerifiedSender(ctx context.Context, fromID *int64) error {
+	if fromID == nil {
+		return nil
+	}
+	err := s.userSvc.RequireVerified(ctx, *fromID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: unknown from_user", ErrInvalidTransaction)
+	}
+	return err
+}
+
+// checkParties rejects transactions that a closed, frozen or suspended
+// account could not take part in. They are checked again when the
+// transaction is processed, as the state may change in between.
+func (s *TransactionService) checkParties(ctx context.Context, fromID, toID *int64) error {
+	parties := []struct {
+		id    *int64
+		delta int64
+	}{{fromID, -1}, {toID, 1}}
+	for _, p := range parties {
+		if p.id == nil {
+			continue
+		}
+		user, err := s.repo.GetUserByID(ctx, *p.id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: unknown user", ErrInvalidTransaction)
+		}
+		if err != nil {
+			return err
+		}
+		if err := checkMovement(user, p.delta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepare authorizes req for actor, filling in the owners of the accounts
+// given and the default accounts of the users given without one.
+func (s *TransactionService) prepare(ctx context.Context, actor Actor, req TransactionRequest) (TransactionRequest, error) {
 	var err error
+	if req.FromUserID, err = s.accountOwner(ctx, "from", req.FromAccountID, req.FromUserID); err != nil {
+		return req, err
+	}
+	if req.ToUserID, err = s.accountOwner(ctx, "to", req.ToAccountID, req.ToUserID); err != nil {
+		return req, err
+	}
+	req.FromUserID, req.ToUserID, err = s.authorize(ctx, actor, req.Type, req.FromUserID, req.ToUserID)
+	if err != nil {
+		return req, err
+	}
+	if req.FromAccountID, err = s.defaultAccount(ctx, "from", req.FromUserID, req.FromAccountID); err != nil {
+		return req, err
+	}
+	if req.ToAccountID, err = s.defaultAccount(ctx, "to", req.ToUserID, req.ToAccountID); err != nil {
+		return req, err
+	}
+	return req, nil
+}
+
+// accountOwner returns the owner of accountID, which must be userID if that
+// is given too. With no account, userID is returned as is.
+func (s *TransactionService) accountOwner(ctx context.Context, side string, accountID, userID *int64) (*int64, error) {
+	if accountID == nil {
+		return userID, nil
+	}
+	account, err := s.repo.GetAccountByID(ctx, *accountID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: unknown %s_account", ErrInvalidTransaction, side)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if userID != nil && *userID != account.UserID {
+		return nil, fmt.Errorf("%w: %s_account does not belong to %s_user", ErrInvalidTransaction, side, side)
+	}
+	if account.Status == models.AccountStatusClosed {
+		return nil, fmt.Errorf("%w: %s_account", ErrAccountClosed, side)
+	}
+	return &account.UserID, nil
+}
+
+// defaultAccount returns accountID, or the default account of userID if no
+// account was given.
+func (s *TransactionService) defaultAccount(ctx context.Context, side string, userID, accountID *int64) (*int64, error) {
+	if userID == nil || accountID != nil {
+		return accountID, nil
+	}
+	account, err := s.repo.GetDefaultAccount(ctx, *userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: unknown %s_user", ErrInvalidTransaction, side)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if account.Status == models.AccountStatusClosed {
+		return nil, fmt.Errorf("%w: %s_account", ErrAccountClosed, side)
+	}
+	return &account.ID, nil
+}
 
-	switch tx.Type {
+// newTransaction builds a transaction, holding it for confirmation if it is
+// large enough to need step-up authentication.
+func (s *TransactionService) newTransaction(ctx context.Context, actor Actor, req TransactionRequest) (*models.Transaction, error) {
+	tx := &models.Transaction{
+		FromUserID:    req.FromUserID,
+		ToUserID:      req.ToUserID,
+		FromAccountID: req.FromAccountID,
+		ToAccountID:   req.ToAccountID,
+		Amount:        req.Amount,
+		Type:          req.Type,
+		Status:        models.TxStatusPending,
+		CreatedBy:     &actor.UserID,
+	}
+	if err := s.price(ctx, s.repo, tx); err != nil {
+		return nil, err
+	}
+	if !actor.Preauthorized {
+		stepUp, err := s.requiresStepUp(ctx, req.Type, req.Amount, tx.Currency)
+		if err != nil {
+			return nil, err
+		}
+		if stepUp {
+			expiresAt := time.Now().Add(s.cfg.StepUpTTL)
+			tx.Status = models.TxStatusRequiresConfirmation
+			tx.ConfirmationExpiresAt = &expiresAt
+		}
+	}
+	return tx, nil
+}
+
+// price sets the currencies of tx from its accounts and, for a transfer
+// between currencies, converts Amount into ToAmount at the current rate.
+func (s *TransactionService) price(ctx context.Context, repo repository.Repository, tx *models.Transaction) error {
+	currency := func(accountID *int64) (string, error) {
+		if accountID == nil {
+			return "", nil
+		}
+		account, err := repo.GetAccountByID(ctx, *accountID)
+		if err != nil {
+			return "", err
+		}
+		return account.Currency, nil
+	}
+	from, err := currency(tx.FromAccountID)
+	if err != nil {
+		return err
+	}
+	to, err := currency(tx.ToAccountID)
+	if err != nil {
+		return err
+	}
+	if from == "" {
+		from = to
+	}
+	if to == "" {
+		to = from
+	}
+
+	toAmount, rate, err := s.fx.Convert(ctx, tx.Amount, from, to)
+	if err != nil {
+		return err
+	}
+	tx.Currency, tx.ToCurrency, tx.ToAmount, tx.FXRate = from, to, toAmount, rate
+	return nil
+}
+
+// requiresStepUp reports whether a transaction of amount in currency needs
+// the creator to re-authenticate. The threshold is converted into currency
+// at the current rate; without a rate, step-up is always required.
+func (s *TransactionService) requiresStepUp(ctx context.Context, typeStr string, amount int64, currency string) (bool, error) {
+	if s.cfg.StepUpThreshold <= 0 || (typeStr != models.TxTypeTransfer && typeStr != models.TxTypeWithdraw) {
+		return false, nil
+	}
+	threshold, _, err := s.fx.Convert(ctx, s.cfg.StepUpThreshold, s.cfg.StepUpCurrency, currency)
+	if errors.Is(err, ErrFXRateUnavailable) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return amount >= threshold, nil
+}
+
+// insert creates tx and queues it for processing, unless it awaits confirmation.
+func (s *TransactionService) insert(ctx context.Context, repo repository.Repository, actor Actor, tx *models.Transaction) error {
+	if err := repo.CreateTransaction(ctx, tx); err != nil {
+		return err
+	}
+	if err := auditOnBehalf(ctx, repo, actor, tx); err != nil {
+		return err
+	}
+	if tx.Status != models.TxStatusPending {
+		return nil
+	}
+	return repo.EnqueueJob(ctx, tx.ID)
+}
+
+// Confirm releases a transaction held for step-up authentication once its
+// creator proves their identity again with a password or TOTP code.
+// Transactions created by someone else are reported as sql.ErrNoRows.
+func (s *TransactionService) Confirm(ctx context.Context, userID, txID int64, password, code string) (*models.Transaction, error) {
+	var tx *models.Transaction
+	expired := false
+	err := s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		current, err := repo.GetTransactionByIDForUpdate(ctx, txID)
+		if err != nil {
+			return err
+		}
+		if current.CreatedBy == nil || *current.CreatedBy != userID {
+			return sql.ErrNoRows
+		}
+		if current.Status != models.TxStatusRequiresConfirmation {
+			return ErrNotAwaitingConfirmation
+		}
+		if current.ConfirmationExpiresAt != nil && time.Now().After(*current.ConfirmationExpiresAt) {
+			expired = true
+			return repo.UpdateTransactionStatus(ctx, txID, models.TxStatusExpired)
+		}
+
+		if err := s.userSvc.reauthenticate(ctx, repo, userID, password, code); err != nil {
+			return err
+		}
+		if err := repo.UpdateTransactionStatus(ctx, txID, models.TxStatusPending); err != nil {
+			return err
+		}
+		if err := repo.EnqueueJob(ctx, txID); err != nil {
+			return err
+		}
+		current.Status = models.TxStatusPending
+		tx = current
+		return repo.CreateAuditLog(ctx, &models.AuditLog{
+			EntityType: "user",
+			EntityID:   userID,
+			ActorID:    &userID,
+			Action:     "transaction_confirmed",
+			Details:    fmt.Sprintf("transaction_id: %d, type: %s, amount: %d", current.ID, current.Type, current.Amount),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if expired {
+		return nil, ErrConfirmationExpired
+	}
+
+	s.notify()
+	return tx, nil
+}
+
+// ExpireConfirmations expires transactions that were not confirmed in time,
+// every interval until ctx is cancelled.
+func (s *TransactionService) ExpireConfirmations(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, err := s.repo.ExpireUnconfirmedTransactions(ctx)
+			if err != nil {
+				slog.Error("Failed to expire unconfirmed transactions", "error", err)
+			} else if n > 0 {
+				slog.Info("Expired unconfirmed transactions", "count", n)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// authorize checks that actor may debit the account the transaction draws
+// from, defaulting the account to the actor's own when none is given. Acting
+// for another user needs the transactions.act_on_behalf permission.
+func (s *TransactionService) authorize(ctx context.Context, actor Actor, typeStr string, fromID, toID *int64) (*int64, *int64, error) {
+	subject := actor.UserID
+	if actor.OnBehalfOf != nil {
+		allowed, err := s.perms.HasPermission(ctx, actor.Role, models.PermTransactionsActOnBehalf)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !allowed {
+			return nil, nil, ErrForbidden
+		}
+		if strings.TrimSpace(actor.Reason) == "" {
+			return nil, nil, fmt.Errorf("%w: a reason is required when acting on behalf of another user", ErrInvalidTransaction)
+		}
+		subject = *actor.OnBehalfOf
+	}
+
+	switch typeStr {
+	case models.TxTypeWithdraw, models.TxTypeTransfer:
+		if fromID == nil {
+			fromID = &subject
+		} else if *fromID != subject {
+			return nil, nil, ErrForbidden
+		}
 	case models.TxTypeDeposit:
-		if tx.ToUserID == nil {
-			err = errors.New("missing to_user")
-		} else {
-			err = s.balanceSvc.Credit(ctx, *tx.ToUserID, tx.Amount)
-		}
-
-	case models.TxTypeWithdraw:
-		if tx.FromUserID == nil {
-			err = errors.New("missing from_user")
-		} else {
-			err = s.balanceSvc.Debit(ctx, *tx.FromUserID, tx.Amount)
-		}
-
-	case models.TxTypeTransfer:
-		if tx.FromUserID == nil || tx.ToUserID == nil {
-			err = errors.New("invalid transfer users")
-		} else {
-			err = s.balanceSvc.Debit(ctx, *tx.FromUserID, tx.Amount)
-			if err == nil {
-				if creditErr := s.balanceSvc.Credit(ctx, *tx.ToUserID, tx.Amount); creditErr != nil {
-					_ = s.balanceSvc.Credit(ctx, *tx.FromUserID, tx.Amount)
-					err = creditErr
-				}
+		if fromID != nil {
+			return nil, nil, fmt.Errorf("%w: deposits cannot have from_user_id", ErrInvalidTransaction)
+		}
+		if toID == nil {
+			toID = &subject
+		}
+	}
+	return fromID, toID, nil
+}
+
+// auditOnBehalf records transactions an admin created for another user.
+func auditOnBehalf(ctx context.Context, repo repository.Repository, actor Actor, tx *models.Transaction) error {
+	if actor.OnBehalfOf == nil {
+		return nil
+	}
+	return repo.CreateAuditLog(ctx, &models.AuditLog{
+		EntityType: "user",
+		EntityID:   *actor.OnBehalfOf,
+		ActorID:    &actor.UserID,
+		Action:     "transaction_on_behalf",
+		Details:    fmt.Sprintf("transaction_id: %d, type: %s, amount: %d, reason: %s", tx.ID, tx.Type, tx.Amount, actor.Reason),
+	})
+}
+
+// replay returns the cached transaction for key, or sql.ErrNoRows if there is none.
+func (s *TransactionService) replay(ctx context.Context, userID int64, key, fingerprint string) (*models.Transaction, error) {
+	k, err := s.repo.GetIdempotencyKey(ctx, userID, key)
+	if err != nil {
+		return nil, err
+	}
+	if k.RequestHash != fingerprint {
+		return nil, ErrIdempotencyConflict
+	}
+
+	var tx models.Transaction
+	if err := json.Unmarshal([]byte(k.ResponseBody), &tx); err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+// CleanupIdempotencyKeys deletes expired idempotency keys every interval until
+// ctx is cancelled.
+func (s *TransactionService) CleanupIdempotencyKeys(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.repo.DeleteExpiredIdempotencyKeys(ctx); err != nil {
+				slog.Error("Failed to delete expired idempotency keys", "error", err)
 			}
+		case <-ctx.Done():
+			return
 		}
+	}
+}
 
-	default:
-		err = errors.New("unknown transaction type")
+// notify tells the local pool about new work. Jobs are durable, so other
+// instances pick them up on their next poll either way.
+func (s *TransactionService) notify() {
+	if s.pool != nil {
+		s.pool.Notify()
+	}
+}
+
+// requestFingerprint identifies a prepared request for idempotency checks.
+// Requests that named no account keep the format from before users had
+// several accounts, so that keys stored then still match; the format for
+// requests naming accounts is versioned.
+func requestFingerprint(req TransactionRequest, namesAccounts bool) string {
+	id := func(v *int64) string {
+		if v == nil {
+			return "-"
+		}
+		return fmt.Sprint(*v)
 	}
+	s := fmt.Sprintf("%s|%s|%d|%s", id(req.FromUserID), id(req.ToUserID), req.Amount, req.Type)
+	if namesAccounts {
+		s = fmt.Sprintf("v2|%s|%s|%s|%s|%d|%s",
+			id(req.FromUserID), id(req.ToUserID), id(req.FromAccountID), id(req.ToAccountID), req.Amount, req.Type)
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// ProcessTransaction applies tx in a single database transaction: the
+// transaction row and every affected balance are locked, the ledger entry is
+// written and the status is set to completed, or nothing happens at all.
+func (s *TransactionService) ProcessTransaction(ctx context.Context, tx *models.Transaction) error {
+	var entry *models.JournalEntry
+	err := s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		current, err := repo.GetTransactionByIDForUpdate(ctx, tx.ID)
+		if err != nil {
+			return err
+		}
+		if current.Status != models.TxStatusPending {
+			return ErrTransactionNotPending
+		}
 
-	status := models.TxStatusCompleted
+		entry, err = s.balanceSvc.applyTransaction(ctx, repo, current)
+		if err != nil {
+			return err
+		}
+		return repo.UpdateTransactionStatus(ctx, tx.ID, models.TxStatusCompleted)
+	})
+	if errors.Is(err, ErrTransactionNotPending) {
+		// Already handled, e.g. by an instance whose lease expired mid-commit
+		slog.Info("Skipping transaction that is no longer pending", "tx_id", tx.ID)
+		return nil
+	}
 	if err != nil {
-		status = models.TxStatusFailed
+		if !isBusinessError(err) {
+			// Leave the transaction pending so the pool can retry it
+			return err
+		}
+		_ = s.repo.UpdateTransactionStatus(ctx, tx.ID, models.TxStatusFailed)
+		return worker.Permanent(err)
 	}
-	_ = s.repo.UpdateTransactionStatus(ctx, tx.ID, status)
 
-	return err
+	tx.Status = models.TxStatusCompleted
+	s.balanceSvc.invalidate(ctx, entry)
+	return nil
+}
+
+// isBusinessError reports whether err means the transaction itself is
+// unacceptable, as opposed to a transient database or cache failure.
+func isBusinessError(err error) bool {
+	return errors.Is(err, ErrInsufficientFunds) ||
+		errors.Is(err, ErrAccountClosed) ||
+		errors.Is(err, ErrAccountFrozen) ||
+		errors.Is(err, ErrAccountSuspended) ||
+		errors.Is(err, ErrInvalidTransaction) ||
+		errors.Is(err, repository.ErrInvalidReference) ||
+		errors.Is(err, sql.ErrNoRows)
+}
+
+func (s *TransactionService) ListDeadJobs(ctx context.Context) ([]*models.Job, error) {
+	return s.repo.ListDeadJobs(ctx)
+}
+
+// RequeueDeadJob gives a dead job a fresh set of attempts.
+func (s *TransactionService) RequeueDeadJob(ctx context.Context, jobID int64) error {
+	if err := s.repo.RequeueDeadJob(ctx, jobID); err != nil {
+		return err
+	}
+	s.notify()
+	return nil
+}
+
+// DiscardDeadJob drops a dead job and fails its transaction.
+func (s *TransactionService) DiscardDeadJob(ctx context.Context, jobID int64) error {
+	return s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		job, err := repo.GetDeadJobForUpdate(ctx, jobID)
+		if err != nil {
+			return err
+		}
+		current, err := repo.GetTransactionByIDForUpdate(ctx, job.TransactionID)
+		if err != nil {
+			return err
+		}
+		if current.Status == models.TxStatusPending {
+			if err := repo.UpdateTransactionStatus(ctx, current.ID, models.TxStatusFailed); err != nil {
+				return err
+			}
+		}
+		return repo.DiscardDeadJob(ctx, jobID)
+	})
 }
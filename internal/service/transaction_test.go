@@ -0,0 +1,74 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"backend/internal/models"
+)
+
+func TestRequestFingerprint(t *testing.T) {
+	ptr := func(v int64) *int64 { return &v }
+	hash := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	req := TransactionRequest{FromUserID: ptr(1), ToUserID: ptr(2), FromAccountID: ptr(10), ToAccountID: ptr(20), Amount: 500, Type: models.TxTypeTransfer}
+
+	tests := []struct {
+		name          string
+		req           TransactionRequest
+		namesAccounts bool
+		want          string
+	}{
+		{"without accounts keeps the original format", req, false, hash("1|2|500|transfer")},
+		{"deposit without accounts", TransactionRequest{ToUserID: ptr(2), ToAccountID: ptr(20), Amount: 500, Type: models.TxTypeDeposit}, false, hash("-|2|500|deposit")},
+		{"with accounts is versioned", req, true, hash("v2|1|2|10|20|500|transfer")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := requestFingerprint(tt.req, tt.namesAccounts); got != tt.want {
+				t.Errorf("requestFingerprint() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequiresStepUp(t *testing.T) {
+	fx := NewFXService(nil, &StaticRates{rates: map[string]*models.FXRate{
+		"EUR/USD": {Base: "EUR", Quote: "USD", Rate: "1.25"},
+		"USD/JPY": {Base: "USD", Quote: "JPY", Rate: "150"},
+	}})
+	svc := &TransactionService{fx: fx, cfg: TransactionConfig{StepUpThreshold: 100000, StepUpCurrency: "USD"}}
+
+	tests := []struct {
+		name     string
+		typ      string
+		amount   int64
+		currency string
+		want     bool
+	}{
+		{"below threshold", models.TxTypeTransfer, 99999, "USD", false},
+		{"at threshold", models.TxTypeTransfer, 100000, "USD", true},
+		{"withdrawal", models.TxTypeWithdraw, 100000, "USD", true},
+		{"deposit", models.TxTypeDeposit, 100000, "USD", false},
+		{"converted below threshold", models.TxTypeTransfer, 79999, "EUR", false},
+		{"converted at threshold", models.TxTypeTransfer, 80000, "EUR", true},
+		{"zero minor units", models.TxTypeTransfer, 150000, "JPY", true},
+		{"zero minor units below", models.TxTypeTransfer, 149999, "JPY", false},
+		{"no rate", models.TxTypeTransfer, 1, "GBP", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := svc.requiresStepUp(context.Background(), tt.typ, tt.amount, tt.currency)
+			if err != nil {
+				t.Fatalf("requiresStepUp() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("requiresStepUp(%d %s) = %v, want %v", tt.amount, tt.currency, got, tt.want)
+			}
+		})
+	}
+}
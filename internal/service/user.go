@@ -2,33 +2,100 @@ package service
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log/slog"
+	"math"
+	"strings"
 	"time"
 
+	"backend/internal/cache"
 	"backend/internal/models"
+	"backend/internal/notify"
 	"backend/internal/repository"
 
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+// Values of the token_use claim, so a token issued for one purpose cannot be
+// presented as another.
+const (
+	tokenUseAccess      = "access"
+	tokenUseMFA         = "mfa"
+	tokenUseVerifyEmail = "verify_email"
+)
+
+type AuthConfig struct {
+	AccessTokenTTL   time.Duration
+	RefreshTokenTTL  time.Duration
+	MFAChallengeTTL  time.Duration // Time allowed between password and code
+	MFAIssuer        string        // Shown in authenticator apps
+	EncryptionSecret string        // Encrypts TOTP secrets at rest
+	PasswordResetTTL time.Duration
+	PasswordResetURL string // The reset token is appended to it
+
+	PasswordResetResendInterval time.Duration
+
+	VerificationTTL            time.Duration
+	VerificationURL            string // The verification token is appended to it
+	VerificationResendInterval time.Duration
+
+	Lockout  LockoutConfig
+	Password PasswordPolicy
+}
+
+// LoginResult is the outcome of a successful password check. If the user has
+// two-factor authentication enabled, Tokens is nil and MFAToken must be
+// exchanged with CompleteMFALogin.
+type LoginResult struct {
+	User     *models.User
+	Tokens   *models.AuthTokens
+	MFAToken string
+}
+
 type UserService struct {
-	repo       repository.UserRepository
-	authSecret string
+	repo     repository.Repository
+	keys     *KeyManager
+	revoked  cache.RevocationStore
+	attempts cache.AttemptCounter
+	perms    *PermissionService
+	box      *secretBox
+	notifier notify.Notifier
+	cfg      AuthConfig
 }
 
-func NewUserService(repo repository.UserRepository, authSecret string) *UserService {
+func NewUserService(repo repository.Repository, keys *KeyManager, revoked cache.RevocationStore, attempts cache.AttemptCounter, perms *PermissionService, notifier notify.Notifier, cfg AuthConfig) *UserService {
 	return &UserService{
-		repo:       repo,
-		authSecret: authSecret,
+		repo:     repo,
+		keys:     keys,
+		revoked:  revoked,
+		attempts: attempts,
+		perms:    perms,
+		box:      newSecretBox(cfg.EncryptionSecret),
+		notifier: notifier,
+		cfg:      cfg,
 	}
 }
 
 func (s *UserService) Register(ctx context.Context, username, email, password string) (*models.User, error) {
+	email = normalizeEmail(email)
 	if username == "" || password == "" || email == "" {
 		return nil, errors.New("all fields are required")
 	}
+	if err := s.cfg.Password.Check(password, username, email); err != nil {
+		return nil, err
+	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -46,10 +113,26 @@ func (s *UserService) Register(ctx context.Context, username, email, password st
 		return nil, err
 	}
 
-	if err := s.repo.CreateUser(ctx, user); err != nil {
+	err = s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		if err := repo.CreateUser(ctx, user); err != nil {
+			return err
+		}
+		return repo.CreateAccount(ctx, &models.Account{
+			UserID:   user.ID,
+			Name:     "Main",
+			Type:     models.AccountTypeChecking,
+			Currency: models.DefaultCurrency,
+			Default:  true,
+		})
+	})
+	if err != nil {
 		return nil, err
 	}
 
+	// The user can ask for another one if this fails
+	if err := s.SendVerification(ctx, user.ID); err != nil {
+		slog.Error("Failed to send verification email", "user_id", user.ID, "error", err)
+	}
 	return user, nil
 }
 
@@ -57,50 +140,330 @@ func (s *UserService) ListUsers(ctx context.Context) ([]*models.User, error) {
 	return s.repo.ListUsers(ctx)
 }
 
-func (s *UserService) UpdateUser(ctx context.Context, user *models.User) error {
-    return s.repo.UpdateUser(ctx, user)
+// Authenticate checks a password login from ip. Failed attempts are counted
+// and slowed down, and lock the account once there are too many.
+func (s *UserService) Authenticate(ctx context.Context, email, password, ip string) (*LoginResult, error) {
+	email = normalizeEmail(email)
+	if err := s.checkLoginAllowed(ctx, nil, ip); err != nil {
+		return nil, err
+	}
+	user, err := s.repo.GetUserByEmail(ctx, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := s.recordLoginFailure(ctx, nil, email, ip); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkLoginAllowed(ctx, user, ""); err != nil {
+		return nil, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		locked, err := s.recordLoginFailure(ctx, user, email, ip)
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			return nil, ErrAccountLocked
+		}
+		return nil, ErrInvalidCredentials
+	}
+	// Only revealed to someone who knows the password
+	if err := checkSignIn(user); err != nil {
+		return nil, err
+	}
+
+	mfa, err := s.mfaEnabled(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if mfa {
+		// Failures are only cleared once the second factor is verified too
+		challenge, err := s.issueMFAChallenge(user)
+		if err != nil {
+			return nil, err
+		}
+		return &LoginResult{User: user, MFAToken: challenge}, nil
+	}
+
+	familyID, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	tokens, _, err := s.issueTokens(ctx, s.repo, user, familyID, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.recordLoginSuccess(ctx, user, ip); err != nil {
+		return nil, err
+	}
+	return &LoginResult{User: user, Tokens: tokens}, nil
 }
 
-func (s *UserService) DeleteUser(ctx context.Context, id int64) error {
-    return s.repo.DeleteUser(ctx, id)
+// Refresh exchanges a refresh token for a new token pair. The presented token
+// is used up; presenting it again revokes every token in its family, since
+// that means it was stolen or replayed.
+func (s *UserService) Refresh(ctx context.Context, refreshToken string) (*models.AuthTokens, error) {
+	return s.refresh(ctx, refreshToken, "")
 }
 
+// refresh rotates a refresh token issued to clientID, or to a first-party
+// login if clientID is empty. Tokens of other clients are treated as invalid
+// and left alone. The new tokens carry the same grant as the old ones.
+func (s *UserService) refresh(ctx context.Context, refreshToken, clientID string) (*models.AuthTokens, error) {
+	var tokens *models.AuthTokens
+	reused := false
+	err := s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		current, err := repo.GetRefreshTokenByHashForUpdate(ctx, hashToken(refreshToken))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+		grant := grantOf(current)
+		if grant.clientID() != clientID {
+			return ErrInvalidRefreshToken
+		}
+
+		if current.UsedAt != nil || current.RevokedAt != nil {
+			reused = current.RevokedAt == nil
+			if err := repo.RevokeRefreshTokenFamily(ctx, current.FamilyID); err != nil {
+				return err
+			}
+			if reused {
+				return repo.CreateAuditLog(ctx, &models.AuditLog{
+					EntityType: "user",
+					EntityID:   current.UserID,
+					Action:     "refresh_token_reuse",
+					Details:    fmt.Sprintf("family_id: %s, token_id: %d", current.FamilyID, current.ID),
+				})
+			}
+			return nil
+		}
+		if time.Now().After(current.ExpiresAt) {
+			return ErrInvalidRefreshToken
+		}
 
-func (s *UserService) Authenticate(ctx context.Context, email, password string) (*models.User, string, error) {
-	user, err := s.repo.GetUserByEmail(ctx, email)
+		user, err := repo.GetUserByID(ctx, current.UserID)
+		if err != nil {
+			return err
+		}
+		var next *models.RefreshToken
+		tokens, next, err = s.issueTokens(ctx, repo, user, current.FamilyID, grant)
+		if err != nil {
+			return err
+		}
+		return repo.MarkRefreshTokenUsed(ctx, current.ID, next.ID)
+	})
 	if err != nil {
-		return nil, "", errors.New("invalid credentials")
+		return nil, err
+	}
+	if tokens == nil {
+		// The family was revoked above and the revocation has been committed
+		if reused {
+			return nil, ErrRefreshTokenReused
+		}
+		return nil, ErrInvalidRefreshToken
 	}
+	return tokens, nil
+}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
-		return nil, "", errors.New("invalid credentials")
+// Logout revokes the refresh token and every token rotated from the same login.
+func (s *UserService) Logout(ctx context.Context, refreshToken string) error {
+	return s.repo.WithTx(ctx, func(repo repository.Repository) error {
+		current, err := repo.GetRefreshTokenByHashForUpdate(ctx, hashToken(refreshToken))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+		return repo.RevokeRefreshTokenFamily(ctx, current.FamilyID)
+	})
+}
+
+// oauthGrant limits tokens issued to an OAuth client to the scopes the user
+// approved. A nil grant is a first-party session with full access.
+type oauthGrant struct {
+	ClientID string
+	Scopes   []string
+}
+
+func grantOf(t *models.RefreshToken) *oauthGrant {
+	if t.ClientID == nil {
+		return nil
 	}
+	return &oauthGrant{ClientID: *t.ClientID, Scopes: t.Scopes}
+}
 
-	token, err := s.GenerateToken(user)
+func (g *oauthGrant) clientID() string {
+	if g == nil {
+		return ""
+	}
+	return g.ClientID
+}
+
+// issueTokens creates an access token and a new refresh token in familyID.
+func (s *UserService) issueTokens(ctx context.Context, repo repository.Repository, user *models.User, familyID string, grant *oauthGrant) (*models.AuthTokens, *models.RefreshToken, error) {
+	access, err := s.generateToken(user, grant)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refresh, err := randomToken(32)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, err
+	}
+	record := &models.RefreshToken{
+		UserID:    user.ID,
+		FamilyID:  familyID,
+		TokenHash: hashToken(refresh),
+		ExpiresAt: time.Now().Add(s.cfg.RefreshTokenTTL),
+	}
+	if grant != nil {
+		record.ClientID = &grant.ClientID
+		record.Scopes = grant.Scopes
+	}
+	if err := repo.CreateRefreshToken(ctx, record); err != nil {
+		return nil, nil, err
 	}
 
-	return user, token, nil
+	return &models.AuthTokens{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		ExpiresIn:    int64(s.cfg.AccessTokenTTL.Seconds()),
+	}, record, nil
 }
 
 func (s *UserService) GenerateToken(user *models.User) (string, error) {
+	return s.generateToken(user, nil)
+}
+
+// generateToken signs an access token. Tokens issued under an OAuth grant
+// carry client_id and a space-separated scope claim, which the auth
+// middleware enforces. Closed and suspended accounts get no tokens.
+func (s *UserService) generateToken(user *models.User, grant *oauthGrant) (string, error) {
+	if err := checkSignIn(user); err != nil {
+		return "", err
+	}
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
 	claims := jwt.MapClaims{
-		"user_id": user.ID,
-		"email":   user.Email,
-		"role":    user.Role,
-		"exp":     time.Now().Add(time.Hour * 24).Unix(), // 24 hour expiration
+		"jti":       jti,
+		"user_id":   user.ID,
+		"email":     user.Email,
+		"role":      user.Role,
+		"token_use": tokenUseAccess,
+		"iat":       numericDate(now),
+		"exp":       now.Add(s.cfg.AccessTokenTTL).Unix(),
+	}
+	if grant != nil {
+		claims["client_id"] = grant.ClientID
+		claims["scope"] = strings.Join(grant.Scopes, " ")
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(s.authSecret))
+	return s.keys.Sign(claims)
 }
 
+// ValidateToken parses an access token. Other kinds of token we sign, such
+// as MFA challenges, are rejected.
 func (s *UserService) ValidateToken(tokenStr string) (*jwt.Token, error) {
-	return jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(s.authSecret), nil
-	})
+	return s.parseToken(tokenStr, tokenUseAccess)
+}
+
+func (s *UserService) parseToken(tokenStr, use string) (*jwt.Token, error) {
+	token, err := jwt.Parse(tokenStr, s.keys.Keyfunc, jwt.WithValidMethods(s.keys.ValidMethods()))
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["token_use"] != use {
+		return nil, errors.New("unexpected token type")
+	}
+	return token, nil
+}
+
+// JWKS returns the public keys other services can use to verify our tokens.
+func (s *UserService) JWKS() *models.JWKS {
+	return s.keys.JWKS()
+}
+
+// IsRevoked reports whether a validated access token has been revoked, either
+// individually or by revoking every session of its user.
+func (s *UserService) IsRevoked(ctx context.Context, claims jwt.MapClaims) (bool, error) {
+	jti, _ := claims["jti"].(string)
+	userID, _ := claims["user_id"].(float64)
+	// Read directly, as GetIssuedAt drops the fraction of a second
+	var issuedAt time.Time
+	if iat, ok := claims["iat"].(float64); ok {
+		issuedAt = time.UnixMicro(int64(math.Round(iat * 1e6)))
+	}
+	return s.revoked.IsRevoked(ctx, jti, int64(userID), issuedAt)
+}
+
+// numericDate returns t as a JWT NumericDate to the microsecond, so that a
+// session started in the same second as a revocation of every session can
+// be told apart from those it revoked.
+func numericDate(t time.Time) float64 {
+	return float64(t.UnixMicro()) / 1e6
+}
+
+// RevokeAccessToken rejects a single access token until it expires.
+func (s *UserService) RevokeAccessToken(ctx context.Context, tokenStr string) error {
+	token, err := s.ValidateToken(tokenStr)
+	if err != nil || !token.Valid {
+		return nil // Nothing to revoke
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil
+	}
+	jti, _ := claims["jti"].(string)
+	exp, err := claims.GetExpirationTime()
+	if jti == "" || err != nil || exp == nil {
+		return nil
+	}
+	return s.revoked.Revoke(ctx, jti, exp.Time)
+}
+
+// RevokeAllSessions revokes every refresh token of the user and rejects every
+// access token issued to them so far.
+func (s *UserService) RevokeAllSessions(ctx context.Context, userID int64) error {
+	if err := s.repo.RevokeUserRefreshTokens(ctx, userID); err != nil {
+		return err
+	}
+	// iat has microsecond precision, so a session issued right after this,
+	// such as the login that follows a password reset, stays valid while
+	// every earlier one in the same second is rejected
+	before := time.Now()
+	return s.revoked.RevokeUser(ctx, userID, before, before.Add(s.cfg.AccessTokenTTL))
+}
+
+// randomToken returns n random bytes encoded for use in URLs and headers.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// normalizeEmail returns the form emails are stored, looked up and counted
+// in, so that addresses differing only in case belong to the same account.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// hashToken is used for opaque tokens, which are random enough that a fast
+// hash is sufficient.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"backend/internal/cache"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestIsRevokedSubSecond(t *testing.T) {
+	ctx := context.Background()
+	before := time.Date(2026, 5, 1, 12, 0, 0, 500_000_000, time.UTC)
+
+	tests := []struct {
+		name     string
+		issuedAt time.Time
+		want     bool
+	}{
+		{"earlier in the same second", before.Add(-time.Millisecond), true},
+		{"later in the same second", before.Add(time.Millisecond), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &UserService{revoked: cache.NewMemoryRevocationStore()}
+			if err := s.revoked.RevokeUser(ctx, 1, before, time.Now().Add(time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+			// Through JSON, as the claims of a signed token are
+			body, err := json.Marshal(jwt.MapClaims{"jti": "jti", "user_id": 1, "iat": numericDate(tt.issuedAt)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var claims jwt.MapClaims
+			if err := json.Unmarshal(body, &claims); err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.IsRevoked(ctx, claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("IsRevoked() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"backend/internal/models"
+	"backend/internal/notify"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrInvalidVerificationToken = errors.New("invalid or expired verification token")
+	ErrVerificationThrottled    = errors.New("a verification email was sent recently, please wait before requesting another")
+	ErrAlreadyVerified          = errors.New("email address is already verified")
+	ErrEmailNotVerified         = errors.New("email address must be verified first")
+)
+
+// SendVerification emails the user a signed verification link. It may be
+// called at most once per resend interval.
+func (s *UserService) SendVerification(ctx context.Context, userID int64) error {
+	user, err := s.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user.Verified {
+		return ErrAlreadyVerified
+	}
+	if err := s.repo.ClaimVerificationSend(ctx, userID, s.cfg.VerificationResendInterval); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrVerificationThrottled
+		}
+		return err
+	}
+
+	token, err := s.verificationToken(user)
+	if err != nil {
+		return err
+	}
+	return s.notifier.Send(ctx, notify.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Confirm your email address with the link below. It expires in %s.\n\n%s%s",
+			s.cfg.VerificationTTL, s.cfg.VerificationURL, token),
+	})
+}
+
+// VerifyEmail marks the user's email as verified. The token only works for
+// the address it was sent to.
+func (s *UserService) VerifyEmail(ctx context.Context, tokenStr string) error {
+	token, err := s.parseToken(tokenStr, tokenUseVerifyEmail)
+	if err != nil {
+		return ErrInvalidVerificationToken
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	userID, _ := claims["user_id"].(float64)
+	email, _ := claims["email"].(string)
+
+	err = s.repo.MarkUserVerified(ctx, int64(userID), email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidVerificationToken
+	}
+	return err
+}
+
+func (s *UserService) verificationToken(user *models.User) (string, error) {
+	now := time.Now()
+	return s.keys.Sign(jwt.MapClaims{
+		"user_id":   user.ID,
+		"email":     user.Email,
+		"token_use": tokenUseVerifyEmail,
+		"iat":       now.Unix(),
+		"exp":       now.Add(s.cfg.VerificationTTL).Unix(),
+	})
+}
+
+// RequireVerified returns ErrEmailNotVerified unless the user has verified
+// their email address.
+func (s *UserService) RequireVerified(ctx context.Context, userID int64) error {
+	user, err := s.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !user.Verified {
+		return ErrEmailNotVerified
+	}
+	return nil
+}
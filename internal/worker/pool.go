@@ -2,72 +2,210 @@ package worker
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"math/rand/v2"
+	"os"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"backend/internal/models"
 )
 
 type ProcessorFunc func(ctx context.Context, tx *models.Transaction) error
 
+// JobStore is the durable queue the pool pulls work from.
+type JobStore interface {
+	// ClaimJob leases the next runnable job to owner, or returns nil if there is none.
+	ClaimJob(ctx context.Context, owner string, lease time.Duration) (*models.Job, error)
+	HeartbeatJob(ctx context.Context, id int64, owner string, lease time.Duration) error
+	CompleteJob(ctx context.Context, id int64, owner string) error
+	FailJob(ctx context.Context, id int64, owner string, reason string) error
+	RetryJob(ctx context.Context, id int64, owner string, delay time.Duration, reason string) error
+	DeadLetterJob(ctx context.Context, id int64, owner string, reason string) error
+}
+
+type Config struct {
+	Workers      int
+	PollInterval time.Duration // How often idle workers look for new jobs
+	Lease        time.Duration // How long a claimed job is reserved without a heartbeat
+	MaxAttempts  int           // Attempts before a retryable failure is dead-lettered
+	BaseBackoff  time.Duration // Delay before the first retry, doubled on each attempt
+	MaxBackoff   time.Duration
+}
+
 type Pool struct {
-	queue          chan *models.Transaction
-	workerCount    int
+	store          JobStore
+	cfg            Config
 	processor      ProcessorFunc
+	instance       string
+	wake           chan struct{}
+	wg             sync.WaitGroup
 	processedCount int64
 	errorCount     int64
 }
 
-func NewPool(workerCount int, queueSize int, processor ProcessorFunc) *Pool {
+func NewPool(store JobStore, cfg Config, processor ProcessorFunc) *Pool {
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.Lease <= 0 {
+		cfg.Lease = 30 * time.Second
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.BaseBackoff <= 0 {
+		cfg.BaseBackoff = time.Second
+	}
+	if cfg.MaxBackoff < cfg.BaseBackoff {
+		cfg.MaxBackoff = 5 * time.Minute
+	}
+
+	host, _ := os.Hostname()
 	return &Pool{
-		queue:       make(chan *models.Transaction, queueSize),
-		workerCount: workerCount,
-		processor:   processor,
+		store:     store,
+		cfg:       cfg,
+		processor: processor,
+		instance:  fmt.Sprintf("%s-%d", host, os.Getpid()),
+		wake:      make(chan struct{}, cfg.Workers),
 	}
 }
 
 func (p *Pool) Start(ctx context.Context) {
-	for i := 0; i < p.workerCount; i++ {
+	for i := 0; i < p.cfg.Workers; i++ {
+		p.wg.Add(1)
 		go p.worker(ctx, i)
 	}
-	slog.Info("Worker pool started", "workers", p.workerCount)
+	slog.Info("Worker pool started", "workers", p.cfg.Workers, "instance", p.instance)
+}
+
+// Wait blocks until every worker has returned after the Start context is cancelled.
+func (p *Pool) Wait() {
+	p.wg.Wait()
 }
 
 func (p *Pool) worker(ctx context.Context, id int) {
+	defer p.wg.Done()
+	owner := fmt.Sprintf("%s-%d", p.instance, id)
+	ticker := time.NewTicker(p.cfg.PollInterval)
+	defer ticker.Stop()
+
 	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		job, err := p.store.ClaimJob(ctx, owner, p.cfg.Lease)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("Worker failed to claim job", "worker_id", id, "error", err)
+		}
+		if job != nil {
+			p.run(ctx, id, owner, job)
+			continue
+		}
+
 		select {
-		case tx := <-p.queue:
-			if err := p.processor(ctx, tx); err != nil {
-				atomic.AddInt64(&p.errorCount, 1)
-				slog.Error("Worker failed to process transaction",
-					"worker_id", id,
-					"tx_id", tx.ID,
-					"type", tx.Type,
-					"amount", tx.Amount,
-					"from_user", tx.FromUserID,
-					"to_user", tx.ToUserID,
-					"error", err,
-				)
-			} else {
-				atomic.AddInt64(&p.processedCount, 1)
-				slog.Info("Worker processed transaction", "worker_id", id, "tx_id", tx.ID)
-			}
+		case <-p.wake:
+		case <-ticker.C:
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (p *Pool) Submit(tx *models.Transaction) {
-	p.queue <- tx
+// run processes a claimed job, renewing its lease until the processor returns.
+// Processing is not interrupted by shutdown so in-flight work can finish.
+func (p *Pool) run(ctx context.Context, id int, owner string, job *models.Job) {
+	workCtx := context.WithoutCancel(ctx)
+	hbCtx, stopHeartbeat := context.WithCancel(workCtx)
+	go p.heartbeat(hbCtx, owner, job.ID)
+
+	tx := job.Transaction
+	err := p.processor(workCtx, tx)
+	stopHeartbeat()
+
+	if err != nil {
+		atomic.AddInt64(&p.errorCount, 1)
+		slog.Error("Worker failed to process transaction",
+			"worker_id", id,
+			"job_id", job.ID,
+			"attempt", job.Attempts,
+			"permanent", IsPermanent(err),
+			"tx_id", tx.ID,
+			"type", tx.Type,
+			"amount", tx.Amount,
+			"from_user", tx.FromUserID,
+			"to_user", tx.ToUserID,
+			"error", err,
+		)
+		if err := p.handleFailure(workCtx, owner, job, err); err != nil {
+			slog.Error("Worker failed to record job failure", "worker_id", id, "job_id", job.ID, "error", err)
+		}
+		return
+	}
+
+	atomic.AddInt64(&p.processedCount, 1)
+	slog.Info("Worker processed transaction", "worker_id", id, "job_id", job.ID, "tx_id", tx.ID)
+	if err := p.store.CompleteJob(workCtx, job.ID, owner); err != nil {
+		slog.Error("Worker failed to mark job completed", "worker_id", id, "job_id", job.ID, "error", err)
+	}
 }
 
-func (p *Pool) SubmitBatch(txs []*models.Transaction) {
-	go func() {
-		for _, tx := range txs {
-			p.queue <- tx
+// handleFailure fails permanent errors outright, schedules a retry with
+// exponential backoff for anything else, and dead-letters the job once it is
+// out of attempts.
+func (p *Pool) handleFailure(ctx context.Context, owner string, job *models.Job, procErr error) error {
+	switch {
+	case IsPermanent(procErr):
+		return p.store.FailJob(ctx, job.ID, owner, procErr.Error())
+	case job.Attempts >= p.cfg.MaxAttempts:
+		slog.Warn("Job moved to dead-letter queue", "job_id", job.ID, "attempts", job.Attempts)
+		return p.store.DeadLetterJob(ctx, job.ID, owner, procErr.Error())
+	default:
+		return p.store.RetryJob(ctx, job.ID, owner, p.backoff(job.Attempts), procErr.Error())
+	}
+}
+
+// backoff returns the delay before the next attempt, with jitter so that
+// retries from several instances do not line up.
+func (p *Pool) backoff(attempt int) time.Duration {
+	d := p.cfg.BaseBackoff
+	for i := 1; i < attempt && d < p.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.cfg.MaxBackoff {
+		d = p.cfg.MaxBackoff
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+func (p *Pool) heartbeat(ctx context.Context, owner string, jobID int64) {
+	ticker := time.NewTicker(p.cfg.Lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.store.HeartbeatJob(ctx, jobID, owner, p.cfg.Lease); err != nil && ctx.Err() == nil {
+				slog.Error("Worker failed to renew job lease", "job_id", jobID, "error", err)
+			}
+		case <-ctx.Done():
+			return
 		}
-	}()
+	}
+}
+
+// Notify wakes an idle worker so newly enqueued jobs are picked up without
+// waiting for the next poll.
+func (p *Pool) Notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
 }
 
 func (p *Pool) Stats() (processed int64, errors int64) {
@@ -0,0 +1,42 @@
+-- Double-entry ledger. Balances become a projection of the postings.
+CREATE TABLE IF NOT EXISTS journal_entries (
+    id SERIAL PRIMARY KEY,
+    transaction_id INTEGER REFERENCES transactions(id),
+    reference VARCHAR(100) UNIQUE,
+    description TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS postings (
+    id SERIAL PRIMARY KEY,
+    journal_entry_id INTEGER NOT NULL REFERENCES journal_entries(id),
+    account_type VARCHAR(50) NOT NULL, -- 'user', 'external'
+    user_id INTEGER REFERENCES users(id),
+    direction VARCHAR(10) NOT NULL CHECK (direction IN ('debit', 'credit')),
+    amount BIGINT NOT NULL CHECK (amount > 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_journal_entries_transaction ON journal_entries(transaction_id);
+CREATE INDEX IF NOT EXISTS idx_postings_entry ON postings(journal_entry_id);
+CREATE INDEX IF NOT EXISTS idx_postings_user ON postings(user_id);
+
+-- Backfill an opening entry for balances that predate the ledger
+INSERT INTO journal_entries (reference, description)
+SELECT 'opening:' || b.user_id, 'opening balance'
+FROM balances b
+WHERE b.amount > 0 AND NOT EXISTS (SELECT 1 FROM postings p WHERE p.user_id = b.user_id)
+ON CONFLICT (reference) DO NOTHING;
+
+INSERT INTO postings (journal_entry_id, account_type, user_id, direction, amount)
+SELECT je.id, 'user', b.user_id, 'credit', b.amount
+FROM journal_entries je
+JOIN balances b ON je.reference = 'opening:' || b.user_id
+WHERE NOT EXISTS (SELECT 1 FROM postings p WHERE p.journal_entry_id = je.id AND p.account_type = 'user');
+
+INSERT INTO postings (journal_entry_id, account_type, direction, amount)
+SELECT je.id, 'external', 'debit', p.amount
+FROM journal_entries je
+JOIN postings p ON p.journal_entry_id = je.id AND p.account_type = 'user'
+WHERE je.reference LIKE 'opening:%'
+AND NOT EXISTS (SELECT 1 FROM postings x WHERE x.journal_entry_id = je.id AND x.account_type = 'external');
@@ -0,0 +1,20 @@
+-- Durable job queue shared by all API instances
+CREATE TABLE IF NOT EXISTS jobs (
+    id SERIAL PRIMARY KEY,
+    transaction_id INTEGER NOT NULL UNIQUE REFERENCES transactions(id),
+    status VARCHAR(50) NOT NULL DEFAULT 'queued', -- 'queued', 'running', 'completed', 'failed'
+    attempts INTEGER NOT NULL DEFAULT 0,
+    locked_by VARCHAR(255),
+    lease_expires_at TIMESTAMPTZ,
+    heartbeat_at TIMESTAMPTZ,
+    last_error TEXT,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_jobs_claimable ON jobs(status, lease_expires_at);
+
+-- Queue transactions that were left pending by the in-memory pool
+INSERT INTO jobs (transaction_id)
+SELECT id FROM transactions WHERE status = 'pending'
+ON CONFLICT (transaction_id) DO NOTHING;
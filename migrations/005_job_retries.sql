@@ -0,0 +1,5 @@
+-- Retry scheduling and dead-lettering for jobs
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS run_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS dead_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_jobs_run_at ON jobs(status, run_at);
@@ -0,0 +1,4 @@
+-- Record who performed an audited action
+ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS actor_id INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_audit_logs_entity ON audit_logs(entity_type, entity_id);
@@ -0,0 +1,11 @@
+-- Asymmetric JWT signing keys, rotated on a schedule
+CREATE TABLE IF NOT EXISTS signing_keys (
+    id SERIAL PRIMARY KEY,
+    kid VARCHAR(64) NOT NULL UNIQUE,
+    algorithm VARCHAR(20) NOT NULL, -- 'EdDSA', 'RS256'
+    private_key BYTEA NOT NULL, -- PKCS#8, encrypted with AUTH_SECRET
+    public_key BYTEA NOT NULL, -- PKIX
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    retired_at TIMESTAMPTZ,
+    verify_until TIMESTAMPTZ
+);
@@ -0,0 +1,6 @@
+-- Who created a transaction, and how long a high-value one waits for the
+-- creator to re-authenticate before it expires
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS created_by INTEGER;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS confirmation_expires_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_transactions_awaiting_confirmation ON transactions(confirmation_expires_at) WHERE status = 'requires_confirmation';
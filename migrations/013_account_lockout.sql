@@ -0,0 +1,2 @@
+-- Set after too many failed logins and cleared by an admin or when it passes
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until TIMESTAMPTZ;
@@ -0,0 +1,45 @@
+-- Roles and the permissions they grant. users.role holds a role name.
+CREATE TABLE IF NOT EXISTS roles (
+    name VARCHAR(50) PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role VARCHAR(50) NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+    permission VARCHAR(100) NOT NULL,
+    PRIMARY KEY (role, permission)
+);
+
+-- Built-in roles. Permissions are only seeded when a role is first created,
+-- so changes made through the API survive restarts.
+WITH new_roles AS (
+    INSERT INTO roles (name, description) VALUES
+        ('user', 'Customer, with access to their own accounts only'),
+        ('admin', 'Full access'),
+        ('support', 'Looks up customers and helps them regain access'),
+        ('auditor', 'Read-only access to customers and the ledger'),
+        ('finance-ops', 'Runs the ledger and transaction processing')
+    ON CONFLICT (name) DO NOTHING
+    RETURNING name
+)
+INSERT INTO role_permissions (role, permission)
+SELECT v.role, v.permission FROM (VALUES
+    ('admin', 'users.read'),
+    ('admin', 'users.write'),
+    ('admin', 'users.delete'),
+    ('admin', 'transactions.act_on_behalf'),
+    ('admin', 'ledger.read'),
+    ('admin', 'jobs.manage'),
+    ('admin', 'api_keys.manage'),
+    ('admin', 'oauth_clients.manage'),
+    ('admin', 'roles.manage'),
+    ('support', 'users.read'),
+    ('support', 'users.write'),
+    ('auditor', 'users.read'),
+    ('auditor', 'ledger.read'),
+    ('finance-ops', 'ledger.read'),
+    ('finance-ops', 'jobs.manage'),
+    ('finance-ops', 'transactions.act_on_behalf')
+) AS v(role, permission)
+JOIN new_roles ON new_roles.name = v.role;
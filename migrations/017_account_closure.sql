@@ -0,0 +1,11 @@
+-- Closed accounts are kept, together with their ledger history, instead of
+-- being deleted. closed_by is the staff member who closed the account.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS closed_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS closed_by INTEGER REFERENCES users(id);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS closure_reason TEXT;
+
+-- users.delete was replaced by users.close
+INSERT INTO role_permissions (role, permission)
+SELECT role, 'users.close' FROM role_permissions WHERE permission = 'users.delete'
+ON CONFLICT DO NOTHING;
+DELETE FROM role_permissions WHERE permission = 'users.delete';
@@ -0,0 +1,25 @@
+-- Restrictions staff place on an account, e.g. while it is under
+-- investigation. A state with an expiry reverts to active once it passes.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS state VARCHAR(20) NOT NULL DEFAULT 'active';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS state_reason TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS state_expires_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_users_state_expires_at ON users(state_expires_at) WHERE state_expires_at IS NOT NULL;
+
+-- The compliance role, and users.restrict for admins. Only granted when the
+-- role is first created, so later changes survive restarts.
+WITH new_roles AS (
+    INSERT INTO roles (name, description) VALUES
+        ('compliance', 'Investigates customers and restricts their accounts')
+    ON CONFLICT (name) DO NOTHING
+    RETURNING name
+)
+INSERT INTO role_permissions (role, permission)
+SELECT v.role, v.permission FROM (VALUES
+    ('admin', 'users.restrict'),
+    ('compliance', 'users.read'),
+    ('compliance', 'users.restrict'),
+    ('compliance', 'ledger.read')
+) AS v(role, permission)
+CROSS JOIN new_roles
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,60 @@
+-- Accounts owned by users. Every user has a default account, which is used
+-- when a transaction names a user but no account.
+CREATE SEQUENCE IF NOT EXISTS account_numbers START 1000000001;
+
+CREATE TABLE IF NOT EXISTS accounts (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    number VARCHAR(20) NOT NULL UNIQUE DEFAULT nextval('account_numbers')::text,
+    name VARCHAR(100) NOT NULL DEFAULT '',
+    type VARCHAR(20) NOT NULL CHECK (type IN ('checking', 'savings')),
+    currency CHAR(3) NOT NULL DEFAULT 'USD',
+    status VARCHAR(20) NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'closed')),
+    is_default BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    closed_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_accounts_user ON accounts(user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_accounts_default ON accounts(user_id) WHERE is_default;
+
+-- Balances are kept per account. The per-user balances table is no longer
+-- written to.
+CREATE TABLE IF NOT EXISTS account_balances (
+    account_id INTEGER PRIMARY KEY REFERENCES accounts(id),
+    amount BIGINT NOT NULL DEFAULT 0,
+    last_updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS from_account_id INTEGER REFERENCES accounts(id);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS to_account_id INTEGER REFERENCES accounts(id);
+ALTER TABLE postings ADD COLUMN IF NOT EXISTS account_id INTEGER REFERENCES accounts(id);
+
+CREATE INDEX IF NOT EXISTS idx_transactions_from_account ON transactions(from_account_id);
+CREATE INDEX IF NOT EXISTS idx_transactions_to_account ON transactions(to_account_id);
+CREATE INDEX IF NOT EXISTS idx_postings_account ON postings(account_id);
+
+-- Move users that predate accounts, with their balances and history, onto a
+-- default account
+INSERT INTO accounts (user_id, name, type, is_default)
+SELECT u.id, 'Main', 'checking', TRUE
+FROM users u
+WHERE NOT EXISTS (SELECT 1 FROM accounts a WHERE a.user_id = u.id AND a.is_default);
+
+INSERT INTO account_balances (account_id, amount, last_updated_at)
+SELECT a.id, b.amount, b.last_updated_at
+FROM balances b
+JOIN accounts a ON a.user_id = b.user_id AND a.is_default
+ON CONFLICT (account_id) DO NOTHING;
+
+UPDATE transactions t SET from_account_id = a.id
+FROM accounts a
+WHERE t.from_account_id IS NULL AND a.user_id = t.from_user_id AND a.is_default;
+
+UPDATE transactions t SET to_account_id = a.id
+FROM accounts a
+WHERE t.to_account_id IS NULL AND a.user_id = t.to_user_id AND a.is_default;
+
+UPDATE postings p SET account_id = a.id
+FROM accounts a
+WHERE p.account_id IS NULL AND a.user_id = p.user_id AND a.is_default;
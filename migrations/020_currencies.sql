@@ -0,0 +1,42 @@
+-- Amounts are in the minor unit of a currency. A transaction takes amount in
+-- currency from its source and pays to_amount in to_currency into its
+-- destination. fx_rate is the rate applied when the two differ.
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD';
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS to_amount BIGINT;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS to_currency CHAR(3) NOT NULL DEFAULT 'USD';
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fx_rate NUMERIC CHECK (fx_rate > 0);
+
+UPDATE transactions SET to_amount = amount WHERE to_amount IS NULL;
+
+ALTER TABLE postings ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD';
+
+-- Exchange rates maintained by staff, used when FX_RATE_SOURCE is table. A
+-- rate converts one unit of base into quote.
+CREATE TABLE IF NOT EXISTS fx_rates (
+    id SERIAL PRIMARY KEY,
+    base CHAR(3) NOT NULL,
+    quote CHAR(3) NOT NULL,
+    rate NUMERIC NOT NULL CHECK (rate > 0),
+    updated_by INTEGER REFERENCES users(id),
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (base, quote),
+    CHECK (base <> quote)
+);
+
+-- The treasury role, and fx.manage for admins and finance-ops. Only granted
+-- when the role is first created, so later changes survive restarts.
+WITH new_roles AS (
+    INSERT INTO roles (name, description) VALUES
+        ('treasury', 'Maintains exchange rates')
+    ON CONFLICT (name) DO NOTHING
+    RETURNING name
+)
+INSERT INTO role_permissions (role, permission)
+SELECT v.role, v.permission FROM (VALUES
+    ('admin', 'fx.manage'),
+    ('finance-ops', 'fx.manage'),
+    ('treasury', 'fx.manage'),
+    ('treasury', 'ledger.read')
+) AS v(role, permission)
+CROSS JOIN new_roles
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,25 @@
+-- Holds reserve funds in an account until they are captured into a
+-- transaction, voided or expire. An active hold that has not expired reduces
+-- the available balance of from_account_id but not its ledger balance.
+CREATE TABLE IF NOT EXISTS holds (
+    id SERIAL PRIMARY KEY,
+    from_user_id INTEGER NOT NULL REFERENCES users(id),
+    from_account_id INTEGER NOT NULL REFERENCES accounts(id),
+    to_user_id INTEGER REFERENCES users(id),
+    to_account_id INTEGER REFERENCES accounts(id),
+    amount BIGINT NOT NULL CHECK (amount > 0),
+    currency CHAR(3) NOT NULL,
+    captured_amount BIGINT,
+    description VARCHAR(255) NOT NULL DEFAULT '',
+    status VARCHAR(20) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'captured', 'voided', 'expired')),
+    created_by INTEGER NOT NULL REFERENCES users(id),
+    transaction_id INTEGER REFERENCES transactions(id),
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    closed_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_holds_active_account ON holds(from_account_id) WHERE status = 'active';
+CREATE INDEX IF NOT EXISTS idx_holds_active_expires_at ON holds(expires_at) WHERE status = 'active';
+CREATE INDEX IF NOT EXISTS idx_holds_from_user ON holds(from_user_id);
+CREATE INDEX IF NOT EXISTS idx_holds_created_by ON holds(created_by);
@@ -0,0 +1,34 @@
+-- Standing orders are transfers the scheduler submits on a user's behalf,
+-- once on start_date or every day, week or month up to end_date. Dates are
+-- in UTC. next_run_date is the payment due next and next_attempt_at when the
+-- scheduler tries it, which moves on while retrying for lack of funds.
+-- locked_until is the lease of the scheduler instance running the order.
+CREATE TABLE IF NOT EXISTS standing_orders (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    from_account_id INTEGER NOT NULL REFERENCES accounts(id),
+    to_user_id INTEGER NOT NULL REFERENCES users(id),
+    to_account_id INTEGER NOT NULL REFERENCES accounts(id),
+    amount BIGINT NOT NULL CHECK (amount > 0),
+    description VARCHAR(255) NOT NULL DEFAULT '',
+    frequency VARCHAR(10) NOT NULL CHECK (frequency IN ('once', 'daily', 'weekly', 'monthly')),
+    start_date DATE NOT NULL,
+    end_date DATE,
+    on_insufficient_funds VARCHAR(10) NOT NULL DEFAULT 'retry' CHECK (on_insufficient_funds IN ('retry', 'skip')),
+    status VARCHAR(20) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'completed', 'cancelled')),
+    next_run_date DATE NOT NULL,
+    next_attempt_at TIMESTAMPTZ NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    run_count INTEGER NOT NULL DEFAULT 0,
+    last_run_at TIMESTAMPTZ,
+    last_transaction_id INTEGER REFERENCES transactions(id),
+    last_error TEXT NOT NULL DEFAULT '',
+    locked_until TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    CHECK (from_account_id <> to_account_id),
+    CHECK (end_date IS NULL OR end_date >= start_date)
+);
+
+CREATE INDEX IF NOT EXISTS idx_standing_orders_due ON standing_orders(next_attempt_at) WHERE status = 'active';
+CREATE INDEX IF NOT EXISTS idx_standing_orders_user ON standing_orders(user_id);
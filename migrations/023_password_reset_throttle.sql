@@ -0,0 +1,2 @@
+-- When the last password reset link was sent, to limit how often they are sent
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_reset_sent_at TIMESTAMPTZ;
@@ -0,0 +1,6 @@
+-- Emails are stored lowercase so logins and lockouts match them whatever
+-- their case. Addresses that would collide with another account once
+-- lowercased are left for an admin to resolve.
+UPDATE users SET email = LOWER(TRIM(email))
+WHERE email <> LOWER(TRIM(email))
+    AND NOT EXISTS (SELECT 1 FROM users other WHERE other.id <> users.id AND LOWER(TRIM(other.email)) = LOWER(TRIM(users.email)));
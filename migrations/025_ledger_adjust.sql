@@ -0,0 +1,21 @@
+-- Built-in permissions added after the roles holding them were created.
+-- Each is granted once, when first seeded, so that later changes made
+-- through the API survive restarts.
+CREATE TABLE IF NOT EXISTS seeded_permissions (
+    permission VARCHAR(100) PRIMARY KEY,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+WITH new_permissions AS (
+    INSERT INTO seeded_permissions (permission) VALUES ('ledger.adjust')
+    ON CONFLICT (permission) DO NOTHING
+    RETURNING permission
+)
+INSERT INTO role_permissions (role, permission)
+SELECT v.role, v.permission FROM (VALUES
+    ('admin', 'ledger.adjust'),
+    ('finance-ops', 'ledger.adjust')
+) AS v(role, permission)
+JOIN new_permissions ON new_permissions.permission = v.permission
+JOIN roles ON roles.name = v.role
+ON CONFLICT DO NOTHING;
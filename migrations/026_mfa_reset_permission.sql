@@ -0,0 +1,14 @@
+-- Resetting MFA was split out of users.write, so support staff no longer
+-- have it. Granted once to admins, like the permissions in 025.
+WITH new_permissions AS (
+    INSERT INTO seeded_permissions (permission) VALUES ('users.mfa_reset')
+    ON CONFLICT (permission) DO NOTHING
+    RETURNING permission
+)
+INSERT INTO role_permissions (role, permission)
+SELECT v.role, v.permission FROM (VALUES
+    ('admin', 'users.mfa_reset')
+) AS v(role, permission)
+JOIN new_permissions ON new_permissions.permission = v.permission
+JOIN roles ON roles.name = v.role
+ON CONFLICT DO NOTHING;